@@ -0,0 +1,196 @@
+// Package checker lets organizers reach team services through the game network.
+// Checker connections are built by the same onion path machinery as team traffic,
+// with the same hop policy, so defenders can not tell them apart.
+package checker
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync/atomic"
+
+	"github.com/derlaft/pe2pectf/common"
+	"github.com/derlaft/pe2pectf/node"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pkg/errors"
+)
+
+// Options configure a checker
+type Options struct {
+	// network map (the identities should be listed there like team nodes)
+	NetworkConfig string
+	Network       *common.NetworkSettings
+
+	// private crypto keys of the checker identities
+	// (identities with OrganizerPrivateKey reach organizer-only services with DialRestricted)
+	IdentityConfigs []string
+	Identities      []*common.CryptoSettings
+
+	// relay listen addr of each identity (empty - a random port on all interfaces)
+	ListenAddrs []string
+}
+
+// Checker dials team services, connections are spread over the identities
+// and entry relays round-robin. It is safe for concurrent use.
+type Checker struct {
+	nodes []*node.Node
+
+	nextNode  uint32
+	nextRelay uint32
+}
+
+// New loads the identities and creates a node for each of them
+func New(opts Options) (*Checker, error) {
+
+	var identities = append([]*common.CryptoSettings(nil), opts.Identities...)
+
+	for _, fname := range opts.IdentityConfigs {
+		cs, err := common.LoadCryptoSettings(fname)
+		if err != nil {
+			return nil, errors.Wrapf(err, "loading identity %v", fname)
+		}
+
+		identities = append(identities, cs)
+	}
+
+	if len(identities) == 0 {
+		return nil, errors.New("no checker identities provided")
+	}
+
+	if len(opts.ListenAddrs) > 0 && len(opts.ListenAddrs) != len(identities) {
+		return nil, errors.Errorf("%v listen addrs for %v identities", len(opts.ListenAddrs), len(identities))
+	}
+
+	var c = new(Checker)
+
+	for i, identity := range identities {
+
+		var listenAddr = "0.0.0.0:0"
+		if len(opts.ListenAddrs) > 0 {
+			listenAddr = opts.ListenAddrs[i]
+		}
+
+		n, err := node.New(node.Options{
+			ListenAddr:    listenAddr,
+			NetworkConfig: opts.NetworkConfig,
+			Network:       opts.Network,
+			Crypto:        identity,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "identity %v", i)
+		}
+
+		c.nodes = append(c.nodes, n)
+	}
+
+	return c, nil
+}
+
+// Start connects all identities to the network
+func (c *Checker) Start(ctx context.Context) error {
+
+	for i, n := range c.nodes {
+		err := n.Start(ctx)
+		if err != nil {
+			_ = c.Close()
+			return errors.Wrapf(err, "starting identity %v", i)
+		}
+	}
+
+	return nil
+}
+
+// Close disconnects all identities from the network
+func (c *Checker) Close() error {
+
+	var err error
+
+	for _, n := range c.nodes {
+		closeErr := n.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// Reload reads the network map from the disk again
+func (c *Checker) Reload() error {
+
+	var err error
+
+	for _, n := range c.nodes {
+		reloadErr := n.Reload()
+		if err == nil {
+			err = reloadErr
+		}
+	}
+
+	return err
+}
+
+// Dial connects to a team service like "team2:4041" or "10.0.0.2:4041"
+func (c *Checker) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to a team service using the provided context
+func (c *Checker) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return c.dial(ctx, network, addr, false)
+}
+
+// DialRestricted connects to an organizer-only service, the exit can tell such connections
+// apart from team traffic, so other services should be dialed with DialContext
+func (c *Checker) DialRestricted(ctx context.Context, network, addr string) (net.Conn, error) {
+	return c.dial(ctx, network, addr, true)
+}
+
+func (c *Checker) dial(ctx context.Context, network, addr string, exitAuth bool) (net.Conn, error) {
+
+	var n = c.nodes[int(atomic.AddUint32(&c.nextNode, 1)-1)%len(c.nodes)]
+
+	dialer := n.Dialer()
+	dialer.EntryRelay = c.entryRelay(n.Network(), n.ID(), addr)
+	dialer.ExitAuth = exitAuth
+
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// entryRelay picks the next member to enter the network through,
+// excluding the identity itself and the target
+func (c *Checker) entryRelay(ns *common.NetworkSettings, self peer.ID, addr string) peer.ID {
+
+	if ns == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+
+	var (
+		dest, _ = ns.PeerIDForHost(host)
+		relays  []peer.ID
+	)
+
+	for id := range ns.Nodes {
+		if id == self || id == dest {
+			continue
+		}
+
+		relays = append(relays, id)
+	}
+
+	if len(relays) == 0 {
+		return ""
+	}
+
+	// map order is random, the rotation needs a stable one
+	sort.Slice(relays, func(i, j int) bool {
+		return relays[i] < relays[j]
+	})
+
+	return relays[int(atomic.AddUint32(&c.nextRelay, 1)-1)%len(relays)]
+}
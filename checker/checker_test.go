@@ -0,0 +1,131 @@
+package checker
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/derlaft/pe2pectf/common"
+	"github.com/derlaft/pe2pectf/internal/nodetest"
+	"github.com/derlaft/pe2pectf/node"
+	core "github.com/libp2p/go-libp2p-core"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecker(t *testing.T) {
+
+	var (
+		cryptoT, idT, memberT = nodetest.Member(t, "team1", "10.0.0.1")
+		cryptoA, idA, memberA = nodetest.Member(t, "checker1", "10.0.0.101")
+		cryptoB, idB, memberB = nodetest.Member(t, "checker2", "10.0.0.102")
+		nodes                 = map[core.PeerID]common.Member{idT: memberT, idA: memberA, idB: memberB}
+	)
+
+	// a team serves a virtual port
+	team, err := node.New(node.Options{
+		ListenAddr: "127.0.0.1:0",
+		Crypto:     cryptoT,
+		Network:    &common.NetworkSettings{Nodes: nodes},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	err = team.Start(context.Background())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer team.Close()
+
+	l, err := team.Listen(4041)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	_, err = New(Options{})
+	assert.Error(t, err, "no identities")
+
+	_, err = New(Options{Identities: []*common.CryptoSettings{cryptoA}, ListenAddrs: []string{"a", "b"}})
+	assert.Error(t, err, "listen addrs mismatch")
+
+	c, err := New(Options{
+		Identities:  []*common.CryptoSettings{cryptoA, cryptoB},
+		ListenAddrs: []string{"127.0.0.1:0", "127.0.0.1:0"},
+		Network: &common.NetworkSettings{
+			DHT:   common.DHTSettings{Bootstrap: []string{team.Addr()}},
+			Nodes: nodes,
+		},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	err = c.Start(context.Background())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer c.Close()
+
+	// default path length: each identity enters through the other one
+	for i := 0; i < 4; i++ {
+		conn, err := c.Dial("tcp", "team1:4041")
+		if !assert.NoError(t, err) {
+			continue
+		}
+
+		_, err = conn.Write([]byte("ping"))
+		assert.NoError(t, err)
+
+		var buf [4]byte
+		_, err = io.ReadFull(conn, buf[:])
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(buf[:]))
+
+		conn.Close()
+	}
+}
+
+func TestEntryRelay(t *testing.T) {
+
+	var (
+		_, idA, memberA = nodetest.Member(t, "checker1", "10.0.0.101")
+		_, idB, memberB = nodetest.Member(t, "team1", "10.0.0.1")
+		_, idC, memberC = nodetest.Member(t, "team2", "10.0.0.2")
+		_, idD, memberD = nodetest.Member(t, "team3", "10.0.0.3")
+		ns              = &common.NetworkSettings{
+			Nodes: map[core.PeerID]common.Member{idA: memberA, idB: memberB, idC: memberC, idD: memberD},
+		}
+		c = new(Checker)
+	)
+
+	// neither self nor the target are used, the rest take turns
+	var seen = make(map[peer.ID]int)
+	for i := 0; i < 4; i++ {
+		seen[c.entryRelay(ns, idA, "team1:4041")]++
+	}
+	assert.Equal(t, map[peer.ID]int{idC: 2, idD: 2}, seen)
+
+	first := c.entryRelay(ns, idA, "10.0.0.2:4041")
+	second := c.entryRelay(ns, idA, "10.0.0.2:4041")
+	assert.NotEqual(t, first, second)
+	assert.NotEqual(t, idC, first)
+	assert.NotEqual(t, idC, second)
+
+	assert.Equal(t, peer.ID(""), c.entryRelay(nil, idA, "team1:4041"))
+	assert.Equal(t, peer.ID(""), c.entryRelay(ns, idA, "team1"))
+}
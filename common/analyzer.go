@@ -0,0 +1,562 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultFlagPattern matches the usual flag format of the checkers
+const DefaultFlagPattern = `[A-Z0-9]{31}=`
+
+// DefaultAnalyzerHistory is the amount of streams kept per service
+const DefaultAnalyzerHistory = 1000
+
+const (
+	analyzerHeadSize    = 256   // first bytes of each direction kept per stream
+	analyzerOverlap     = 256   // response bytes kept between reads (flags split across them)
+	analyzerMaxLine     = 1024  // longer lines are not parsed as HTTP requests
+	analyzerMaxRequests = 64    // request lines kept per stream
+	analyzerMaxAlerts   = 10000 // alerts kept in total
+	analyzerQueryLimit  = 100   // default amount of streams returned by the query API
+)
+
+// httpRequestLine matches a HTTP/1.x request line
+var httpRequestLine = regexp.MustCompile(`^[A-Z]+ \S+ HTTP/1\.[01]$`) //nolint:gochecknoglobals
+
+// StreamInfo is the index entry of a stream to a service
+type StreamInfo struct {
+	ID      string
+	Service string // mapping of the service
+	Port    int
+	Backend string
+	// synthetic source address of the circuit (the same for streams of one isolation group)
+	Circuit string
+
+	Start  time.Time
+	End    time.Time // zero while open
+	Closed bool
+
+	// bytes sent to the service and to the client
+	Sent     int64
+	Received int64
+	// first bytes sent to the service and to the client
+	Head         string
+	ResponseHead string
+	// HTTP request lines sent to the service
+	Requests []string
+	// flags found in the responses
+	Flags []string
+}
+
+// FlagAlert is raised when a flag leaves a service
+type FlagAlert struct {
+	Time    time.Time
+	Flag    string
+	Stream  string
+	Service string
+	Circuit string
+	// the last HTTP request line of the stream before the flag (empty - not HTTP)
+	Request string
+}
+
+// StreamQuery selects indexed streams, empty fields match everything
+type StreamQuery struct {
+	Service string
+	Circuit string
+	// only streams that leaked a flag (Flag - this one)
+	Leaked bool
+	Flag   string
+	Since  time.Time
+	// newest streams are returned first (0 - all of them)
+	Limit int
+}
+
+// analyzer indexes streams of mapped services and looks for flags in the responses
+type analyzer struct {
+	pattern *regexp.Regexp
+	history int
+
+	lock     sync.RWMutex
+	services map[string][]*analyzedStream // oldest first
+	alerts   []FlagAlert
+
+	server *http.Server
+	shadow *shadowStats
+}
+
+// analyzedStream is the state of a stream being indexed
+type analyzedStream struct {
+	analyzer *analyzer
+
+	lock sync.Mutex
+	info StreamInfo
+	line []byte // incomplete request line
+	long bool   // the current line is too long
+	tail []byte // end of the response so far
+	seen map[string]bool
+}
+
+// StartAnalyzer indexes streams of mapped services and serves the query API
+// if AnalyzerAddr is set
+func (c *Client) StartAnalyzer() error {
+
+	if c.Settings.AnalyzerAddr == "" {
+		return nil
+	}
+
+	var pattern = c.Settings.FlagPattern
+	if pattern == "" {
+		pattern = DefaultFlagPattern
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return errors.Wrap(err, "parsing flag pattern")
+	}
+
+	var history = c.Settings.AnalyzerHistory
+	if history <= 0 {
+		history = DefaultAnalyzerHistory
+	}
+
+	listener, err := net.Listen("tcp", c.Settings.AnalyzerAddr)
+	if err != nil {
+		return errors.Wrap(err, "listening for analyzer queries")
+	}
+
+	var an = &analyzer{
+		pattern:  re,
+		history:  history,
+		services: make(map[string][]*analyzedStream),
+		shadow:   &c.shadow,
+	}
+
+	an.server = &http.Server{
+		Handler:           an,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		err := an.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("Analyzer API stopped: %v", err)
+		}
+	}()
+
+	c.analyzer = an
+
+	return nil
+}
+
+// stopAnalyzer stops the query API
+func (c *Client) stopAnalyzer() {
+	if c.analyzer != nil && c.analyzer.server != nil {
+		_ = c.analyzer.server.Close()
+	}
+}
+
+// Streams returns the indexed streams matching the query
+func (c *Client) Streams(query StreamQuery) []StreamInfo {
+
+	if c.analyzer == nil {
+		return nil
+	}
+
+	return c.analyzer.streams(query)
+}
+
+// FlagAlerts returns the alerts raised since the time
+func (c *Client) FlagAlerts(since time.Time) []FlagAlert {
+
+	if c.analyzer == nil {
+		return nil
+	}
+
+	return c.analyzer.flagAlerts(since, "")
+}
+
+// wrap indexes a stream to a service
+func (an *analyzer) wrap(mapping, backend string, conn net.Conn, req *connectionOpenRequest) net.Conn {
+
+	var as = &analyzedStream{
+		analyzer: an,
+		info: StreamInfo{
+			ID:      req.StreamID.String(),
+			Service: mapping,
+			Port:    int(req.Port),
+			Backend: backend,
+			Circuit: circuitAddr(req.Circuit).String(),
+			Start:   time.Now(),
+		},
+		seen: make(map[string]bool),
+	}
+
+	an.lock.Lock()
+	var streams = append(an.services[mapping], as)
+	if len(streams) > an.history {
+		streams = append(streams[:0:0], streams[len(streams)-an.history:]...)
+	}
+	an.services[mapping] = streams
+	an.lock.Unlock()
+
+	return &analyzedConn{Conn: conn, stream: as}
+}
+
+// alert records a flag that left a service
+func (an *analyzer) alert(alert FlagAlert) {
+
+	log.Warningf("Flag %v left %v in stream %v (circuit %v, request %q)",
+		alert.Flag, alert.Service, alert.Stream, alert.Circuit, alert.Request)
+
+	an.lock.Lock()
+	defer an.lock.Unlock()
+
+	an.alerts = append(an.alerts, alert)
+	if len(an.alerts) > analyzerMaxAlerts {
+		an.alerts = append(an.alerts[:0:0], an.alerts[len(an.alerts)-analyzerMaxAlerts:]...)
+	}
+}
+
+// streams returns the matching streams, newest first
+func (an *analyzer) streams(query StreamQuery) []StreamInfo {
+
+	an.lock.RLock()
+	var candidates []*analyzedStream
+	for mapping, streams := range an.services {
+		if query.Service == "" || query.Service == mapping {
+			candidates = append(candidates, streams...)
+		}
+	}
+	an.lock.RUnlock()
+
+	var result []StreamInfo
+	for _, as := range candidates {
+		info := as.snapshot()
+		if query.matches(&info) {
+			result = append(result, info)
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Start.After(result[j].Start)
+	})
+
+	if query.Limit > 0 && len(result) > query.Limit {
+		result = result[:query.Limit]
+	}
+
+	return result
+}
+
+// stream returns a stream by its ID
+func (an *analyzer) stream(id string) (StreamInfo, bool) {
+
+	an.lock.RLock()
+	defer an.lock.RUnlock()
+
+	for _, streams := range an.services {
+		for _, as := range streams {
+			if as.info.ID == id {
+				return as.snapshot(), true
+			}
+		}
+	}
+
+	return StreamInfo{}, false
+}
+
+// flagAlerts returns the alerts raised since the time (about the service if not empty)
+func (an *analyzer) flagAlerts(since time.Time, service string) []FlagAlert {
+
+	an.lock.RLock()
+	defer an.lock.RUnlock()
+
+	var result = []FlagAlert{}
+	for _, alert := range an.alerts {
+		if alert.Time.Before(since) || (service != "" && alert.Service != service) {
+			continue
+		}
+		result = append(result, alert)
+	}
+
+	return result
+}
+
+func (q *StreamQuery) matches(info *StreamInfo) bool {
+
+	if q.Circuit != "" && q.Circuit != info.Circuit {
+		return false
+	}
+
+	if info.Start.Before(q.Since) {
+		return false
+	}
+
+	if q.Leaked && len(info.Flags) == 0 {
+		return false
+	}
+
+	if q.Flag != "" {
+		for _, flag := range info.Flags {
+			if flag == q.Flag {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// snapshot returns a copy of the stream info
+func (as *analyzedStream) snapshot() StreamInfo {
+
+	as.lock.Lock()
+	defer as.lock.Unlock()
+
+	var info = as.info
+	info.Requests = append([]string(nil), info.Requests...)
+	info.Flags = append([]string(nil), info.Flags...)
+
+	return info
+}
+
+// sent indexes data sent to the service
+func (as *analyzedStream) sent(data []byte) {
+
+	as.lock.Lock()
+	defer as.lock.Unlock()
+
+	as.info.Sent += int64(len(data))
+	as.info.Head = appendHead(as.info.Head, data)
+
+	for len(data) > 0 {
+		var (
+			end  = bytes.IndexByte(data, '\n')
+			part = data
+		)
+		if end >= 0 {
+			part = data[:end]
+		}
+
+		if !as.long {
+			as.line = append(as.line, part...)
+			if len(as.line) > analyzerMaxLine {
+				as.line, as.long = as.line[:0], true
+			}
+		}
+
+		if end < 0 {
+			break
+		}
+
+		line := strings.TrimSuffix(string(as.line), "\r")
+		if !as.long && len(as.info.Requests) < analyzerMaxRequests && httpRequestLine.MatchString(line) {
+			as.info.Requests = append(as.info.Requests, line)
+		}
+
+		as.line, as.long = as.line[:0], false
+		data = data[end+1:]
+	}
+}
+
+// received indexes data sent to the client and raises alerts about new flags in it
+func (as *analyzedStream) received(data []byte) {
+
+	as.lock.Lock()
+
+	as.info.Received += int64(len(data))
+	as.info.ResponseHead = appendHead(as.info.ResponseHead, data)
+
+	var (
+		buf    = append(as.tail, data...)
+		alerts []FlagAlert
+	)
+
+	for _, loc := range as.analyzer.pattern.FindAllIndex(buf, -1) {
+
+		// flags inside the kept tail were checked with the previous data
+		var flag = string(buf[loc[0]:loc[1]])
+		if loc[1] <= len(as.tail) || flag == "" || as.seen[flag] {
+			continue
+		}
+		as.seen[flag] = true
+
+		as.info.Flags = append(as.info.Flags, flag)
+
+		var request string
+		if len(as.info.Requests) > 0 {
+			request = as.info.Requests[len(as.info.Requests)-1]
+		}
+
+		alerts = append(alerts, FlagAlert{
+			Time:    time.Now(),
+			Flag:    flag,
+			Stream:  as.info.ID,
+			Service: as.info.Service,
+			Circuit: as.info.Circuit,
+			Request: request,
+		})
+	}
+
+	if len(buf) > analyzerOverlap {
+		buf = buf[len(buf)-analyzerOverlap:]
+	}
+	as.tail = append(as.tail[:0], buf...)
+
+	as.lock.Unlock()
+
+	for _, alert := range alerts {
+		as.analyzer.alert(alert)
+	}
+}
+
+// close marks the stream finished
+func (as *analyzedStream) close() {
+
+	as.lock.Lock()
+	defer as.lock.Unlock()
+
+	if !as.info.Closed {
+		as.info.Closed = true
+		as.info.End = time.Now()
+	}
+}
+
+// appendHead appends data to the head of a stream up to analyzerHeadSize bytes
+func appendHead(head string, data []byte) string {
+
+	if len(head) >= analyzerHeadSize {
+		return head
+	}
+
+	if len(data) > analyzerHeadSize-len(head) {
+		data = data[:analyzerHeadSize-len(head)]
+	}
+
+	return head + string(data)
+}
+
+// ServeHTTP implements the query API:
+// GET /streams?service=&circuit=&flag=&leaked=1&since=RFC3339&limit=, GET /streams/<id>,
+// GET /alerts?service=&since=RFC3339, GET /shadow (ShadowStats by mapping)
+func (an *analyzer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var params = r.URL.Query()
+
+	since, err := parseSince(params.Get("since"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/streams":
+		var query = StreamQuery{
+			Service: params.Get("service"),
+			Circuit: params.Get("circuit"),
+			Flag:    params.Get("flag"),
+			Leaked:  params.Get("leaked") != "",
+			Since:   since,
+			Limit:   analyzerQueryLimit,
+		}
+
+		if limit := params.Get("limit"); limit != "" {
+			query.Limit, err = strconv.Atoi(limit)
+			if err != nil {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
+
+		var streams = an.streams(query)
+		if streams == nil {
+			streams = []StreamInfo{}
+		}
+		writeJSON(w, streams)
+
+	case strings.HasPrefix(r.URL.Path, "/streams/"):
+		info, found := an.stream(strings.TrimPrefix(r.URL.Path, "/streams/"))
+		if !found {
+			http.Error(w, "Stream not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, info)
+
+	case r.URL.Path == "/alerts":
+		writeJSON(w, an.flagAlerts(since, params.Get("service")))
+
+	case r.URL.Path == "/shadow" && an.shadow != nil:
+		writeJSON(w, an.shadow.snapshot())
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// parseSince parses an optional RFC 3339 time
+func parseSince(value string) (time.Time, error) {
+
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	since, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid time %q (RFC 3339 expected)", value)
+	}
+
+	return since, nil
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Debugf("Failed to write analyzer response: %v", err)
+	}
+}
+
+// analyzedConn indexes the traffic of a service connection
+type analyzedConn struct {
+	net.Conn
+	stream *analyzedStream
+}
+
+func (ac *analyzedConn) Read(b []byte) (int, error) {
+	n, err := ac.Conn.Read(b)
+	if n > 0 {
+		ac.stream.received(b[:n])
+	}
+	return n, err
+}
+
+func (ac *analyzedConn) Write(b []byte) (int, error) {
+	n, err := ac.Conn.Write(b)
+	if n > 0 {
+		ac.stream.sent(b[:n])
+	}
+	return n, err
+}
+
+func (ac *analyzedConn) Close() error {
+	ac.stream.close()
+	return ac.Conn.Close()
+}
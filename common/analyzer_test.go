@@ -0,0 +1,103 @@
+package common
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnalyzer(t *testing.T) {
+
+	var (
+		an = &analyzer{
+			pattern:  regexp.MustCompile(DefaultFlagPattern),
+			history:  2,
+			services: make(map[string][]*analyzedStream),
+		}
+		flag = "ABCDEFGHIJKLMNOPQRSTUVWXYZ01234="
+		req  = connectionOpenRequest{Port: 4041, StreamID: uuid.New(), Circuit: [8]byte{1}}
+	)
+
+	service, backend := net.Pipe()
+	conn := an.wrap("4041", "127.0.0.1:8080", service, &req)
+
+	go func() {
+		buf := make([]byte, 1024)
+		_, _ = backend.Read(buf)
+		_, _ = backend.Read(buf)
+
+		// the flag is split between reads and sent twice
+		_, _ = backend.Write([]byte("HTTP/1.1 200 OK\r\n\r\n" + flag[:10]))
+		_, _ = backend.Write([]byte(flag[10:] + " " + flag))
+	}()
+
+	_, err := conn.Write([]byte("GET /note?id=1'%20or%201=1 HTTP/1.1\r\nHost: x\r\n"))
+	assert.NoError(t, err)
+	_, err = conn.Write([]byte("\r\n"))
+	assert.NoError(t, err)
+
+	var buf = make([]byte, 1024)
+	for received := 0; received < 19+2*len(flag)+1; {
+		n, err := conn.Read(buf)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		received += n
+	}
+	assert.NoError(t, conn.Close())
+
+	alerts := an.flagAlerts(time.Time{}, "")
+	if !assert.Len(t, alerts, 1) {
+		t.FailNow()
+	}
+	assert.Equal(t, flag, alerts[0].Flag)
+	assert.Equal(t, req.StreamID.String(), alerts[0].Stream)
+	assert.Equal(t, "GET /note?id=1'%20or%201=1 HTTP/1.1", alerts[0].Request)
+	assert.Equal(t, circuitAddr(req.Circuit).String(), alerts[0].Circuit)
+
+	streams := an.streams(StreamQuery{Flag: flag})
+	if !assert.Len(t, streams, 1) {
+		t.FailNow()
+	}
+	assert.True(t, streams[0].Closed)
+	assert.Equal(t, int64(len("GET /note?id=1'%20or%201=1 HTTP/1.1\r\nHost: x\r\n\r\n")), streams[0].Sent)
+	assert.Equal(t, "127.0.0.1:8080", streams[0].Backend)
+	assert.Equal(t, []string{"GET /note?id=1'%20or%201=1 HTTP/1.1"}, streams[0].Requests)
+
+	// only the latest streams are kept
+	for i := 0; i < 2; i++ {
+		_ = an.wrap("4041", "", service, &connectionOpenRequest{StreamID: uuid.New()})
+	}
+	assert.Len(t, an.streams(StreamQuery{}), 2)
+	assert.Len(t, an.streams(StreamQuery{Leaked: true}), 0)
+	assert.Len(t, an.flagAlerts(time.Time{}, ""), 1)
+
+	// query API
+	var (
+		w       = httptest.NewRecorder()
+		results []StreamInfo
+	)
+	an.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/streams?service=4041&limit=1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &results))
+	assert.Len(t, results, 1)
+
+	w = httptest.NewRecorder()
+	an.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/alerts?service=80", nil))
+	assert.Equal(t, "[]\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	an.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/streams/"+req.StreamID.String(), nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	an.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/streams?since=yesterday", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
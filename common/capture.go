@@ -0,0 +1,566 @@
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// capture file formats
+const (
+	CapturePcapNG = "pcapng" // default, stream IDs are packet comments
+	CapturePcap   = "pcap"   // no stream IDs
+)
+
+// DefaultCaptureFileSize is the size capture files are rotated at
+const DefaultCaptureFileSize = 64 << 20
+
+const (
+	captureLinkType = 101   // LINKTYPE_RAW: packets start with the IP header
+	captureSnapLen  = 65535 // maximum packet size
+	captureSegment  = 32768 // maximum payload of a synthetic TCP segment
+	captureWindow   = 65535
+)
+
+// TCP flags of synthetic segments
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// capture writes decrypted exit streams into per-service capture files
+type capture struct {
+	dir    string
+	format string
+	limit  int64
+
+	lock   sync.Mutex
+	files  map[string]*captureFile
+	closed bool
+}
+
+// captureFile is the current capture file of a service
+type captureFile struct {
+	name   string
+	format string
+	limit  int64
+
+	lock   sync.Mutex
+	file   *os.File
+	buf    *bufio.Writer
+	size   int64
+	files  int  // opened so far
+	closed bool // streams still running after stopCapture are not recorded
+}
+
+// StartCapture records streams of mapped services if CaptureDir is set
+func (c *Client) StartCapture() error {
+
+	if c.Settings.CaptureDir == "" {
+		return nil
+	}
+
+	var format = c.Settings.CaptureFormat
+	if format == "" {
+		format = CapturePcapNG
+	}
+	if format != CapturePcapNG && format != CapturePcap {
+		return errors.Errorf("unknown capture format %v", format)
+	}
+
+	var limit = c.Settings.CaptureFileSize
+	if limit <= 0 {
+		limit = DefaultCaptureFileSize
+	}
+
+	err := os.MkdirAll(c.Settings.CaptureDir, 0750)
+	if err != nil {
+		return errors.Wrap(err, "creating capture dir")
+	}
+
+	c.capture = &capture{
+		dir:    c.Settings.CaptureDir,
+		format: format,
+		limit:  limit,
+		files:  make(map[string]*captureFile),
+	}
+
+	return nil
+}
+
+// stopCapture flushes and closes the capture files
+func (c *Client) stopCapture() {
+	if c.capture != nil {
+		c.capture.close()
+	}
+}
+
+// file returns the capture file of a service mapping
+func (cp *capture) file(mapping string) *captureFile {
+
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	if cp.closed {
+		return nil
+	}
+
+	cf, found := cp.files[mapping]
+	if !found {
+		var name = strings.NewReplacer(":", "_", "[", "", "]", "", ",", "_").Replace(mapping)
+
+		cf = &captureFile{
+			name:   filepath.Join(cp.dir, name),
+			format: cp.format,
+			limit:  cp.limit,
+		}
+		cp.files[mapping] = cf
+	}
+
+	return cf
+}
+
+func (cp *capture) close() {
+
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	cp.closed = true
+
+	for _, cf := range cp.files {
+		cf.close()
+	}
+}
+
+// wrap records the traffic of a stream to a service
+func (cp *capture) wrap(mapping string, conn net.Conn, req *connectionOpenRequest) net.Conn {
+
+	cf := cp.file(mapping)
+	if cf == nil {
+		return conn
+	}
+
+	var cs = &captureStream{
+		file:    cf,
+		comment: fmt.Sprintf("pe2pe stream %v", req.StreamID),
+		dstPort: uint16(req.Port),
+		srcPort: binary.BigEndian.Uint16(req.StreamID[:2]),
+		seq:     [2]uint32{binary.BigEndian.Uint32(req.StreamID[2:6]), binary.BigEndian.Uint32(req.StreamID[6:10])},
+	}
+
+	// the families of the synthetic addresses match the requested game address
+	dst := net.IP(req.Addr[:])
+	if dst4 := dst.To4(); dst4 != nil && !dst.IsUnspecified() {
+		cs.src, cs.dst = circuitAddr4(req.Circuit), dst4
+	} else {
+		cs.src, cs.dst = circuitAddr(req.Circuit), dst.To16()
+	}
+
+	cs.open()
+
+	return &capturedConn{Conn: conn, stream: cs}
+}
+
+// circuitAddr4 returns the synthetic IPv4 source address of a circuit (100.64.0.0/10)
+func circuitAddr4(circuit [8]byte) net.IP {
+
+	var ip = net.IPv4(100, 64|circuit[0]&0x3f, circuit[1], circuit[2]).To4()
+	if ip[3] == 0 {
+		ip[3] = 1
+	}
+
+	return ip
+}
+
+// captureStream is the synthetic TCP connection of a stream
+type captureStream struct {
+	file    *captureFile
+	comment string
+
+	src, dst         net.IP
+	srcPort, dstPort uint16
+
+	lock   sync.Mutex
+	seq    [2]uint32 // next sequence numbers: client -> service, service -> client
+	closed bool
+}
+
+// open records the handshake
+func (cs *captureStream) open() {
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	cs.segment(0, tcpSYN, nil, cs.comment)
+	cs.seq[0]++
+	cs.segment(1, tcpSYN|tcpACK, nil, "")
+	cs.seq[1]++
+	cs.segment(0, tcpACK, nil, "")
+}
+
+// data records payload sent in a direction (0 - to the service, 1 - to the client)
+func (cs *captureStream) data(dir int, payload []byte) {
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	if cs.closed {
+		return
+	}
+
+	for len(payload) > 0 {
+		var chunk = payload
+		if len(chunk) > captureSegment {
+			chunk = chunk[:captureSegment]
+		}
+
+		cs.segment(dir, tcpPSH|tcpACK, chunk, "")
+		cs.seq[dir] += uint32(len(chunk))
+		payload = payload[len(chunk):]
+	}
+}
+
+// close records the teardown
+func (cs *captureStream) close() {
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	if cs.closed {
+		return
+	}
+	cs.closed = true
+
+	cs.segment(0, tcpFIN|tcpACK, nil, "")
+	cs.seq[0]++
+	cs.segment(1, tcpFIN|tcpACK, nil, "")
+	cs.seq[1]++
+	cs.segment(0, tcpACK, nil, "")
+
+	// finished streams are visible to readers of the file
+	cs.file.flush()
+}
+
+// segment writes a TCP segment of the stream (the lock is held)
+func (cs *captureStream) segment(dir int, flags byte, payload []byte, comment string) {
+
+	var (
+		src, dst         = cs.src, cs.dst
+		srcPort, dstPort = cs.srcPort, cs.dstPort
+		seq, ack         = cs.seq[dir], cs.seq[1-dir]
+	)
+
+	if dir == 1 {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+	}
+
+	if flags&tcpACK == 0 {
+		ack = 0
+	}
+
+	var tcp = make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], captureWindow)
+	copy(tcp[20:], payload)
+
+	cs.file.write(ipPacket(src, dst, tcp), comment)
+}
+
+// ipPacket wraps a TCP segment into an IPv4 or IPv6 packet with valid checksums
+func ipPacket(src, dst net.IP, tcp []byte) []byte {
+
+	var (
+		packet []byte
+		pseudo []byte
+	)
+
+	if src.To4() != nil {
+		packet = make([]byte, 20, 20+len(tcp))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(20+len(tcp)))
+		packet[8] = 64 // TTL
+		packet[9] = 6  // TCP
+		copy(packet[12:], src.To4())
+		copy(packet[16:], dst.To4())
+		binary.BigEndian.PutUint16(packet[10:], checksum(packet, 0))
+
+		pseudo = append(append(append([]byte{}, src.To4()...), dst.To4()...), 0, 6, 0, 0)
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	} else {
+		packet = make([]byte, 40, 40+len(tcp))
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(tcp)))
+		packet[6] = 6  // TCP
+		packet[7] = 64 // hop limit
+		copy(packet[8:], src.To16())
+		copy(packet[24:], dst.To16())
+
+		pseudo = append(append(append([]byte{}, src.To16()...), dst.To16()...), 0, 0, 0, 0, 0, 0, 0, 6)
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(tcp)))
+	}
+
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum(pseudo)))
+
+	return append(packet, tcp...)
+}
+
+// sum returns the ones' complement sum of 16-bit words
+func sum(data []byte) uint32 {
+
+	var total uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		total += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		total += uint32(data[len(data)-1]) << 8
+	}
+
+	return total
+}
+
+// checksum returns the internet checksum of the data with an initial sum
+func checksum(data []byte, initial uint32) uint16 {
+
+	var total = initial + sum(data)
+	for total>>16 != 0 {
+		total = total&0xffff + total>>16
+	}
+
+	return ^uint16(total)
+}
+
+// write appends a packet to the file, rotating it if it is too large
+func (cf *captureFile) write(packet []byte, comment string) {
+
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+
+	if cf.closed {
+		return
+	}
+
+	if cf.file != nil && cf.size >= cf.limit {
+		cf.closeFile()
+	}
+
+	if cf.file == nil {
+		err := cf.openFile()
+		if err != nil {
+			log.Errorf("Failed to open capture file: %v", err)
+			return
+		}
+	}
+
+	var (
+		now    = time.Now()
+		record []byte
+	)
+
+	if cf.format == CapturePcap {
+		record = pcapRecord(now, packet)
+	} else {
+		record = pcapngPacket(now, packet, comment)
+	}
+
+	n, err := cf.buf.Write(record)
+	cf.size += int64(n)
+	if err != nil {
+		log.Errorf("Failed to write capture file %v: %v", cf.file.Name(), err)
+		cf.closeFile()
+	}
+}
+
+// openFile creates the next file of the rotation (the lock is held)
+func (cf *captureFile) openFile() error {
+
+	cf.files++
+	var name = fmt.Sprintf("%v-%v-%v.%v", cf.name, time.Now().UTC().Format("20060102T150405"), cf.files, cf.format)
+
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+
+	var header []byte
+	if cf.format == CapturePcap {
+		header = pcapHeader()
+	} else {
+		header = pcapngHeader()
+	}
+
+	cf.file, cf.buf = file, bufio.NewWriter(file)
+
+	n, err := cf.buf.Write(header)
+	cf.size = int64(n)
+
+	return err
+}
+
+// closeFile flushes and closes the current file (the lock is held)
+func (cf *captureFile) closeFile() {
+
+	if cf.file == nil {
+		return
+	}
+
+	err := cf.buf.Flush()
+	if err == nil {
+		err = cf.file.Close()
+	} else {
+		_ = cf.file.Close()
+	}
+	if err != nil {
+		log.Errorf("Failed to close capture file %v: %v", cf.file.Name(), err)
+	}
+
+	cf.file, cf.buf = nil, nil
+}
+
+// flush writes buffered packets to the file
+func (cf *captureFile) flush() {
+
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+
+	if cf.buf != nil {
+		err := cf.buf.Flush()
+		if err != nil {
+			log.Errorf("Failed to write capture file %v: %v", cf.file.Name(), err)
+		}
+	}
+}
+
+func (cf *captureFile) close() {
+	cf.lock.Lock()
+	cf.closed = true
+	cf.closeFile()
+	cf.lock.Unlock()
+}
+
+// pcapHeader returns the global header of a pcap file
+func pcapHeader() []byte {
+
+	var header = make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], captureSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], captureLinkType)
+
+	return header
+}
+
+// pcapRecord returns a packet record of a pcap file
+func pcapRecord(ts time.Time, packet []byte) []byte {
+
+	var record = make([]byte, 16, 16+len(packet))
+	binary.LittleEndian.PutUint32(record[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+
+	return append(record, packet...)
+}
+
+// pcapngBlock returns a block with the type and body (padded to 32 bits)
+func pcapngBlock(blockType uint32, body []byte) []byte {
+
+	var (
+		padded = (len(body) + 3) &^ 3
+		length = uint32(12 + padded)
+		block  = make([]byte, length)
+	)
+
+	binary.LittleEndian.PutUint32(block[0:], blockType)
+	binary.LittleEndian.PutUint32(block[4:], length)
+	copy(block[8:], body)
+	binary.LittleEndian.PutUint32(block[length-4:], length)
+
+	return block
+}
+
+// pcapngHeader returns the section header and interface description blocks
+func pcapngHeader() []byte {
+
+	var shb = make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], 0x1a2b3c4d)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint64(shb[8:], 0xffffffffffffffff) // section length is not specified
+
+	var idb = make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], captureLinkType)
+	binary.LittleEndian.PutUint32(idb[4:], captureSnapLen)
+
+	return append(pcapngBlock(0x0a0d0d0a, shb), pcapngBlock(1, idb)...)
+}
+
+// pcapngPacket returns an enhanced packet block with an optional comment
+func pcapngPacket(ts time.Time, packet []byte, comment string) []byte {
+
+	var (
+		micros = uint64(ts.UnixNano() / 1000)
+		body   = make([]byte, 20, 20+len(packet)+len(comment)+16)
+	)
+
+	binary.LittleEndian.PutUint32(body[4:], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(micros))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(packet)))
+
+	body = append(body, packet...)
+	body = append(body, make([]byte, (4-len(packet)%4)%4)...)
+
+	if comment != "" {
+		var option = make([]byte, 4, 4+len(comment)+8)
+		binary.LittleEndian.PutUint16(option[0:], 1) // opt_comment
+		binary.LittleEndian.PutUint16(option[2:], uint16(len(comment)))
+		option = append(option, comment...)
+		option = append(option, make([]byte, (4-len(comment)%4)%4)...)
+		body = append(append(body, option...), 0, 0, 0, 0) // opt_endofopt
+	}
+
+	return pcapngBlock(6, body)
+}
+
+// capturedConn records the traffic of a service connection
+type capturedConn struct {
+	net.Conn
+	stream *captureStream
+}
+
+func (cc *capturedConn) Read(b []byte) (int, error) {
+	n, err := cc.Conn.Read(b)
+	if n > 0 {
+		cc.stream.data(1, b[:n])
+	}
+	return n, err
+}
+
+func (cc *capturedConn) Write(b []byte) (int, error) {
+	n, err := cc.Conn.Write(b)
+	if n > 0 {
+		cc.stream.data(0, b[:n])
+	}
+	return n, err
+}
+
+func (cc *capturedConn) Close() error {
+	cc.stream.close()
+	return cc.Conn.Close()
+}
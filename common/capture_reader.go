@@ -0,0 +1,391 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// link types of capture files that can be read
+const (
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+)
+
+// CapturedStream is a TCP connection read from a capture file
+type CapturedStream struct {
+	// the pe2pe stream ID of exit node captures ("client -> server" otherwise)
+	ID     string
+	Client string
+	Server string
+	Start  time.Time
+	Chunks []CapturedChunk
+}
+
+// CapturedChunk is the payload of a segment
+type CapturedChunk struct {
+	Time     time.Time
+	Response bool // sent by the server
+	Data     []byte
+}
+
+// capturedPacket is a packet of a capture file
+type capturedPacket struct {
+	time     time.Time
+	linkType uint16
+	data     []byte
+	comment  string
+}
+
+// ReadCapture reads the TCP streams of a pcap or pcapng file (raw IP or Ethernet),
+// retransmitted data is skipped
+func ReadCapture(fname string) ([]*CapturedStream, error) {
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	var packets []capturedPacket
+	if len(data) >= 4 && binary.LittleEndian.Uint32(data) == 0x0a0d0d0a {
+		packets, err = parsePcapNG(data)
+	} else {
+		packets, err = parsePcap(data)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %v", fname)
+	}
+
+	var assembler = tcpAssembler{streams: make(map[string]*assembledStream)}
+	for _, packet := range packets {
+		assembler.add(packet)
+	}
+
+	return assembler.result, nil
+}
+
+// parsePcap reads the packets of a pcap file
+func parsePcap(data []byte) ([]capturedPacket, error) {
+
+	if len(data) < 24 {
+		return nil, errors.New("not a capture file")
+	}
+
+	var (
+		order binary.ByteOrder = binary.LittleEndian
+		nanos bool
+	)
+
+	switch {
+	case binary.LittleEndian.Uint32(data) == 0xa1b2c3d4:
+	case binary.LittleEndian.Uint32(data) == 0xa1b23c4d:
+		nanos = true
+	case binary.BigEndian.Uint32(data) == 0xa1b2c3d4:
+		order = binary.BigEndian
+	case binary.BigEndian.Uint32(data) == 0xa1b23c4d:
+		order, nanos = binary.BigEndian, true
+	default:
+		return nil, errors.New("not a capture file")
+	}
+
+	var (
+		linkType = uint16(order.Uint32(data[20:]))
+		packets  []capturedPacket
+	)
+
+	for data = data[24:]; len(data) >= 16; {
+
+		var (
+			sec   = int64(order.Uint32(data))
+			frac  = int64(order.Uint32(data[4:]))
+			size  = int(order.Uint32(data[8:]))
+			stamp time.Time
+		)
+
+		if len(data) < 16+size {
+			return nil, errors.New("truncated packet")
+		}
+
+		if nanos {
+			stamp = time.Unix(sec, frac)
+		} else {
+			stamp = time.Unix(sec, frac*int64(time.Microsecond))
+		}
+
+		packets = append(packets, capturedPacket{time: stamp, linkType: linkType, data: data[16 : 16+size]})
+		data = data[16+size:]
+	}
+
+	return packets, nil
+}
+
+// parsePcapNG reads the enhanced packet blocks of a pcapng file
+func parsePcapNG(data []byte) ([]capturedPacket, error) {
+
+	type iface struct {
+		linkType uint16
+		unit     time.Duration // of timestamps
+	}
+
+	var (
+		order   binary.ByteOrder = binary.LittleEndian
+		ifaces  []iface
+		packets []capturedPacket
+	)
+
+	for len(data) >= 12 {
+
+		// the section header defines the byte order of the following blocks
+		if binary.LittleEndian.Uint32(data) == 0x0a0d0d0a {
+			if binary.LittleEndian.Uint32(data[8:]) == 0x1a2b3c4d {
+				order = binary.LittleEndian
+			} else {
+				order = binary.BigEndian
+			}
+			ifaces = nil
+		}
+
+		var (
+			blockType = order.Uint32(data)
+			length    = int(order.Uint32(data[4:]))
+		)
+
+		if length < 12 || length > len(data) {
+			return nil, errors.New("truncated block")
+		}
+
+		var body = data[8 : length-4]
+		data = data[length:]
+
+		switch blockType {
+		case 1: // interface description
+			if len(body) < 8 {
+				return nil, errors.New("truncated interface block")
+			}
+
+			var ifc = iface{linkType: order.Uint16(body), unit: time.Microsecond}
+
+			// if_tsresol
+			for _, opt := range pcapngOptions(order, body[8:]) {
+				if opt.code == 9 && len(opt.value) == 1 {
+					if opt.value[0]&0x80 != 0 || opt.value[0] > 9 {
+						return nil, errors.New("unsupported timestamp resolution")
+					}
+					ifc.unit = time.Second
+					for i := byte(0); i < opt.value[0]; i++ {
+						ifc.unit /= 10
+					}
+				}
+			}
+
+			ifaces = append(ifaces, ifc)
+
+		case 6: // enhanced packet
+			if len(body) < 20 {
+				return nil, errors.New("truncated packet block")
+			}
+
+			var (
+				id    = int(order.Uint32(body))
+				stamp = uint64(order.Uint32(body[4:]))<<32 | uint64(order.Uint32(body[8:]))
+				size  = int(order.Uint32(body[12:]))
+			)
+
+			if id >= len(ifaces) || 20+size > len(body) {
+				return nil, errors.New("invalid packet block")
+			}
+
+			var packet = capturedPacket{
+				time:     time.Unix(0, 0).Add(time.Duration(stamp) * ifaces[id].unit),
+				linkType: ifaces[id].linkType,
+				data:     body[20 : 20+size],
+			}
+
+			// opt_comment
+			if options := 20 + (size+3)&^3; options < len(body) {
+				for _, opt := range pcapngOptions(order, body[options:]) {
+					if opt.code == 1 {
+						packet.comment = string(opt.value)
+					}
+				}
+			}
+
+			packets = append(packets, packet)
+		}
+	}
+
+	return packets, nil
+}
+
+type pcapngOption struct {
+	code  uint16
+	value []byte
+}
+
+// pcapngOptions parses the options of a block
+func pcapngOptions(order binary.ByteOrder, data []byte) []pcapngOption {
+
+	var options []pcapngOption
+
+	for len(data) >= 4 {
+		var (
+			code = order.Uint16(data)
+			size = int(order.Uint16(data[2:]))
+		)
+
+		if code == 0 || 4+size > len(data) {
+			break
+		}
+
+		options = append(options, pcapngOption{code: code, value: data[4 : 4+size]})
+		data = data[4+(size+3)&^3:]
+	}
+
+	return options
+}
+
+// tcpAssembler rebuilds TCP streams from packets
+type tcpAssembler struct {
+	streams map[string]*assembledStream // by the addresses of both sides
+	result  []*CapturedStream
+}
+
+type assembledStream struct {
+	*CapturedStream
+	next   [2]uint32 // expected sequence numbers: client, server
+	synced [2]bool
+	fin    [2]bool
+}
+
+// add adds a packet to its stream
+func (ta *tcpAssembler) add(packet capturedPacket) {
+
+	var ip = packet.data
+	if packet.linkType == linkTypeEthernet {
+		if len(ip) < 14 {
+			return
+		}
+		ip = ip[14:]
+	} else if packet.linkType != linkTypeRaw {
+		return
+	}
+
+	src, dst, tcp := parseTCP(ip)
+	if tcp == nil {
+		return
+	}
+
+	var (
+		srcAddr = net.JoinHostPort(src.String(), fmt.Sprint(binary.BigEndian.Uint16(tcp)))
+		dstAddr = net.JoinHostPort(dst.String(), fmt.Sprint(binary.BigEndian.Uint16(tcp[2:])))
+		seq     = binary.BigEndian.Uint32(tcp[4:])
+		flags   = tcp[13]
+		payload = tcp[int(tcp[12]>>4)*4:]
+		key     = srcAddr + " " + dstAddr
+	)
+
+	if srcAddr > dstAddr {
+		key = dstAddr + " " + srcAddr
+	}
+
+	as, found := ta.streams[key]
+
+	// a new connection starts with SYN (or the first packet seen)
+	if !found || (flags&(tcpSYN|tcpACK) == tcpSYN && (as.fin[0] || as.fin[1])) {
+		as = &assembledStream{CapturedStream: &CapturedStream{
+			ID:     srcAddr + " -> " + dstAddr,
+			Client: srcAddr,
+			Server: dstAddr,
+			Start:  packet.time,
+		}}
+
+		if flags&(tcpSYN|tcpACK) == tcpSYN|tcpACK {
+			as.ID, as.Client, as.Server = dstAddr+" -> "+srcAddr, dstAddr, srcAddr
+		}
+
+		ta.streams[key] = as
+		ta.result = append(ta.result, as.CapturedStream)
+	}
+
+	if strings.HasPrefix(packet.comment, "pe2pe stream ") {
+		as.ID = strings.TrimPrefix(packet.comment, "pe2pe stream ")
+	}
+
+	var dir = 0
+	if srcAddr == as.Server {
+		dir = 1
+	}
+
+	if flags&tcpSYN != 0 {
+		as.next[dir], as.synced[dir] = seq+1, true
+		return
+	}
+
+	if !as.synced[dir] {
+		as.next[dir], as.synced[dir] = seq, true
+	}
+
+	// retransmitted data is skipped
+	if offset := int32(as.next[dir] - seq); offset > 0 {
+		if int(offset) >= len(payload) {
+			payload = nil
+		} else {
+			payload = payload[offset:]
+		}
+	}
+
+	if len(payload) > 0 {
+		as.Chunks = append(as.Chunks, CapturedChunk{
+			Time:     packet.time,
+			Response: dir == 1,
+			Data:     append([]byte(nil), payload...),
+		})
+		as.next[dir] += uint32(len(payload))
+	}
+
+	if flags&tcpFIN != 0 {
+		as.fin[dir] = true
+	}
+}
+
+// parseTCP returns the addresses and the TCP segment of an IPv4 or IPv6 packet
+func parseTCP(ip []byte) (net.IP, net.IP, []byte) {
+
+	var tcp []byte
+
+	switch {
+	case len(ip) >= 20 && ip[0]>>4 == 4:
+		var (
+			headerSize = int(ip[0]&0x0f) * 4
+			total      = int(binary.BigEndian.Uint16(ip[2:]))
+		)
+		if ip[9] != 6 || total > len(ip) || headerSize+20 > total {
+			return nil, nil, nil
+		}
+		tcp = ip[headerSize:total]
+
+		if len(tcp) < int(tcp[12]>>4)*4 {
+			return nil, nil, nil
+		}
+		return net.IP(ip[12:16]), net.IP(ip[16:20]), tcp
+
+	case len(ip) >= 40 && ip[0]>>4 == 6:
+		var total = 40 + int(binary.BigEndian.Uint16(ip[4:]))
+		if ip[6] != 6 || total > len(ip) || total < 60 {
+			return nil, nil, nil
+		}
+		tcp = ip[40:total]
+
+		if len(tcp) < int(tcp[12]>>4)*4 {
+			return nil, nil, nil
+		}
+		return net.IP(ip[8:24]), net.IP(ip[24:40]), tcp
+	}
+
+	return nil, nil, nil
+}
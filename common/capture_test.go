@@ -0,0 +1,153 @@
+package common
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// readPcapNG returns the packets and comments of the enhanced packet blocks of a file
+func readPcapNG(t *testing.T, fname string) ([][]byte, []string) {
+
+	data, err := ioutil.ReadFile(fname)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	var (
+		packets  [][]byte
+		comments []string
+	)
+
+	for len(data) >= 12 {
+		blockType := binary.LittleEndian.Uint32(data)
+		length := binary.LittleEndian.Uint32(data[4:])
+		body := data[8 : length-4]
+
+		if blockType == 6 {
+			size := binary.LittleEndian.Uint32(body[12:])
+			packets = append(packets, body[20:20+size])
+
+			options := body[20+(size+3)&^3:]
+			if len(options) > 4 && binary.LittleEndian.Uint16(options) == 1 {
+				comments = append(comments, string(options[4:4+binary.LittleEndian.Uint16(options[2:])]))
+			}
+		}
+
+		data = data[length:]
+	}
+
+	return packets, comments
+}
+
+func TestCapture(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "pe2pe")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	var c = &Client{Settings: &Settings{CaptureDir: dir}}
+	if !assert.NoError(t, c.StartCapture()) {
+		t.FailNow()
+	}
+
+	var req = connectionOpenRequest{Port: 4041, StreamID: uuid.New(), Circuit: [8]byte{1, 2, 3}}
+	copy(req.Addr[:], net.ParseIP("10.0.3.5").To16())
+
+	service, backend := net.Pipe()
+	conn := c.capture.wrap("10.0.3.5:4041", service, &req)
+
+	go func() {
+		buf := make([]byte, 4)
+		_, _ = backend.Read(buf)
+		_, _ = backend.Write([]byte("pong"))
+	}()
+
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	_, err = conn.Read(make([]byte, 4))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Close())
+	c.stopCapture()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "10.0.3.5_4041-*.pcapng"))
+	if !assert.Len(t, files, 1) {
+		t.FailNow()
+	}
+
+	packets, comments := readPcapNG(t, files[0])
+
+	// handshake, ping, pong and teardown
+	assert.Len(t, packets, 8)
+	assert.Equal(t, []string{"pe2pe stream " + req.StreamID.String()}, comments)
+
+	var payloads []string
+	for _, packet := range packets {
+		if !assert.Equal(t, byte(0x45), packet[0]) {
+			continue
+		}
+
+		// valid checksums sum to zero
+		assert.Equal(t, uint16(0), checksum(packet[:20], 0))
+		pseudo := append(append(append([]byte{}, packet[12:20]...), 0, 6), 0, 0)
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(packet)-20))
+		assert.Equal(t, uint16(0), checksum(packet[20:], sum(pseudo)))
+
+		tcp := packet[20:]
+		if binary.BigEndian.Uint16(tcp[2:]) == 4041 {
+			assert.Equal(t, "10.0.3.5", net.IP(packet[16:20]).String())
+			assert.True(t, strings.HasPrefix(net.IP(packet[12:16]).String(), "100.65."))
+		}
+		if len(tcp) > 20 {
+			payloads = append(payloads, string(tcp[20:]))
+		}
+	}
+	assert.Equal(t, []string{"ping", "pong"}, payloads)
+}
+
+func TestCaptureRotation(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "pe2pe")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	var c = &Client{Settings: &Settings{CaptureDir: dir, CaptureFormat: CapturePcap, CaptureFileSize: 1000}}
+	if !assert.NoError(t, c.StartCapture()) {
+		t.FailNow()
+	}
+
+	var req = connectionOpenRequest{Port: 22, StreamID: uuid.New()}
+
+	service, _ := net.Pipe()
+	stream := c.capture.wrap("22", service, &req).(*capturedConn).stream
+	stream.data(0, make([]byte, 1500))
+	stream.data(1, make([]byte, 1500))
+	c.stopCapture()
+
+	// streams still running do not start another file
+	stream.data(0, make([]byte, 1500))
+	stream.close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "22-*.pcap"))
+	assert.Len(t, files, 2)
+
+	for _, fname := range files {
+		data, err := ioutil.ReadFile(fname)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(0xa1b2c3d4), binary.LittleEndian.Uint32(data))
+		assert.Equal(t, uint32(captureLinkType), binary.LittleEndian.Uint32(data[20:]))
+	}
+
+	assert.Error(t, (&Client{Settings: &Settings{CaptureDir: dir, CaptureFormat: "json"}}).StartCapture())
+}
@@ -3,7 +3,9 @@ package common
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,6 +18,7 @@ import (
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	routedhost "github.com/libp2p/go-libp2p/p2p/host/routed"
 	"github.com/multiformats/go-multiaddr"
+	"github.com/pkg/errors"
 )
 
 const (
@@ -30,6 +33,39 @@ type Client struct {
 	Settings  *Settings
 	Discovery routing.ContentRouting
 	RelayCtx  *sphinx.RelayerCtx
+
+	networkLock  sync.RWMutex
+	networkHooks []func(*NetworkSettings)
+	// hooksLock keeps the hooks seeing network maps in the order they were set
+	hooksLock sync.Mutex
+
+	networkUpdateLock  sync.Mutex
+	networkUpdatesDone chan struct{}
+
+	forwardsLock   sync.Mutex
+	forwards       map[string]*portForward
+	forwardSlots   forwardSlots
+	forwardsClosed bool
+
+	tunDevice io.Closer
+
+	exitLock         sync.RWMutex
+	exitStreams      map[*exitStream]struct{}
+	exitWatchDone    chan struct{}
+	exitWatchStopped chan struct{}
+
+	circuitOnce sync.Once
+	circuitSalt [32]byte
+	capture     *capture
+	analyzer    *analyzer
+	shadow      shadowStats
+
+	listenersLock sync.Mutex
+	listeners     map[int]*overlayListener
+
+	proxies   map[string]*proxyListener
+	isolation relayIsolation
+	lightNode peer.ID
 }
 
 func (c *Client) HostAddress() string {
@@ -42,15 +78,18 @@ func (c *Client) HostAddress() string {
 // createHost creates this new CTF host
 func CreateHost(context context.Context, settings *Settings) (*Client, error) {
 
-	host, port, err := net.SplitHostPort(settings.ListenAddr)
+	listenAddrs, err := parseHostAddrs(settings.ListenAddr)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrap(err, "parsing listen addr")
 	}
 
-	listenAddr := fmt.Sprintf("/ip4/%s/tcp/%s", host, port)
+	announceAddrs, err := parseHostAddrs(settings.AnnounceAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing announce addr")
+	}
 
 	opts := []libp2p.Option{
-		libp2p.ListenAddrStrings(listenAddr),
+		libp2p.ListenAddrs(listenAddrs...),
 		libp2p.Identity(settings.Crypto.Key),
 		libp2p.DefaultTransports,
 		libp2p.DefaultMuxers,
@@ -58,6 +97,13 @@ func CreateHost(context context.Context, settings *Settings) (*Client, error) {
 		libp2p.NATPortMap(),
 	}
 
+	// other nodes dial the announced addrs instead of the listen ones
+	if len(announceAddrs) > 0 {
+		opts = append(opts, libp2p.AddrsFactory(func([]multiaddr.Multiaddr) []multiaddr.Multiaddr {
+			return announceAddrs
+		}))
+	}
+
 	basicHost, err := libp2p.New(context, opts...)
 	if err != nil {
 		return nil, err
@@ -69,6 +115,91 @@ func CreateHost(context context.Context, settings *Settings) (*Client, error) {
 	}, nil
 }
 
+// parseHostAddrs parses a comma-separated list of multiaddrs and host:port pairs,
+// hosts of the pairs are IP addresses (IPv6 ones in brackets)
+func parseHostAddrs(value string) ([]multiaddr.Multiaddr, error) {
+
+	var addrs []multiaddr.Multiaddr
+
+	for _, item := range strings.Split(value, ",") {
+
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(item, "/") {
+			host, port, err := net.SplitHostPort(item)
+			if err != nil {
+				return nil, err
+			}
+
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return nil, errors.Errorf("%v is not an IP address (use a /dns4 or /dns6 multiaddr)", host)
+			}
+
+			var proto = "ip4"
+			if ip.To4() == nil {
+				proto = "ip6"
+			}
+
+			item = fmt.Sprintf("/%s/%s/tcp/%s", proto, ip, port)
+		}
+
+		addr, err := multiaddr.NewMultiaddr(item)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing addr %v", item)
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	return addrs, nil
+}
+
+// Close stops all services and the host, active connections are interrupted
+func (c *Client) Close() error {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_ = c.StopProxy(ctx)
+
+	c.stopNetworkUpdates()
+	c.stopExitNodeWatch()
+	c.stopCapture()
+	c.stopAnalyzer()
+	c.stopForwards()
+
+	c.listenersLock.Lock()
+	var listeners = make([]*overlayListener, 0, len(c.listeners))
+	for _, ol := range c.listeners {
+		listeners = append(listeners, ol)
+	}
+	c.listenersLock.Unlock()
+
+	for _, ol := range listeners {
+		_ = ol.Close()
+	}
+
+	if c.tunDevice != nil {
+		err := c.tunDevice.Close()
+		if err != nil {
+			log.Errorf("Failed to close TUN device: %v", err)
+		}
+	}
+
+	if dht, ok := c.Discovery.(io.Closer); ok {
+		err := dht.Close()
+		if err != nil {
+			log.Errorf("Failed to close DHT: %v", err)
+		}
+	}
+
+	return c.Host.Close()
+}
+
 func (c *Client) ConnectDHT(ctx context.Context) error {
 
 	// create DHT
@@ -101,7 +232,7 @@ func (c *Client) bootstrapDHT(ctx context.Context) error {
 
 	// connect to all bootstrap nodes
 	var wg sync.WaitGroup
-	for _, peerAddr := range c.Settings.Network.DHT.Bootstrap {
+	for _, peerAddr := range c.Network().DHT.Bootstrap {
 
 		addr, err := multiaddr.NewMultiaddr(peerAddr)
 		if err != nil {
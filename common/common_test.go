@@ -0,0 +1,52 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHostAddrs(t *testing.T) {
+
+	addrs, err := parseHostAddrs("0.0.0.0:4242, [::]:4242,/dns4/relay.example/tcp/4242")
+	if assert.NoError(t, err) && assert.Len(t, addrs, 3) {
+		assert.Equal(t, "/ip4/0.0.0.0/tcp/4242", addrs[0].String())
+		assert.Equal(t, "/ip6/::/tcp/4242", addrs[1].String())
+		assert.Equal(t, "/dns4/relay.example/tcp/4242", addrs[2].String())
+	}
+
+	addrs, err = parseHostAddrs("")
+	assert.NoError(t, err)
+	assert.Empty(t, addrs)
+
+	for _, value := range []string{"relay.example:4242", "::1:4242", "/ip4/1.2.3.4/tcp", "127.0.0.1"} {
+		_, err = parseHostAddrs(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestHopAddr(t *testing.T) {
+
+	for _, typ := range []int{crypto.RSA, crypto.Ed25519} {
+
+		key, _, err := crypto.GenerateKeyPair(typ, 2048)
+		assert.NoError(t, err)
+
+		id, err := peer.IDFromPrivateKey(key)
+		assert.NoError(t, err)
+
+		// sphinx pads addresses with zeroes
+		var addr [46]byte
+		copy(addr[:], id)
+
+		decoded, err := hopAddr(addr[:])
+		if assert.NoError(t, err) {
+			assert.Equal(t, id, decoded)
+		}
+	}
+
+	_, err := hopAddr([]byte{0x12, 0x20, 1, 2, 3})
+	assert.Error(t, err, "truncated")
+}
@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"strconv"
+	"net"
+	"strings"
+	"time"
 
 	"crypto/ecdsa"
 
@@ -14,29 +16,123 @@ import (
 )
 
 type Settings struct {
-	// server will be listening on this addr (relay && connectivity)
+	// server will be listening on these addrs (relay && connectivity),
+	// comma-separated host:port pairs or multiaddrs
 	ListenAddr string
+	// addrs other nodes dial instead of the listen ones (empty - listen addrs)
+	AnnounceAddr string
 	// if not empty, socks5 proxy will be listening on this addr (entry point into the game network)
 	ProxyAddr string
+	// refuse proxy requests to game addresses of own team
+	BlockSelf bool
+	// if not empty, proxy on ProxyAddr requires authentication of these users
+	ProxyUsersConfig string
+	// additional proxy listeners with their own policies
+	ProxyConfig string
+	Proxies     ProxiesSettings
+	// if not empty, this node is a light client tunneling through its team node (multiaddr)
+	LightNode string
+	// if not empty, light clients of these users are served (users have PeerID)
+	LightUsersConfig string
+	LightUsers       map[string]*ProxyUser
+	// proxy connection limits (0 - unlimited)
+	ProxyHandshakeTimeout time.Duration
+	ProxyIdleTimeout      time.Duration
+	ProxyMaxConns         int
+
+	// if not empty, a TUN device with this name routes the game subnet into the network
+	TunDevice string
+	// address of the TUN device with the prefix of the game subnet (e.g. 10.0.0.254/24)
+	TunAddr string
+
+	// static port forwards (entry points for tools without proxy support)
+	ForwardConfig string
+	Forwards      *ForwardSettings
 
 	// exit node config (hosted services)
 	ExitNodeConfig string
 	ExitNode       *ExitNodeSettings
+	// how often the config is checked for changes (0 - reload on demand only)
+	ExitNodeWatchInterval time.Duration
+	// let streams of removed or changed mappings finish instead of closing them on reload
+	ExitNodeDrain bool
+	// if not empty, streams of mapped services are recorded into capture files in this dir,
+	// CapturePcapNG (default) or CapturePcap, rotated at the size (0 - DefaultCaptureFileSize)
+	CaptureDir      string
+	CaptureFormat   string
+	CaptureFileSize int64
+	// if not empty, streams of mapped services are indexed and queried on this HTTP addr,
+	// responses matching FlagPattern (empty - DefaultFlagPattern) raise alerts,
+	// AnalyzerHistory streams are kept per service (0 - DefaultAnalyzerHistory)
+	AnalyzerAddr    string
+	FlagPattern     string
+	AnalyzerHistory int
 
 	// network config (info about all nodes in the network)
 	NetworkConfig string
 	Network       *NetworkSettings
 
+	// signed network map updates: HTTP URL of the map (empty - trusted relays only),
+	// the signature is at the URL with ".sig" appended; how often to check (0 - never)
+	NetworkURL            string
+	NetworkUpdateInterval time.Duration
+
 	// private keys
 	CryptoConfig string
 	Crypto       *CryptoSettings
 }
 
-type ExitNodeSettings map[string]string
+// ExitNodeSettings maps virtual ports ("80", "8000-8100") or virtual addresses of the node
+// ("10.60.2.3:80") to services, a service may be given as a single backend ("127.0.0.1:8080")
+type ExitNodeSettings map[string]*ExitService
+
+// ProxySettings is a single proxy listener with its own policy
+type ProxySettings struct {
+	Listen string
+	// ProxySOCKS5 (default) or ProxyHTTP
+	Protocol string
+	// file with proxy users (empty - no authentication)
+	Users string
+	// onion path length (0 - NumHops), overridden by user policies
+	Hops int
+	// relays shared between streams: IsolateUser (default), IsolateListener or IsolateNone
+	Isolation string
+	// reachable targets like "team2:4041", "*:80" (empty - any)
+	Allow []string
+	// streams prove access to owner-only and organizer-only services
+	// (exits can tell such streams apart, so only dedicated listeners should set it)
+	ExitAuth bool
+
+	users   map[string]*ProxyUser
+	targets []targetPattern
+}
+
+// ProxiesSettings maps listener names to their settings
+type ProxiesSettings map[string]*ProxySettings
+
+// ForwardSettings maps local listen addresses to game targets:
+// "team2:4041" forwards to one node, "*:4041" binds a port per team starting at the local port
+// (teams joining later get the next ports, the ports of other teams never change)
+type ForwardSettings map[string]string
 
 type NetworkSettings struct {
-	DHT   DHTSettings
-	Nodes map[core.PeerID]Member
+	// maps signed by the organizers are replaced by greater versions only
+	Version uint64
+	DHT     DHTSettings
+	Rules   GameRules
+	Nodes   map[core.PeerID]Member
+
+	// the map as signed by the organizers (nil - not signed)
+	raw       []byte
+	signature []byte
+}
+
+// GameRules restrict what can be requested through the entry proxy
+type GameRules struct {
+	// ports open on team nodes (empty - any)
+	Ports PortSet
+	// ports of organizer nodes (trusted relays) closed for teams
+	OrganizerPorts PortSet
 }
 
 type DHTSettings struct {
@@ -48,35 +144,168 @@ type CryptoSettings struct {
 	ID       peer.ID
 	Key      crypto.PrivKey
 	OnionKey ecdsa.PrivateKey
+	// network maps must be signed by this key (nil - not checked)
+	OrganizerKey *ecdsa.PublicKey
+	// organizer nodes (checkers) prove access to organizer-only services with it
+	OrganizerPrivateKey *ecdsa.PrivateKey
 }
 
 type Member struct {
-	ID           string
-	Address      string
+	ID string
+	// primary game address
+	Address string
+	// addresses and subnets owned by the member (including the primary address)
+	Networks     []*net.IPNet
 	OnionKey     ecdsa.PublicKey
 	TrustedRelay bool
 }
 
+// HasIP reports whether the game address belongs to the member
+func (m Member) HasIP(ip net.IP) bool {
+
+	for _, network := range m.Networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsPortAllowed reports whether the port is mapped on any address of the node
 func (ns *ExitNodeSettings) IsPortAllowed(id int) bool {
 
 	if ns == nil {
 		return false
 	}
 
-	var key = strconv.Itoa(id)
-	_, allowed := (*ns)[key]
-	return allowed
+	for _, svc := range *ns {
+		if svc.ports.Contains(id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Service returns the service of the virtual address and port (nil - not mapped).
+// Mappings of the address take precedence over the ones of any address,
+// narrower port ranges over wider ones.
+func (ns *ExitNodeSettings) Service(ip net.IP, port int) *ExitService {
+
+	if ns == nil {
+		return nil
+	}
+
+	var (
+		best    *ExitService
+		bestKey string
+	)
+
+	for mapping, svc := range *ns {
+
+		if !svc.ports.Contains(port) || (svc.ip != nil && !svc.ip.Equal(ip)) {
+			continue
+		}
+
+		if best != nil {
+			switch {
+			case (svc.ip != nil) != (best.ip != nil):
+				if best.ip != nil {
+					continue
+				}
+			case svc.size() != best.size():
+				if svc.size() > best.size() {
+					continue
+				}
+			case mapping > bestKey:
+				continue
+			}
+		}
+
+		best, bestKey = svc, mapping
+	}
+
+	return best
+}
+
+// validate checks the services and parses their mappings
+func (ns ExitNodeSettings) validate() error {
+
+	for mapping, svc := range ns {
+		err := svc.validate(mapping)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// inherit keeps the stream counters, backend health and rule limits of unchanged mappings
+func (ns ExitNodeSettings) inherit(old *ExitNodeSettings) {
+
+	if old == nil {
+		return
+	}
+
+	for mapping, svc := range ns {
+
+		prev, found := (*old)[mapping]
+		if !found {
+			continue
+		}
+
+		if prev.state != nil {
+			svc.state = prev.state
+		}
+
+		if rules, prevRules := svc.rules(), prev.rules(); rules != nil && prevRules != nil {
+			rules.inherit(prevRules)
+		}
+	}
 }
 
 func (s *Settings) Load() error {
 
-	// load network config
-	{
+	// light clients only need keys and proxies
+	if s.LightNode > "" {
+		if s.NetworkConfig > "" || s.Network != nil || s.ExitNodeConfig > "" || s.ExitNode != nil ||
+			s.ForwardConfig > "" || s.TunDevice > "" || s.LightUsersConfig > "" || s.NetworkURL > "" {
+			return fmt.Errorf("light client supports only proxies")
+		}
+	}
+
+	// load private crypto keys (unless already loaded)
+	if s.Crypto == nil {
+		if s.CryptoConfig == "" {
+			return fmt.Errorf("crypto keys not provided")
+		}
+
+		cs, err := LoadCryptoSettings(s.CryptoConfig)
+		if err != nil {
+			return err
+		}
+
+		s.Crypto = cs
+	}
+
+	// load network config (unless already loaded), the organizer signature is checked if pinned
+	if s.LightNode == "" && s.Network == nil {
 		if s.NetworkConfig == "" {
 			return fmt.Errorf("network map not provided")
 		}
 
-		cfg, err := LoadNetworkSettings(s.NetworkConfig)
+		var (
+			cfg *NetworkSettings
+			err error
+		)
+
+		if s.Crypto.OrganizerKey != nil {
+			cfg, err = LoadSignedNetworkSettings(s.NetworkConfig, s.Crypto.OrganizerKey)
+		} else {
+			cfg, err = LoadNetworkSettings(s.NetworkConfig)
+		}
 		if err != nil {
 			return err
 		}
@@ -87,44 +316,164 @@ func (s *Settings) Load() error {
 	// load exit-node config
 	if s.ExitNodeConfig > "" {
 
-		en := new(ExitNodeSettings)
+		en, err := LoadExitNodeSettings(s.ExitNodeConfig)
+		if err != nil {
+			return err
+		}
 
-		bytes, err := ioutil.ReadFile(s.ExitNodeConfig)
+		s.ExitNode = en
+	} else if s.ExitNode != nil {
+		err := s.ExitNode.validate()
 		if err != nil {
 			return err
 		}
+	}
 
-		err = json.Unmarshal(bytes, en)
+	// load port forwards
+	if s.ForwardConfig > "" {
+
+		fs := new(ForwardSettings)
+
+		bytes, err := ioutil.ReadFile(s.ForwardConfig)
 		if err != nil {
 			return err
 		}
 
-		s.ExitNode = en
+		err = json.Unmarshal(bytes, fs)
+		if err != nil {
+			return err
+		}
+
+		s.Forwards = fs
 	}
 
-	// load private crypto keys
-	{
-		cs := new(CryptoSettings)
-		if s.CryptoConfig == "" {
-			return fmt.Errorf("crypto keys not provided")
+	// load proxy listeners
+	if s.ProxyConfig > "" {
+
+		proxies, err := LoadProxySettings(s.ProxyConfig)
+		if err != nil {
+			return err
 		}
 
-		bytes, err := ioutil.ReadFile(s.CryptoConfig)
+		s.Proxies = proxies
+	}
+
+	// the proxy listener from the command line
+	if s.ProxyAddr > "" {
+
+		if s.Proxies == nil {
+			s.Proxies = make(ProxiesSettings)
+		}
+
+		if _, found := s.Proxies[DefaultProxy]; found {
+			return fmt.Errorf("proxy %v is both in the command line and %v", DefaultProxy, s.ProxyConfig)
+		}
+
+		ps := &ProxySettings{
+			Listen: s.ProxyAddr,
+			Users:  s.ProxyUsersConfig,
+		}
+
+		err := ps.load(DefaultProxy)
 		if err != nil {
 			return err
 		}
 
-		err = json.Unmarshal(bytes, cs)
+		s.Proxies[DefaultProxy] = ps
+	}
+
+	// light clients can not resolve members, the team node checks their targets
+	if s.LightNode > "" {
+		for name, ps := range s.Proxies {
+			if len(ps.Allow) > 0 {
+				return fmt.Errorf("proxy %v: light client can not allow targets, set them for it on the team node", name)
+			}
+
+			for user, pu := range ps.users {
+				if len(pu.Allow) > 0 {
+					return fmt.Errorf("proxy %v: light client can not allow targets of user %v, set them on the team node", name, user)
+				}
+			}
+		}
+	}
+
+	// load light client users
+	if s.LightUsersConfig > "" {
+
+		users, err := LoadProxyUsers(s.LightUsersConfig)
 		if err != nil {
 			return err
 		}
 
-		s.Crypto = cs
+		err = checkLightUsers(users)
+		if err != nil {
+			return err
+		}
+
+		s.LightUsers = users
 	}
 
 	return nil
 }
 
+// LoadCryptoSettings reads private crypto keys of a node
+func LoadCryptoSettings(fname string) (*CryptoSettings, error) {
+
+	bytes, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	var cs = new(CryptoSettings)
+	err = json.Unmarshal(bytes, cs)
+	if err != nil {
+		return nil, err
+	}
+
+	return cs, nil
+}
+
+// game network names of members without a static address entry
+const (
+	PeerDomain = ".pe2pe" // <peer ID>.pe2pe
+	NodeDomain = ".node"  // <member ID>.node
+)
+
+// PeerIDForHost returns the member with the game address, member ID,
+// "<member ID>.node" or "<peer ID>.pe2pe" name
+func (ns *NetworkSettings) PeerIDForHost(host string) (core.PeerID, bool) {
+
+	if ns == nil || ns.Nodes == nil {
+		return "", false
+	}
+
+	host = strings.TrimSuffix(host, ".")
+
+	if strings.HasSuffix(host, PeerDomain) {
+		id, err := peer.IDB58Decode(strings.TrimSuffix(host, PeerDomain))
+		if err != nil {
+			return "", false
+		}
+
+		_, found := ns.Nodes[id]
+		return id, found
+	}
+
+	host = strings.TrimSuffix(host, NodeDomain)
+	if host == "" {
+		return "", false
+	}
+
+	for peer, info := range ns.Nodes {
+		if info.ID == host {
+			return peer, true
+		}
+	}
+
+	return ns.PeerIDForAddr(host)
+}
+
+// PeerIDForAddr returns the member owning the game address
 func (ns *NetworkSettings) PeerIDForAddr(addr string) (core.PeerID, bool) {
 
 	if ns == nil || ns.Nodes == nil {
@@ -137,5 +486,17 @@ func (ns *NetworkSettings) PeerIDForAddr(addr string) (core.PeerID, bool) {
 		}
 	}
 
+	// additional addresses and team subnets
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", false
+	}
+
+	for peer, info := range ns.Nodes {
+		if info.HasIP(ip) {
+			return peer, true
+		}
+	}
+
 	return "", false
 }
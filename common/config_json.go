@@ -5,6 +5,8 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"io/ioutil"
+	"net"
 	"strings"
 
 	"gopkg.in/ini.v1"
@@ -15,8 +17,10 @@ import (
 )
 
 type encodeCryptoSettings struct {
-	Key      string
-	OnionKey string
+	Key                 string
+	OnionKey            string
+	OrganizerKey        string
+	OrganizerPrivateKey string
 }
 
 func (cs *CryptoSettings) UnmarshalJSON(input []byte) error {
@@ -52,11 +56,58 @@ func (cs *CryptoSettings) UnmarshalJSON(input []byte) error {
 
 	cs.OnionKey = *ecdsaP
 
+	if ec.OrganizerKey != "" {
+		cs.OrganizerKey, err = ParsePublicKey(ec.OrganizerKey)
+		if err != nil {
+			return errors.Wrap(err, "organizer key")
+		}
+	}
+
+	if ec.OrganizerPrivateKey != "" {
+		keyBytes, err := base64.StdEncoding.DecodeString(ec.OrganizerPrivateKey)
+		if err != nil {
+			return errors.Wrap(err, "decoding organizer private key")
+		}
+
+		cs.OrganizerPrivateKey, err = x509.ParseECPrivateKey(keyBytes)
+		if err != nil {
+			return errors.Wrap(err, "parsing organizer private key")
+		}
+	}
+
 	return nil
 }
 
+// ParsePublicKey decodes a base64 PKIX ECDSA public key like OnionKey of the network map
+func ParsePublicKey(value string) (*ecdsa.PublicKey, error) {
+
+	keyBytes, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding ecdsa public key")
+	}
+
+	ecdsaP, err := x509.ParsePKIXPublicKey(keyBytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing ecdsa public key")
+	}
+
+	ecdsaPK, ok := ecdsaP.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("casting ecdsa public key (unknown type %T)", ecdsaP)
+	}
+
+	return ecdsaPK, nil
+}
+
 type encodeMembers struct {
-	DHT DHTSettings
+	Version uint64
+	DHT     DHTSettings
+	Rules   encodeRules
+}
+
+type encodeRules struct {
+	Ports          string
+	OrganizerPorts string
 }
 
 type encodeMember struct {
@@ -70,7 +121,18 @@ const nodePrefix = "Node-"
 
 func LoadNetworkSettings(fname string) (*NetworkSettings, error) {
 
-	cfg, err := ini.Load(fname)
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseNetworkSettings(data)
+}
+
+// ParseNetworkSettings decodes a network map
+func ParseNetworkSettings(data []byte) (*NetworkSettings, error) {
+
+	cfg, err := ini.Load(data)
 	if err != nil {
 		return nil, err
 	}
@@ -84,8 +146,19 @@ func LoadNetworkSettings(fname string) (*NetworkSettings, error) {
 	log.Debugf("wat %+v", dec)
 
 	var output = NetworkSettings{
-		DHT:   dec.DHT,
-		Nodes: make(map[peer.ID]Member),
+		Version: dec.Version,
+		DHT:     dec.DHT,
+		Nodes:   make(map[peer.ID]Member),
+	}
+
+	output.Rules.Ports, err = ParsePortSet(dec.Rules.Ports)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing game ports")
+	}
+
+	output.Rules.OrganizerPorts, err = ParsePortSet(dec.Rules.OrganizerPorts)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing organizer ports")
 	}
 
 	for _, section := range cfg.Sections() {
@@ -105,29 +178,103 @@ func LoadNetworkSettings(fname string) (*NetworkSettings, error) {
 			return nil, errors.Wrapf(err, "Could not parse peerAddr %v", value.Key)
 		}
 
-		keyBytes, err := base64.StdEncoding.DecodeString(value.OnionKey)
+		ecdsaPK, err := ParsePublicKey(value.OnionKey)
 		if err != nil {
-			return nil, errors.Wrap(err, "decoding ecdsa public key")
+			return nil, err
 		}
 
-		ecdsaP, err := x509.ParsePKIXPublicKey(keyBytes)
+		address, networks, err := parseMemberAddress(value.Address)
 		if err != nil {
-			return nil, errors.Wrap(err, "parsing ecdsa public key")
-		}
-
-		ecdsaPK, ok := ecdsaP.(*ecdsa.PublicKey)
-		if !ok {
-			return nil, errors.Wrapf(err, "casting ecdsa public key (unknown type %T)", ecdsaP)
-
+			return nil, errors.Wrapf(err, "parsing address of %v", section.Name())
 		}
 
 		output.Nodes[peerID] = Member{
 			ID:           strings.TrimPrefix(section.Name(), nodePrefix),
-			Address:      value.Address,
+			Address:      address,
+			Networks:     networks,
 			OnionKey:     *ecdsaPK,
 			TrustedRelay: value.Trusted,
 		}
 	}
 
+	err = checkOverlaps(output.Nodes)
+	if err != nil {
+		return nil, err
+	}
+
 	return &output, nil
 }
+
+// parseMemberAddress parses a list of addresses and subnets like "10.60.2.1/24, 10.60.200.2",
+// the first address is the primary one
+func parseMemberAddress(value string) (string, []*net.IPNet, error) {
+
+	var (
+		address  string
+		networks []*net.IPNet
+	)
+
+	for _, item := range strings.Split(value, ",") {
+
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		var (
+			ip      net.IP
+			network *net.IPNet
+			err     error
+		)
+
+		if strings.Contains(item, "/") {
+			ip, network, err = net.ParseCIDR(item)
+			if err != nil {
+				return "", nil, err
+			}
+		} else {
+			ip = net.ParseIP(item)
+			if ip == nil {
+				return "", nil, errors.Errorf("%v is not an IP address", item)
+			}
+
+			var bits = 8 * net.IPv6len
+			if v4 := ip.To4(); v4 != nil {
+				ip, bits = v4, 8*net.IPv4len
+			}
+
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+
+		if address == "" {
+			address = ip.String()
+		}
+
+		networks = append(networks, network)
+	}
+
+	return address, networks, nil
+}
+
+// checkOverlaps makes sure every game address belongs to a single member
+func checkOverlaps(nodes map[peer.ID]Member) error {
+
+	for a, first := range nodes {
+		for b, second := range nodes {
+
+			if a >= b {
+				continue
+			}
+
+			for _, x := range first.Networks {
+				for _, y := range second.Networks {
+					if x.Contains(y.IP) || y.Contains(x.IP) {
+						return errors.Errorf("%v of %v overlaps %v of %v", x, first.ID, y, second.ID)
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
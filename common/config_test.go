@@ -0,0 +1,97 @@
+package common
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMemberAddress(t *testing.T) {
+
+	address, networks, err := parseMemberAddress("10.60.2.1/24, 10.60.200.2,fd00::1")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, "10.60.2.1", address)
+	assert.Len(t, networks, 3)
+
+	var member = Member{Address: address, Networks: networks}
+	assert.True(t, member.HasIP(net.ParseIP("10.60.2.200")))
+	assert.True(t, member.HasIP(net.ParseIP("10.60.200.2")))
+	assert.True(t, member.HasIP(net.ParseIP("fd00::1")))
+	assert.False(t, member.HasIP(net.ParseIP("10.60.200.3")))
+	assert.False(t, member.HasIP(net.ParseIP("10.60.3.1")))
+
+	address, networks, err = parseMemberAddress("")
+	assert.NoError(t, err)
+	assert.Equal(t, "", address)
+	assert.Empty(t, networks)
+
+	for _, value := range []string{"team1", "10.60.2.1/33", "10.0.0.1, bad"} {
+		_, _, err = parseMemberAddress(value)
+		assert.Error(t, err, value)
+	}
+
+	_, team1, _ := parseMemberAddress("10.60.1.1/24")
+	_, team2, _ := parseMemberAddress("10.60.2.1, 10.60.1.7")
+	assert.Error(t, checkOverlaps(map[peer.ID]Member{
+		"a": {ID: "team1", Networks: team1},
+		"b": {ID: "team2", Networks: team2},
+	}))
+}
+
+func TestExitNodeSettings(t *testing.T) {
+
+	var en ExitNodeSettings
+	err := json.Unmarshal([]byte(`{
+		"80":            "127.0.0.1:8080",
+		"10.60.2.3:80":  "127.0.0.1:8081",
+		"10.60.2.4:22":  "127.0.0.1:22",
+		"[fd00::3]:443": {"Backends": ["[::1]:8443", "unix:/run/https.sock"], "Balance": "health"},
+		"8000-8100":     {"Backends": ["127.0.0.1"], "ConnectTimeout": "1s", "MaxConns": 10},
+		"8080":          "maintenance"
+	}`), &en)
+	if !assert.NoError(t, err) || !assert.NoError(t, en.validate()) {
+		t.FailNow()
+	}
+
+	backends := func(ip string, port int) []string {
+		if svc := en.Service(net.ParseIP(ip), port); svc != nil {
+			return svc.Backends
+		}
+		return nil
+	}
+
+	assert.Equal(t, []string{"127.0.0.1:8081"}, backends("10.60.2.3", 80))
+	assert.Equal(t, []string{"127.0.0.1:8080"}, backends("10.60.2.4", 80))
+	assert.Equal(t, []string{"127.0.0.1:8080"}, backends("", 80))
+	assert.Equal(t, []string{"127.0.0.1:22"}, backends("10.60.2.4", 22))
+	assert.Nil(t, backends("10.60.2.3", 22))
+	assert.Equal(t, []string{"[::1]:8443", "unix:/run/https.sock"}, backends("fd00::3", 443))
+	assert.Equal(t, []string{"127.0.0.1"}, backends("10.60.2.3", 8050))
+
+	// narrower mappings take precedence
+	assert.True(t, en.Service(nil, 8080).Maintenance)
+
+	svc := en.Service(nil, 8000)
+	assert.Equal(t, time.Second, svc.ConnectTimeout)
+	assert.Equal(t, 10, svc.MaxConns)
+
+	assert.True(t, en.IsPortAllowed(80))
+	assert.True(t, en.IsPortAllowed(22))
+	assert.True(t, en.IsPortAllowed(443))
+	assert.True(t, en.IsPortAllowed(8100))
+	assert.False(t, en.IsPortAllowed(8101))
+
+	for _, mapping := range []string{"http", "team1:80", "10.0.0.1:0", "70000", "90-80"} {
+		assert.Error(t, ExitNodeSettings{mapping: {Backends: []string{"127.0.0.1:80"}}}.validate(), mapping)
+	}
+
+	for _, svc := range []*ExitService{nil, {}, {Backends: []string{"unix:"}}, {Backends: []string{"127.0.0.1:80"}, Balance: "random"}} {
+		assert.Error(t, ExitNodeSettings{"80": svc}.validate())
+	}
+}
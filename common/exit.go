@@ -0,0 +1,265 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/derlaft/pe2pectf/go-socks5"
+	"github.com/pkg/errors"
+)
+
+// ExitMaintenance is the mapping of a service that is temporarily down (short for Maintenance)
+const ExitMaintenance = "maintenance"
+
+// exit node responses sent instead of MagicWelcomeByte
+const (
+	exitRefused     byte = 0x43 + iota // the port is not mapped
+	exitMaintenance                    // the service is in maintenance
+	exitFailed                         // the service is not reachable
+	exitBusy                           // the service has too many streams
+	exitDenied                         // the service is restricted to other nodes
+)
+
+// ExitError is returned by dials when the exit node could not connect to the service
+type ExitError struct {
+	status byte
+}
+
+// errors reported by exit nodes
+var (
+	ErrPortNotMapped = &ExitError{exitRefused}
+	ErrMaintenance   = &ExitError{exitMaintenance}
+	ErrServiceDown   = &ExitError{exitFailed}
+	ErrServiceBusy   = &ExitError{exitBusy}
+	ErrAccessDenied  = &ExitError{exitDenied}
+)
+
+func (e *ExitError) Error() string {
+	switch e.status {
+	case exitRefused:
+		return "port is not mapped on the exit node"
+	case exitMaintenance:
+		return "service is in maintenance"
+	case exitBusy:
+		return "service has too many streams"
+	case exitDenied:
+		return "service is restricted"
+	default:
+		return "exit node failed to reach the service"
+	}
+}
+
+// ReplyCode implements socks5.ReplyError
+func (e *ExitError) ReplyCode() uint8 {
+	switch e.status {
+	case exitRefused:
+		return socks5.ReplyConnectionRefused
+	case exitMaintenance, exitBusy:
+		return socks5.ReplyServerFailure
+	case exitDenied:
+		return socks5.ReplyNotAllowed
+	default:
+		return socks5.ReplyHostUnreachable
+	}
+}
+
+// exitErrorFromStatus returns the error of an exit node response (nil - unknown response)
+func exitErrorFromStatus(status byte) *ExitError {
+	for _, err := range []*ExitError{ErrPortNotMapped, ErrMaintenance, ErrServiceDown, ErrServiceBusy, ErrAccessDenied} {
+		if err.status == status {
+			return err
+		}
+	}
+	return nil
+}
+
+// exitStatus returns the response of the exit node for a failed dial
+func exitStatus(err error) byte {
+	if ee, ok := errors.Cause(err).(*ExitError); ok {
+		return ee.status
+	}
+	return exitFailed
+}
+
+// exitErrorOf finds the exit node error of a dial (nil - other failure),
+// errors wrapped by the standard library (like the HTTP transport does) are unwrapped too
+func exitErrorOf(err error) *ExitError {
+
+	for err != nil {
+
+		err = errors.Cause(err)
+		if ee, ok := err.(*ExitError); ok {
+			return ee
+		}
+
+		wrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return nil
+		}
+		err = wrapper.Unwrap()
+	}
+
+	return nil
+}
+
+// exitStream is a connection of the exit node to a mapped service
+type exitStream struct {
+	addr   net.IP
+	port   int
+	target string
+	conn   net.Conn
+}
+
+// exitNode returns the current exit node config
+func (c *Client) exitNode() *ExitNodeSettings {
+
+	c.exitLock.RLock()
+	defer c.exitLock.RUnlock()
+
+	return c.Settings.ExitNode
+}
+
+// trackExitStream registers a connection to a mapped service, the returned func unregisters it
+func (c *Client) trackExitStream(es *exitStream) func() {
+
+	c.exitLock.Lock()
+	defer c.exitLock.Unlock()
+
+	if c.exitStreams == nil {
+		c.exitStreams = make(map[*exitStream]struct{})
+	}
+	c.exitStreams[es] = struct{}{}
+
+	return func() {
+		c.exitLock.Lock()
+		delete(c.exitStreams, es)
+		c.exitLock.Unlock()
+	}
+}
+
+// LoadExitNodeSettings reads the service mappings of an exit node
+func LoadExitNodeSettings(fname string) (*ExitNodeSettings, error) {
+
+	bytes, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	var en = new(ExitNodeSettings)
+	err = json.Unmarshal(bytes, en)
+	if err != nil {
+		return nil, err
+	}
+
+	err = en.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return en, nil
+}
+
+// ReloadExitNode reads the exit node config from the disk again. Open streams of removed,
+// moved or paused services are closed unless ExitNodeDrain is set.
+func (c *Client) ReloadExitNode() error {
+
+	if c.Settings.ExitNodeConfig == "" {
+		return nil
+	}
+
+	en, err := LoadExitNodeSettings(c.Settings.ExitNodeConfig)
+	if err != nil {
+		return errors.Wrap(err, "reloading exit node config")
+	}
+
+	c.exitLock.Lock()
+	en.inherit(c.Settings.ExitNode)
+	c.Settings.ExitNode = en
+
+	var stale []net.Conn
+	for es := range c.exitStreams {
+		if !en.Service(es.addr, es.port).hasBackend(es.target) {
+			stale = append(stale, es.conn)
+		}
+	}
+	c.exitLock.Unlock()
+
+	if c.Settings.ExitNodeDrain {
+		log.Infof("Exit node config reloaded (%v mappings, %v streams of old mappings are drained)", len(*en), len(stale))
+		return nil
+	}
+
+	for _, conn := range stale {
+		_ = conn.Close()
+	}
+
+	log.Infof("Exit node config reloaded (%v mappings, %v streams of old mappings closed)", len(*en), len(stale))
+
+	return nil
+}
+
+// StartExitNodeWatch reloads the exit node config whenever the file is modified
+func (c *Client) StartExitNodeWatch() error {
+
+	var (
+		fname    = c.Settings.ExitNodeConfig
+		interval = c.Settings.ExitNodeWatchInterval
+	)
+
+	if fname == "" || interval <= 0 {
+		return nil
+	}
+
+	info, err := os.Stat(fname)
+	if err != nil {
+		return err
+	}
+
+	// the goroutine keeps its own channels, stopExitNodeWatch resets the fields
+	var (
+		done    = make(chan struct{})
+		stopped = make(chan struct{})
+	)
+	c.exitWatchDone, c.exitWatchStopped = done, stopped
+
+	go func(done <-chan struct{}, stopped chan<- struct{}, modTime time.Time) {
+
+		defer close(stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+
+			info, err := os.Stat(fname)
+			if err != nil || info.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = info.ModTime()
+
+			err = c.ReloadExitNode()
+			if err != nil {
+				log.Errorf("%v", err)
+			}
+		}
+	}(done, stopped, info.ModTime())
+
+	return nil
+}
+
+// stopExitNodeWatch stops watching the exit node config and waits for a running reload
+func (c *Client) stopExitNodeWatch() {
+	if c.exitWatchDone != nil {
+		close(c.exitWatchDone)
+		<-c.exitWatchStopped
+		c.exitWatchDone, c.exitWatchStopped = nil, nil
+	}
+}
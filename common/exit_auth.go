@@ -0,0 +1,152 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+	"time"
+
+	core "github.com/libp2p/go-libp2p-core"
+	"github.com/pkg/errors"
+)
+
+// who may connect to a service (empty - everyone)
+const (
+	AccessOwner     = "owner"     // nodes of the team hosting the service
+	AccessOrganizer = "organizer" // holders of the organizer key
+)
+
+// kinds of access proofs in connection open requests
+const (
+	exitAuthNone byte = iota
+	exitAuthMember
+	exitAuthOrganizer
+)
+
+// requests to restricted services older than this are refused
+const exitAuthMaxAge = 2 * time.Minute
+
+// exitAuthDigest returns the hash of a request signed by its access proof,
+// the proof is bound to the exit node
+func exitAuthDigest(req *connectionOpenRequest, exit core.PeerID) []byte {
+
+	var buf bytes.Buffer
+
+	buf.WriteString("pe2pe exit access\x00")
+	_ = binary.Write(&buf, binary.BigEndian, req.Timestamp)
+	_ = binary.Write(&buf, binary.BigEndian, req.Port)
+	buf.Write(req.StreamID[:])
+	buf.Write(req.Addr[:])
+	buf.Write(req.Circuit[:])
+	buf.WriteString(string(exit))
+
+	hash := sha256.Sum256(buf.Bytes())
+
+	return hash[:]
+}
+
+// signExitAuth attaches an access proof of the kind to the request
+func signExitAuth(req *connectionOpenRequest, exit core.PeerID, kind byte, key *ecdsa.PrivateKey) error {
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, exitAuthDigest(req, exit))
+	if err != nil {
+		return errors.Wrap(err, "signing access proof")
+	}
+
+	var size = (key.Curve.Params().BitSize + 7) / 8
+	if 2*size > len(req.AuthSignature) {
+		return errors.Errorf("access proof key is too long (%v bits)", key.Curve.Params().BitSize)
+	}
+
+	req.AuthKind = kind
+	req.AuthSignature = [64]byte{}
+	copy(req.AuthSignature[size-len(r.Bytes()):size], r.Bytes())
+	copy(req.AuthSignature[2*size-len(s.Bytes()):2*size], s.Bytes())
+
+	return nil
+}
+
+// verifyExitAuth checks the access proof signature of the request
+func verifyExitAuth(req *connectionOpenRequest, exit core.PeerID, key *ecdsa.PublicKey) bool {
+
+	var (
+		size = (key.Curve.Params().BitSize + 7) / 8
+		r    = new(big.Int).SetBytes(req.AuthSignature[:size])
+		s    = new(big.Int).SetBytes(req.AuthSignature[size : 2*size])
+	)
+
+	return ecdsa.Verify(key, exitAuthDigest(req, exit), r, s)
+}
+
+// WithExitAuth makes connections dialed with the context prove access to restricted services.
+// The proofs can be verified by every exit, so streams without the context carry none
+// and can not be told apart from team traffic.
+func WithExitAuth(ctx context.Context) context.Context {
+	return context.WithValue(ctx, exitAuthKey, true)
+}
+
+// exitAuthFromContext reports whether access proofs were requested
+func exitAuthFromContext(ctx context.Context) bool {
+	auth, _ := ctx.Value(exitAuthKey).(bool)
+	return auth
+}
+
+// attachExitAuth proves access to restricted services of the destination if possible:
+// organizer nodes sign with the organizer key, nodes of the same team with their onion key
+func (c *Client) attachExitAuth(req *connectionOpenRequest, dest core.PeerID) error {
+
+	if key := c.Settings.Crypto.OrganizerPrivateKey; key != nil {
+		return signExitAuth(req, dest, exitAuthOrganizer, key)
+	}
+
+	var (
+		ns                = c.Network()
+		self, selfFound   = ns.Nodes[c.Host.ID()]
+		target, destFound = ns.Nodes[dest]
+	)
+
+	if selfFound && destFound && self.ID != "" && self.ID == target.ID {
+		return signExitAuth(req, dest, exitAuthMember, &c.Settings.Crypto.OnionKey)
+	}
+
+	return nil
+}
+
+// checkExitAuth refuses requests to restricted services without a valid access proof
+func checkExitAuth(req *connectionOpenRequest, access string, self core.PeerID, ns *NetworkSettings, organizer *ecdsa.PublicKey) error {
+
+	if access == "" {
+		return nil
+	}
+
+	if age := time.Since(time.Unix(req.Timestamp, 0)); age > exitAuthMaxAge || age < -exitAuthMaxAge {
+		return errors.Wrapf(ErrAccessDenied, "request is %v old", age)
+	}
+
+	switch {
+	case access == AccessOrganizer && req.AuthKind == exitAuthOrganizer && organizer != nil:
+		if verifyExitAuth(req, self, organizer) {
+			return nil
+		}
+
+	case access == AccessOwner && req.AuthKind == exitAuthMember:
+		owner, found := ns.Nodes[self]
+		if !found || owner.ID == "" {
+			break
+		}
+
+		// any node of the team may sign
+		for _, member := range ns.Nodes {
+			key := member.OnionKey
+			if member.ID == owner.ID && key.Curve != nil && verifyExitAuth(req, self, &key) {
+				return nil
+			}
+		}
+	}
+
+	return errors.Wrapf(ErrAccessDenied, "%v only", access)
+}
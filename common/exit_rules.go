@@ -0,0 +1,556 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// actions of exit rules
+const (
+	RuleDrop     = "drop"     // close the stream
+	RuleReset    = "reset"    // reset the onion stream
+	RuleTruncate = "truncate" // pass the data before the match, then close the stream
+	RuleLog      = "log"      // only log the match
+	RuleLimit    = "limit"    // streams of the circuit (or of the service) are over the rate
+)
+
+const (
+	rulesOverlap       = 1024        // data kept between reads (matches split across them)
+	rulesCheckInterval = time.Second // how often rules files are checked for changes
+)
+
+// ExitRules are the filtering rules of a service, one per line:
+//
+//	# comments and empty lines are ignored
+//	drop request ~ \.\./
+//	reset request ~ (?i)union\s+select
+//	truncate response ~ [A-Z0-9]{31}= unless request ~ ^PUT /flags
+//	log response ~ password
+//	limit 5 per second
+//	limit 100 per second total
+//
+// Patterns are regular expressions matched against the data of a direction
+// ("request" - to the service, "response" - to the client), "^" matches only at the start
+// of the direction ("(?m)^" - at line starts). Rules with "unless" are skipped once its
+// pattern matches in the stream. "limit" refuses streams of circuits opening more than
+// N streams per second, "limit ... total" - streams of the service over the rate. Circuits
+// are chosen by the clients: only streams of isolated clients share one, every other
+// stream gets a new circuit and is never refused by the per-circuit limit, so only the
+// total limit bounds a flood. Limits keep their state while their rule text is unchanged
+// (across reloads of the rules file and of the exit node config).
+type ExitRules struct {
+	rules     []exitRule
+	limit     *rateLimitMiddleware
+	limitRule exitRule
+	total     *rateLimitMiddleware
+	totalRule exitRule
+}
+
+type exitRule struct {
+	line    int
+	text    string
+	action  string
+	dir     int
+	pattern *rulePattern
+	// the rule is skipped after this pattern matches in the direction
+	unlessDir int
+	unless    *rulePattern
+}
+
+// rulePattern is a compiled pattern of a rule
+type rulePattern struct {
+	*regexp.Regexp
+	// the pattern is anchored to the start of the data or of a line
+	beginText bool
+	beginLine bool
+}
+
+// compileRulePattern compiles a pattern and finds its anchors
+func compileRulePattern(expr string) (*rulePattern, error) {
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		rp   = &rulePattern{Regexp: re}
+		walk func(*syntax.Regexp)
+	)
+
+	walk = func(node *syntax.Regexp) {
+		switch node.Op {
+		case syntax.OpBeginText:
+			rp.beginText = true
+		case syntax.OpBeginLine:
+			rp.beginLine = true
+		}
+
+		for _, sub := range node.Sub {
+			walk(sub)
+		}
+	}
+	walk(parsed)
+
+	return rp, nil
+}
+
+// RuleMatch is a rule matched by a stream
+type RuleMatch struct {
+	Stream string
+	Line   int
+	Rule   string
+	Action string
+	// the matched data
+	Data string
+}
+
+// LoadExitRules reads a rules file
+func LoadExitRules(fname string) (*ExitRules, error) {
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := ParseExitRules(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %v", fname)
+	}
+
+	return rules, nil
+}
+
+// ParseExitRules parses rules
+func ParseExitRules(data []byte) (*ExitRules, error) {
+
+	var (
+		rules   ExitRules
+		scanner = bufio.NewScanner(bytes.NewReader(data))
+		line    int
+	)
+
+	for scanner.Scan() {
+		line++
+
+		var text = strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		err := rules.parseRule(line, text)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %v", line)
+		}
+	}
+
+	return &rules, scanner.Err()
+}
+
+// parseRule parses "<action> <request|response> ~ <pattern> [unless <request|response> ~ <pattern>]"
+// or "limit <N> per second [total]"
+func (r *ExitRules) parseRule(line int, text string) error {
+
+	var fields = strings.Fields(text)
+
+	if fields[0] == RuleLimit {
+		var total = len(fields) == 5 && fields[4] == "total"
+
+		if (len(fields) != 4 && !total) || fields[2] != "per" || fields[3] != "second" {
+			return errors.New(`"limit <N> per second [total]" expected`)
+		}
+
+		rate, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || rate <= 0 {
+			return errors.Errorf("invalid rate %v", fields[1])
+		}
+
+		var limit = &rateLimitMiddleware{rate: rate, burst: rate, buckets: make(map[string]*rateBucket)}
+		if limit.burst < 1 {
+			limit.burst = 1
+		}
+
+		if total {
+			r.total, r.totalRule = limit, exitRule{line: line, text: text, action: RuleLimit}
+		} else {
+			r.limit, r.limitRule = limit, exitRule{line: line, text: text, action: RuleLimit}
+		}
+
+		return nil
+	}
+
+	var rule = exitRule{line: line, text: text, action: fields[0]}
+
+	switch rule.action {
+	case RuleDrop, RuleReset, RuleTruncate, RuleLog:
+	default:
+		return errors.Errorf("unknown action %v", rule.action)
+	}
+
+	var condition = strings.TrimSpace(strings.TrimPrefix(text, rule.action))
+	if idx := strings.LastIndex(condition, " unless "); idx >= 0 {
+
+		var err error
+		rule.unlessDir, rule.unless, err = parseRuleCondition(condition[idx+len(" unless "):])
+		if err != nil {
+			return errors.Wrap(err, "unless")
+		}
+
+		condition = condition[:idx]
+	}
+
+	var err error
+	rule.dir, rule.pattern, err = parseRuleCondition(condition)
+	if err != nil {
+		return err
+	}
+
+	r.rules = append(r.rules, rule)
+
+	return nil
+}
+
+// parseRuleCondition parses "<request|response> ~ <pattern>"
+func parseRuleCondition(condition string) (int, *rulePattern, error) {
+
+	var parts = strings.SplitN(strings.TrimSpace(condition), " ~ ", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		return 0, nil, errors.Errorf(`"request|response ~ <pattern>" expected, got %q`, condition)
+	}
+
+	var dir int
+	switch strings.TrimSpace(parts[0]) {
+	case "request":
+		dir = 0
+	case "response":
+		dir = 1
+	default:
+		return 0, nil, errors.Errorf("unknown direction %v", parts[0])
+	}
+
+	pattern, err := compileRulePattern(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "parsing pattern %v", parts[1])
+	}
+
+	return dir, pattern, nil
+}
+
+// inherit keeps the rate limits of the old rules that did not change
+func (r *ExitRules) inherit(old *ExitRules) {
+
+	if old == nil {
+		return
+	}
+
+	if r.limit != nil && old.limit != nil && r.limitRule.text == old.limitRule.text {
+		r.limit = old.limit
+	}
+
+	if r.total != nil && old.total != nil && r.totalRule.text == old.totalRule.text {
+		r.total = old.total
+	}
+}
+
+// limited takes a stream of the circuit from the rate limits,
+// streams over the rate are reported as matches of the limit rule
+// (streams refused by the circuit limit do not count for the total one)
+func (r *ExitRules) limited(id, circuit string, now time.Time) (RuleMatch, bool) {
+
+	var rule *exitRule
+
+	switch {
+	case r.limit != nil && r.limit.reserve(circuit, now) != 0:
+		rule = &r.limitRule
+	case r.total != nil && r.total.reserve("", now) != 0:
+		rule = &r.totalRule
+	default:
+		return RuleMatch{}, false
+	}
+
+	return RuleMatch{
+		Stream: id,
+		Line:   rule.line,
+		Rule:   rule.text,
+		Action: RuleLimit,
+		Data:   circuit,
+	}, true
+}
+
+// stream returns the filter of a stream, matches are reported to the callback
+func (r *ExitRules) stream(id string, onMatch func(RuleMatch)) *rulesFilter {
+	return &rulesFilter{
+		rules:   r,
+		id:      id,
+		skipped: make([]bool, len(r.rules)),
+		onMatch: onMatch,
+	}
+}
+
+// rulesFilter applies rules to the data of a stream
+type rulesFilter struct {
+	rules   *ExitRules
+	id      string
+	onMatch func(RuleMatch)
+
+	lock    sync.Mutex
+	tails   [2][]byte
+	trimmed [2]bool // the tail does not start at the beginning of the direction
+	before  [2]byte // the byte before a trimmed tail
+	skipped []bool  // "unless" matched
+	stopped error
+}
+
+func (rf *rulesFilter) Request(data []byte) ([]byte, error) {
+	return rf.filter(0, data)
+}
+
+func (rf *rulesFilter) Response(data []byte) ([]byte, error) {
+	return rf.filter(1, data)
+}
+
+// filter applies the rules of a direction, the first matching drop, reset or truncate rule
+// stops the stream
+func (rf *rulesFilter) filter(dir int, data []byte) ([]byte, error) {
+
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+
+	if rf.stopped != nil {
+		return nil, rf.stopped
+	}
+
+	var (
+		buf    = append(rf.tails[dir], data...)
+		offset = len(rf.tails[dir])
+	)
+
+	for i, rule := range rf.rules.rules {
+		if rule.unless != nil && rule.unlessDir == dir && rf.find(dir, rule.unless, buf, -1) != nil {
+			rf.skipped[i] = true
+		}
+	}
+
+	for i, rule := range rf.rules.rules {
+
+		if rule.dir != dir || rf.skipped[i] {
+			continue
+		}
+
+		// matches inside the kept tail were handled with the previous data
+		loc := rf.find(dir, rule.pattern, buf, offset)
+		if loc == nil {
+			continue
+		}
+
+		rf.onMatch(RuleMatch{
+			Stream: rf.id,
+			Line:   rule.line,
+			Rule:   rule.text,
+			Action: rule.action,
+			Data:   string(buf[loc[0]:loc[1]]),
+		})
+
+		switch rule.action {
+		case RuleDrop:
+			rf.stopped = ErrDropStream
+			return nil, rf.stopped
+
+		case RuleReset:
+			rf.stopped = ErrResetStream
+			return nil, rf.stopped
+
+		case RuleTruncate:
+			var cut = loc[0] - offset
+			if cut < 0 {
+				cut = 0
+			}
+			rf.stopped = ErrDropStream
+			return data[:cut], rf.stopped
+		}
+	}
+
+	if len(buf) > rulesOverlap {
+		rf.trimmed[dir], rf.before[dir] = true, buf[len(buf)-rulesOverlap-1]
+		buf = buf[len(buf)-rulesOverlap:]
+	}
+	rf.tails[dir] = append(rf.tails[dir][:0], buf...)
+
+	return data, nil
+}
+
+// find returns the first match of the pattern ending after the offset (nil - none).
+// The start of a trimmed tail is not the start of the direction, anchored
+// patterns may match there only if it starts a line.
+func (rf *rulesFilter) find(dir int, pattern *rulePattern, buf []byte, offset int) []int {
+
+	var anchored = rf.trimmed[dir] &&
+		(pattern.beginText || (pattern.beginLine && rf.before[dir] != '\n'))
+
+	for _, match := range pattern.FindAllIndex(buf, -1) {
+		if match[1] <= offset || (match[0] == 0 && anchored) {
+			continue
+		}
+		return match
+	}
+
+	return nil
+}
+
+// rulesMiddleware applies the rules file of a service, the file is reloaded when it changes
+type rulesMiddleware struct {
+	fname string
+
+	lock    sync.Mutex
+	rules   *ExitRules
+	modTime time.Time
+	checked time.Time
+}
+
+// newRulesMiddleware loads the rules file of a service
+func newRulesMiddleware(fname string) (*rulesMiddleware, error) {
+
+	info, err := os.Stat(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := LoadExitRules(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rulesMiddleware{
+		fname:   fname,
+		rules:   rules,
+		modTime: info.ModTime(),
+		checked: time.Now(),
+	}, nil
+}
+
+// current returns the rules, reloading the file if it changed (broken files are ignored)
+func (rm *rulesMiddleware) current(now time.Time) *ExitRules {
+
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+
+	if now.Sub(rm.checked) < rulesCheckInterval {
+		return rm.rules
+	}
+	rm.checked = now
+
+	info, err := os.Stat(rm.fname)
+	if err != nil || info.ModTime().Equal(rm.modTime) {
+		return rm.rules
+	}
+	rm.modTime = info.ModTime()
+
+	rules, err := LoadExitRules(rm.fname)
+	if err != nil {
+		log.Errorf("Keeping the previous rules: %v", err)
+		return rm.rules
+	}
+
+	log.Infof("Reloaded rules %v", rm.fname)
+	rules.inherit(rm.rules)
+	rm.rules = rules
+
+	return rules
+}
+
+// inherit keeps the rate limits of the rules middleware replaced by a reload of the exit node config
+func (rm *rulesMiddleware) inherit(old *rulesMiddleware) {
+
+	old.lock.Lock()
+	var prev = old.rules
+	old.lock.Unlock()
+
+	rm.lock.Lock()
+	rm.rules.inherit(prev)
+	rm.lock.Unlock()
+}
+
+func (rm *rulesMiddleware) Stream(_ context.Context, meta *StreamMeta) (StreamFilter, error) {
+
+	var rules = rm.current(time.Now())
+
+	if match, limited := rules.limited(meta.ID, meta.Circuit.String(), time.Now()); limited {
+		logRuleMatch(meta.Service, match)
+		return nil, errors.Wrap(ErrServiceBusy, "rate limited by rules")
+	}
+
+	if len(rules.rules) == 0 {
+		return nil, nil
+	}
+
+	return rules.stream(meta.ID, func(match RuleMatch) {
+		logRuleMatch(meta.Service, match)
+	}), nil
+}
+
+func logRuleMatch(service string, match RuleMatch) {
+	log.Infof("Rule %q (line %v) matched stream %v of %v: %q", match.Rule, match.Line, match.Stream, service, match.Data)
+}
+
+// RuleVerdict is the result of rules applied to a recorded stream
+type RuleVerdict struct {
+	Stream  *CapturedStream
+	Matches []RuleMatch
+	// the stream would be stopped with this action (empty - passed)
+	Action string
+}
+
+// Replay applies the rules to a recorded stream like to a live one
+// (rate limits use the recorded times)
+func (r *ExitRules) Replay(cs *CapturedStream) RuleVerdict {
+
+	var verdict = RuleVerdict{Stream: cs}
+
+	var client = cs.Client
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+
+	if match, limited := r.limited(cs.ID, client, cs.Start); limited {
+		verdict.Matches, verdict.Action = []RuleMatch{match}, RuleLimit
+		return verdict
+	}
+
+	filter := r.stream(cs.ID, func(match RuleMatch) {
+		verdict.Matches = append(verdict.Matches, match)
+	})
+
+	for _, chunk := range cs.Chunks {
+
+		var err error
+		if chunk.Response {
+			_, err = filter.Response(chunk.Data)
+		} else {
+			_, err = filter.Request(chunk.Data)
+		}
+
+		if err != nil {
+			verdict.Action = verdict.Matches[len(verdict.Matches)-1].Action
+			break
+		}
+	}
+
+	return verdict
+}
@@ -0,0 +1,310 @@
+package common
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+const testRules = `
+# web service
+drop request ~ \.\./
+truncate response ~ [A-Z0-9]{31}= unless request ~ ^PUT /flags
+log response ~ secret
+limit 2 per second
+`
+
+func TestParseExitRules(t *testing.T) {
+
+	rules, err := ParseExitRules([]byte(testRules))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Len(t, rules.rules, 3)
+	assert.Equal(t, 3, rules.rules[0].line)
+	assert.NotNil(t, rules.rules[1].unless)
+	assert.Equal(t, 2.0, rules.limit.rate)
+
+	for _, text := range []string{
+		"block request ~ a",
+		"drop stdin ~ a",
+		"drop request ~ (",
+		"drop request",
+		"drop request ~ a unless response ~",
+		"limit 5 per minute",
+		"limit 0 per second",
+		"limit 5 per second in total",
+	} {
+		_, err := ParseExitRules([]byte(text))
+		assert.Error(t, err, text)
+	}
+}
+
+func TestExitRulesFilter(t *testing.T) {
+
+	rules, err := ParseExitRules([]byte(testRules))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	var (
+		matches []RuleMatch
+		flag    = "ABCDEFGHIJKLMNOPQRSTUVWXYZ01234="
+	)
+
+	// flags are cut off unless the checker puts them
+	filter := rules.stream("s1", func(match RuleMatch) {
+		matches = append(matches, match)
+	})
+
+	data, err := filter.Request([]byte("GET /note HTTP/1.1\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "GET /note HTTP/1.1\r\n", string(data))
+
+	data, err = filter.Response([]byte("a secret: " + flag[:8]))
+	assert.NoError(t, err)
+	assert.Equal(t, "a secret: "+flag[:8], string(data))
+
+	data, err = filter.Response([]byte(flag[8:] + " tail"))
+	assert.Equal(t, ErrDropStream, err)
+	assert.Empty(t, data)
+
+	_, err = filter.Request([]byte("more"))
+	assert.Equal(t, ErrDropStream, err)
+
+	if assert.Len(t, matches, 2) {
+		assert.Equal(t, RuleMatch{Stream: "s1", Line: 5, Rule: "log response ~ secret", Action: RuleLog, Data: "secret"}, matches[0])
+		assert.Equal(t, RuleTruncate, matches[1].Action)
+		assert.Equal(t, flag, matches[1].Data)
+	}
+
+	filter = rules.stream("s2", func(RuleMatch) {})
+
+	_, err = filter.Request([]byte("PUT /flags HTTP/1.1\r\n"))
+	assert.NoError(t, err)
+	data, err = filter.Response([]byte("OK " + flag))
+	assert.NoError(t, err)
+	assert.Equal(t, "OK "+flag, string(data))
+
+	_, err = filter.Request([]byte("GET /.."))
+	assert.NoError(t, err)
+	_, err = filter.Request([]byte("/etc"))
+	assert.Equal(t, ErrDropStream, err)
+
+	// streams over the rate are refused
+	var now = time.Now()
+	for i := 0; i < 2; i++ {
+		_, limited := rules.limited("s", "fd70::1", now)
+		assert.False(t, limited)
+	}
+	match, limited := rules.limited("s", "fd70::1", now)
+	assert.True(t, limited)
+	assert.Equal(t, 6, match.Line)
+
+	// new circuits do not get around the total limit
+	rules, err = ParseExitRules([]byte("limit 2 per second\nlimit 3 per second total\n"))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	for _, circuit := range []string{"fd70::1", "fd70::2", "fd70::3"} {
+		_, limited = rules.limited("s", circuit, now)
+		assert.False(t, limited)
+	}
+	match, limited = rules.limited("s", "fd70::4", now)
+	assert.True(t, limited)
+	assert.Equal(t, 2, match.Line)
+}
+
+func TestExitRulesAnchors(t *testing.T) {
+
+	rules, err := ParseExitRules([]byte(testRules + "drop request ~ ^DELETE \\S*admin\nreset request ~ (?m)^SHUTDOWN\n"))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	var (
+		flag    = "ABCDEFGHIJKLMNOPQRSTUVWXYZ01234="
+		padding = strings.Repeat("x", rulesOverlap+100)
+	)
+
+	// a padded request can not pass for the checker once the kept data is cut
+	filter := rules.stream("s1", func(RuleMatch) {})
+
+	var put = "PUT /flags HTTP/1.1\r\n"
+	for _, chunk := range []string{"GET /" + padding, put + padding[:rulesOverlap-len(put)], "\r\n"} {
+		_, err = filter.Request([]byte(chunk))
+		assert.NoError(t, err)
+	}
+
+	data, err := filter.Response([]byte("OK " + flag))
+	assert.Equal(t, ErrDropStream, err)
+	assert.Equal(t, "OK ", string(data))
+
+	// anchored rules do not fire in the middle of a stream
+	filter = rules.stream("s2", func(RuleMatch) {})
+
+	var del = "DELETE /notes"
+	for _, chunk := range []string{"POST /" + padding, del + padding[:rulesOverlap-len(del)], "admin"} {
+		_, err = filter.Request([]byte(chunk))
+		assert.NoError(t, err)
+	}
+
+	_, err = filter.Request([]byte("\nSHUTDOWN"))
+	assert.Equal(t, ErrResetStream, err)
+
+	// line anchors still match at the start of a cut tail after a newline
+	var shutdown = rules.rules[len(rules.rules)-1].pattern
+
+	filter = rules.stream("s3", func(RuleMatch) {})
+	filter.trimmed[0], filter.before[0] = true, '\n'
+	assert.NotNil(t, filter.find(0, shutdown, []byte("SHUTDOWN"), -1))
+
+	filter.before[0] = 'x'
+	assert.Nil(t, filter.find(0, shutdown, []byte("SHUTDOWN"), -1))
+}
+
+func TestRulesReload(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "pe2pe")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	var fname = filepath.Join(dir, "web.rules")
+	assert.NoError(t, ioutil.WriteFile(fname, []byte("drop request ~ evil\n"), 0600))
+
+	var en = ExitNodeSettings{"4041": {Backends: []string{"127.0.0.1:4041"}, Rules: fname}}
+	if !assert.NoError(t, en.validate()) {
+		t.FailNow()
+	}
+
+	rm := en["4041"].middleware[0].(*rulesMiddleware)
+	var meta = StreamMeta{ID: "s", Circuit: net.IPv6loopback}
+
+	filter, err := rm.Stream(context.Background(), &meta)
+	assert.NoError(t, err)
+	_, err = filter.Request([]byte("evil"))
+	assert.Equal(t, ErrDropStream, err)
+
+	// broken rules are ignored, fixed ones are applied
+	var later = time.Now().Add(time.Minute)
+	assert.NoError(t, ioutil.WriteFile(fname, []byte("drop request ~ (\n"), 0600))
+	assert.NoError(t, os.Chtimes(fname, later, later))
+	assert.Len(t, rm.current(time.Now().Add(2*time.Second)).rules, 1)
+
+	later = later.Add(time.Minute)
+	assert.NoError(t, ioutil.WriteFile(fname, []byte("reset request ~ bad\nlimit 1 per second\n"), 0600))
+	assert.NoError(t, os.Chtimes(fname, later, later))
+	rm.checked = time.Time{}
+
+	filter, err = rm.Stream(context.Background(), &meta)
+	assert.NoError(t, err)
+	_, err = filter.Request([]byte("evil"))
+	assert.NoError(t, err)
+	_, err = filter.Request([]byte("bad"))
+	assert.Equal(t, ErrResetStream, err)
+
+	_, err = rm.Stream(context.Background(), &meta)
+	assert.Equal(t, exitBusy, exitStatus(err))
+
+	// unchanged limits keep their state when the rules file changes
+	later = later.Add(time.Minute)
+	assert.NoError(t, ioutil.WriteFile(fname, []byte("drop request ~ bad\nlimit 1 per second\n"), 0600))
+	assert.NoError(t, os.Chtimes(fname, later, later))
+	rm.checked = time.Time{}
+
+	_, err = rm.Stream(context.Background(), &meta)
+	assert.Equal(t, exitBusy, exitStatus(err))
+
+	// and when the exit node config is reloaded
+	var reloaded = ExitNodeSettings{"4041": {Backends: []string{"127.0.0.1:4042"}, Rules: fname}}
+	if !assert.NoError(t, reloaded.validate()) {
+		t.FailNow()
+	}
+	reloaded.inherit(&en)
+
+	_, err = reloaded["4041"].middleware[0].Stream(context.Background(), &meta)
+	assert.Equal(t, exitBusy, exitStatus(err))
+
+	// changed limits start over
+	later = later.Add(time.Minute)
+	assert.NoError(t, ioutil.WriteFile(fname, []byte("limit 2 per second\n"), 0600))
+	assert.NoError(t, os.Chtimes(fname, later, later))
+	rm.checked = time.Time{}
+
+	_, err = rm.Stream(context.Background(), &meta)
+	assert.NoError(t, err)
+
+	en = ExitNodeSettings{"4041": {Backends: []string{"127.0.0.1:4041"}, Rules: filepath.Join(dir, "missing")}}
+	assert.Error(t, en.validate())
+}
+
+func TestReplayCapture(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "pe2pe")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	for _, format := range []string{CapturePcapNG, CapturePcap} {
+
+		var c = &Client{Settings: &Settings{CaptureDir: filepath.Join(dir, format), CaptureFormat: format}}
+		if !assert.NoError(t, c.StartCapture()) {
+			t.FailNow()
+		}
+
+		var ids []uuid.UUID
+		for _, request := range []string{"GET /note HTTP/1.1\r\n", "GET /../etc/passwd HTTP/1.1\r\n"} {
+
+			var req = connectionOpenRequest{Port: 4041, StreamID: uuid.New(), Circuit: [8]byte{byte(len(ids))}}
+			copy(req.Addr[:], net.ParseIP("10.0.3.5").To16())
+			ids = append(ids, req.StreamID)
+
+			stream := c.capture.wrap("4041", nil, &req).(*capturedConn).stream
+			stream.data(0, []byte(request))
+			stream.data(1, []byte("HTTP/1.1 200 OK\r\n\r\n"))
+			stream.close()
+		}
+		c.stopCapture()
+
+		files, _ := filepath.Glob(filepath.Join(dir, format, "4041-*"))
+		if !assert.Len(t, files, 1) {
+			t.FailNow()
+		}
+
+		streams, err := ReadCapture(files[0])
+		if !assert.NoError(t, err) || !assert.Len(t, streams, 2) {
+			t.FailNow()
+		}
+
+		assert.Equal(t, "10.0.3.5:4041", streams[0].Server)
+		assert.Len(t, streams[0].Chunks, 2)
+		assert.Equal(t, "GET /note HTTP/1.1\r\n", string(streams[0].Chunks[0].Data))
+		assert.True(t, streams[0].Chunks[1].Response)
+
+		if format == CapturePcapNG {
+			assert.Equal(t, ids[0].String(), streams[0].ID)
+		}
+
+		rules, err := ParseExitRules([]byte(testRules))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		assert.Equal(t, "", rules.Replay(streams[0]).Action)
+		verdict := rules.Replay(streams[1])
+		assert.Equal(t, RuleDrop, verdict.Action)
+		assert.Equal(t, streams[1].ID, verdict.Matches[0].Stream)
+	}
+}
@@ -0,0 +1,410 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// how a backend of a service is chosen
+const (
+	BalanceRoundRobin = "round-robin" // the next backend for every stream (default)
+	BalanceHealth     = "health"      // the first backend that is not failing
+)
+
+// UnixBackend is the prefix of unix socket backends ("unix:/run/service.sock")
+const UnixBackend = "unix:"
+
+// a backend that failed to connect is tried after the others for this long
+const exitBackendRetry = 10 * time.Second
+
+// ExitService is a service hosted by the exit node
+type ExitService struct {
+	// "127.0.0.1:8080", "[::1]:8080" or "unix:/run/service.sock";
+	// backends without a port are connected on the requested one (port ranges)
+	Backends []string
+	// BalanceRoundRobin (empty) or BalanceHealth
+	Balance string
+	// connect timeout of a single backend and idle timeout of streams (0 - none)
+	ConnectTimeout time.Duration
+	IdleTimeout    time.Duration
+	// maximum amount of concurrent streams (0 - unlimited)
+	MaxConns int
+	// the service is temporarily down, streams are refused with ErrMaintenance
+	Maintenance bool
+	// streams start with a PROXY protocol v2 header: the source is a synthetic address
+	// of the client circuit, the stream ID is sent as PP2_TYPE_UNIQUE_ID
+	ProxyProtocol bool
+	// AccessOwner or AccessOrganizer restrict the service (empty - everyone)
+	Access string
+	// filters of the streams, the first one sees the data of the client first
+	Middleware []MiddlewareConfig
+	// rules file applied before the middlewares (see ExitRules), reloaded when it changes
+	Rules string
+	// client data of the streams is copied to this backend (like Backends), its responses
+	// are only compared with the ones of the service (see Client.ShadowStats)
+	Shadow string
+
+	mapping    string
+	ip         net.IP  // nil - any address of the node
+	ports      PortSet // parsed from the mapping
+	state      *exitServiceState
+	middleware []Middleware
+}
+
+// exitServiceState is kept across reloads of the mapping
+type exitServiceState struct {
+	conns int64
+	next  uint32
+
+	lock sync.Mutex
+	down map[string]time.Time // backend -> when it failed
+}
+
+type encodeExitService struct {
+	Backends       []string
+	Balance        string
+	ConnectTimeout string
+	IdleTimeout    string
+	MaxConns       int
+	Maintenance    bool
+	ProxyProtocol  bool
+	Access         string
+	Middleware     []MiddlewareConfig
+	Rules          string
+	Shadow         string
+}
+
+// UnmarshalJSON accepts both service objects and single backends ("127.0.0.1:8080", ExitMaintenance)
+func (svc *ExitService) UnmarshalJSON(input []byte) error {
+
+	var backend string
+	if json.Unmarshal(input, &backend) == nil {
+		if backend == ExitMaintenance {
+			*svc = ExitService{Maintenance: true}
+		} else {
+			*svc = ExitService{Backends: []string{backend}}
+		}
+		return nil
+	}
+
+	var es encodeExitService
+
+	err := json.Unmarshal(input, &es)
+	if err != nil {
+		return errors.Wrap(err, "decoding service")
+	}
+
+	*svc = ExitService{
+		Backends:      es.Backends,
+		Balance:       es.Balance,
+		MaxConns:      es.MaxConns,
+		Maintenance:   es.Maintenance,
+		ProxyProtocol: es.ProxyProtocol,
+		Access:        es.Access,
+		Middleware:    es.Middleware,
+		Rules:         es.Rules,
+		Shadow:        es.Shadow,
+	}
+
+	for _, timeout := range []struct {
+		value string
+		dest  *time.Duration
+	}{
+		{es.ConnectTimeout, &svc.ConnectTimeout},
+		{es.IdleTimeout, &svc.IdleTimeout},
+	} {
+		if timeout.value == "" {
+			continue
+		}
+
+		*timeout.dest, err = time.ParseDuration(timeout.value)
+		if err != nil {
+			return errors.Wrapf(err, "parsing timeout %v", timeout.value)
+		}
+	}
+
+	return nil
+}
+
+// parseExitMapping parses a mapping key: ports ("80", "8000-8100") optionally with
+// a virtual address of the node ("10.60.2.3:80", "[fd00::3]:443")
+func parseExitMapping(mapping string) (net.IP, PortSet, error) {
+
+	var (
+		ip    net.IP
+		ports = mapping
+	)
+
+	if host, hostPorts, err := net.SplitHostPort(mapping); err == nil {
+		ip = net.ParseIP(host)
+		if ip == nil {
+			return nil, nil, errors.Errorf("exit mapping %v: %v is not an IP address", mapping, host)
+		}
+		ports = hostPorts
+	}
+
+	ps, err := ParsePortSet(ports)
+	if err != nil || len(ps) == 0 {
+		return nil, nil, errors.Errorf("exit mapping %v: invalid port %v", mapping, ports)
+	}
+
+	return ip, ps, nil
+}
+
+// validate checks the service of a mapping and prepares it for use
+func (svc *ExitService) validate(mapping string) error {
+
+	ip, ports, err := parseExitMapping(mapping)
+	if err != nil {
+		return err
+	}
+
+	if svc == nil {
+		return errors.Errorf("exit mapping %v has no service", mapping)
+	}
+
+	if len(svc.Backends) == 0 && !svc.Maintenance {
+		return errors.Errorf("exit mapping %v has no backends", mapping)
+	}
+
+	for _, backend := range svc.Backends {
+		if backend == "" || backend == UnixBackend {
+			return errors.Errorf("exit mapping %v has an empty backend", mapping)
+		}
+	}
+
+	if svc.Shadow == UnixBackend {
+		return errors.Errorf("exit mapping %v has an empty shadow", mapping)
+	}
+
+	if svc.Balance != "" && svc.Balance != BalanceRoundRobin && svc.Balance != BalanceHealth {
+		return errors.Errorf("exit mapping %v: unknown balance %v", mapping, svc.Balance)
+	}
+
+	if svc.Access != "" && svc.Access != AccessOwner && svc.Access != AccessOrganizer {
+		return errors.Errorf("exit mapping %v: unknown access %v", mapping, svc.Access)
+	}
+
+	if svc.MaxConns < 0 || svc.ConnectTimeout < 0 || svc.IdleTimeout < 0 {
+		return errors.Errorf("exit mapping %v has negative limits", mapping)
+	}
+
+	var middleware = make([]Middleware, 0, len(svc.Middleware)+1)
+	if svc.Rules != "" {
+		rules, err := newRulesMiddleware(svc.Rules)
+		if err != nil {
+			return errors.Wrapf(err, "exit mapping %v: loading rules", mapping)
+		}
+		middleware = append(middleware, rules)
+	}
+
+	for i := range svc.Middleware {
+		m, err := svc.Middleware[i].build()
+		if err != nil {
+			return errors.Wrapf(err, "exit mapping %v", mapping)
+		}
+		middleware = append(middleware, m)
+	}
+
+	svc.mapping, svc.ip, svc.ports, svc.middleware = mapping, ip, ports, middleware
+	if svc.state == nil {
+		svc.state = &exitServiceState{}
+	}
+
+	return nil
+}
+
+// size returns the amount of ports of the mapping
+func (svc *ExitService) size() int {
+
+	var n int
+	for _, r := range svc.ports {
+		n += r.To - r.From + 1
+	}
+
+	return n
+}
+
+// rules returns the middleware applying the rules file of the service (nil - no rules)
+func (svc *ExitService) rules() *rulesMiddleware {
+
+	if svc.Rules == "" || len(svc.middleware) == 0 {
+		return nil
+	}
+
+	rules, _ := svc.middleware[0].(*rulesMiddleware)
+	return rules
+}
+
+// hasBackend reports whether streams to the backend may stay open
+func (svc *ExitService) hasBackend(backend string) bool {
+
+	if svc == nil || svc.Maintenance {
+		return false
+	}
+
+	for _, b := range svc.Backends {
+		if b == backend {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backendAddr returns the network and address of a backend for the requested port
+func backendAddr(backend string, port int) (string, string) {
+
+	if strings.HasPrefix(backend, UnixBackend) {
+		return "unix", strings.TrimPrefix(backend, UnixBackend)
+	}
+
+	if _, _, err := net.SplitHostPort(backend); err == nil {
+		return "tcp", backend
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(backend, "["), "]")
+
+	return "tcp", net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// order returns the backends in the order they are tried: healthy ones first,
+// rotated for round-robin services
+func (svc *ExitService) order() []string {
+
+	var (
+		n       = len(svc.Backends)
+		start   int
+		ordered = make([]string, 0, n)
+	)
+
+	if svc.Balance != BalanceHealth {
+		start = int(atomic.AddUint32(&svc.state.next, 1)-1) % n
+	}
+
+	for i := 0; i < n; i++ {
+		ordered = append(ordered, svc.Backends[(start+i)%n])
+	}
+
+	svc.state.lock.Lock()
+	defer svc.state.lock.Unlock()
+
+	now := time.Now()
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return !svc.state.failing(ordered[i], now) && svc.state.failing(ordered[j], now)
+	})
+
+	return ordered
+}
+
+// failing reports whether the backend failed recently (the lock is held)
+func (st *exitServiceState) failing(backend string, now time.Time) bool {
+	failed, found := st.down[backend]
+	return found && now.Sub(failed) < exitBackendRetry
+}
+
+// report remembers whether a backend could be connected
+func (st *exitServiceState) report(backend string, err error) {
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if err == nil {
+		delete(st.down, backend)
+		return
+	}
+
+	if st.down == nil {
+		st.down = make(map[string]time.Time)
+	}
+	st.down[backend] = time.Now()
+}
+
+// acquire claims a stream of the service
+func (svc *ExitService) acquire() bool {
+
+	for {
+		conns := atomic.LoadInt64(&svc.state.conns)
+
+		if svc.MaxConns > 0 && conns >= int64(svc.MaxConns) {
+			return false
+		}
+
+		if atomic.CompareAndSwapInt64(&svc.state.conns, conns, conns+1) {
+			return true
+		}
+	}
+}
+
+// dial connects to a backend of the service for the requested port,
+// the backend entry is returned with the connection
+func (svc *ExitService) dial(ctx context.Context, port int) (net.Conn, string, error) {
+
+	if svc.Maintenance {
+		return nil, "", errors.Wrapf(ErrMaintenance, "port %v", port)
+	}
+
+	if !svc.acquire() {
+		return nil, "", errors.Wrapf(ErrServiceBusy, "port %v (%v streams)", port, svc.MaxConns)
+	}
+
+	var dialer = &net.Dialer{Timeout: svc.ConnectTimeout}
+
+	for _, backend := range svc.order() {
+
+		network, addr := backendAddr(backend, port)
+
+		conn, err := dialer.DialContext(ctx, network, addr)
+		svc.state.report(backend, err)
+		if err != nil {
+			log.Debugf("Failed to connect backend %v of port %v: %v", backend, port, err)
+			continue
+		}
+
+		return &serviceConn{Conn: conn, svc: svc}, backend, nil
+	}
+
+	atomic.AddInt64(&svc.state.conns, -1)
+
+	return nil, "", errors.Wrapf(ErrServiceDown, "port %v", port)
+}
+
+// serviceConn is a stream of a service, closing it frees the slot
+type serviceConn struct {
+	net.Conn
+	svc  *ExitService
+	once sync.Once
+}
+
+func (sc *serviceConn) Read(b []byte) (int, error) {
+	sc.touch()
+	return sc.Conn.Read(b)
+}
+
+func (sc *serviceConn) Write(b []byte) (int, error) {
+	sc.touch()
+	return sc.Conn.Write(b)
+}
+
+// touch moves the idle deadline
+func (sc *serviceConn) touch() {
+	if sc.svc.IdleTimeout > 0 {
+		_ = sc.Conn.SetDeadline(time.Now().Add(sc.svc.IdleTimeout))
+	}
+}
+
+func (sc *serviceConn) Close() error {
+	sc.once.Do(func() {
+		atomic.AddInt64(&sc.svc.state.conns, -1)
+	})
+	return sc.Conn.Close()
+}
@@ -0,0 +1,300 @@
+package common
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/derlaft/pe2pectf/go-socks5"
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitError(t *testing.T) {
+
+	for _, err := range []*ExitError{ErrPortNotMapped, ErrMaintenance, ErrServiceDown} {
+		var wrapped = errors.Wrap(err, "port 80")
+		assert.Equal(t, err, exitErrorFromStatus(exitStatus(wrapped)))
+	}
+
+	assert.Nil(t, exitErrorFromStatus(MagicWelcomeByte))
+	assert.Equal(t, exitFailed, exitStatus(errors.New("connection refused")))
+
+	assert.Equal(t, uint8(socks5.ReplyServerFailure), ErrMaintenance.ReplyCode())
+	assert.Equal(t, uint8(socks5.ReplyConnectionRefused), ErrPortNotMapped.ReplyCode())
+	assert.Equal(t, uint8(socks5.ReplyHostUnreachable), ErrServiceDown.ReplyCode())
+}
+
+func TestReloadExitNode(t *testing.T) {
+
+	fname := writeTemp(t, `{"80": "127.0.0.1:8080", "81": "127.0.0.1:8081"}`)
+	defer os.Remove(fname)
+
+	en, err := LoadExitNodeSettings(fname)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	var c = &Client{Settings: &Settings{ExitNodeConfig: fname, ExitNode: en}}
+
+	kept, keptPeer := net.Pipe()
+	moved, movedPeer := net.Pipe()
+	paused, pausedPeer := net.Pipe()
+	defer keptPeer.Close()
+	defer movedPeer.Close()
+	defer pausedPeer.Close()
+
+	c.trackExitStream(&exitStream{port: 80, target: "127.0.0.1:8080", conn: kept})
+	c.trackExitStream(&exitStream{port: 81, target: "127.0.0.1:8081", conn: moved})
+	untrack := c.trackExitStream(&exitStream{port: 81, target: "127.0.0.1:8081", conn: paused})
+	untrack()
+
+	assert.NoError(t, ioutil.WriteFile(fname, []byte(`{"80": "127.0.0.1:8080", "81": "maintenance"}`), 0600))
+	if !assert.NoError(t, c.ReloadExitNode()) {
+		t.FailNow()
+	}
+
+	assert.True(t, c.exitNode().Service(nil, 81).Maintenance)
+
+	// only the tracked stream of the changed mapping is closed
+	// (deadlines of closed pipes can not be set)
+	assert.NoError(t, kept.SetDeadline(time.Time{}))
+	assert.Error(t, moved.SetDeadline(time.Time{}))
+	assert.NoError(t, paused.SetDeadline(time.Time{}))
+
+	// broken configs keep the current mappings
+	assert.NoError(t, ioutil.WriteFile(fname, []byte(`{"80": `), 0600))
+	assert.Error(t, c.ReloadExitNode())
+	assert.True(t, c.exitNode().Service(nil, 80).hasBackend("127.0.0.1:8080"))
+}
+
+func TestExitNodeWatch(t *testing.T) {
+
+	fname := writeTemp(t, `{"80": "127.0.0.1:8080"}`)
+	defer os.Remove(fname)
+
+	en, err := LoadExitNodeSettings(fname)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	var c = &Client{Settings: &Settings{ExitNodeConfig: fname, ExitNode: en, ExitNodeWatchInterval: time.Millisecond * 10}}
+
+	if !assert.NoError(t, c.StartExitNodeWatch()) {
+		t.FailNow()
+	}
+
+	var later = time.Now().Add(time.Minute)
+	assert.NoError(t, ioutil.WriteFile(fname, []byte(`{"80": "maintenance"}`), 0600))
+	assert.NoError(t, os.Chtimes(fname, later, later))
+
+	for i := 0; i < 100 && !c.exitNode().Service(nil, 80).Maintenance; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.True(t, c.exitNode().Service(nil, 80).Maintenance)
+
+	// nothing is reloaded after the watch is stopped
+	c.stopExitNodeWatch()
+
+	later = later.Add(time.Minute)
+	assert.NoError(t, ioutil.WriteFile(fname, []byte(`{"80": "127.0.0.1:8080"}`), 0600))
+	assert.NoError(t, os.Chtimes(fname, later, later))
+
+	time.Sleep(time.Millisecond * 100)
+	assert.True(t, c.exitNode().Service(nil, 80).Maintenance)
+}
+
+func TestExitServiceDial(t *testing.T) {
+
+	var (
+		ctx       = context.Background()
+		listeners []net.Listener
+	)
+
+	dir, err := ioutil.TempDir("", "pe2pe")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	for _, addr := range [][2]string{{"tcp", "127.0.0.1:0"}, {"tcp", "127.0.0.1:0"}, {"unix", dir + "/service.sock"}} {
+		l, err := net.Listen(addr[0], addr[1])
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer l.Close()
+
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+
+		listeners = append(listeners, l)
+	}
+
+	var (
+		first  = listeners[0].Addr().String()
+		second = listeners[1].Addr().String()
+		unix   = UnixBackend + listeners[2].Addr().String()
+		dead   = "127.0.0.1:1"
+	)
+
+	service := func(svc *ExitService) *ExitService {
+		if !assert.NoError(t, svc.validate("4041")) {
+			t.FailNow()
+		}
+		return svc
+	}
+
+	dialed := func(svc *ExitService, port int) string {
+		conn, backend, err := svc.dial(ctx, port)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		_ = conn.Close()
+		return backend
+	}
+
+	// round-robin skips failing backends
+	svc := service(&ExitService{Backends: []string{first, dead, unix}})
+	assert.Equal(t, first, dialed(svc, 4041))
+	assert.Equal(t, unix, dialed(svc, 4041))
+	assert.Equal(t, unix, dialed(svc, 4041))
+	assert.Equal(t, first, dialed(svc, 4041))
+
+	// health-based services stay on the first healthy backend
+	svc = service(&ExitService{Backends: []string{dead, second, first}, Balance: BalanceHealth})
+	assert.Equal(t, second, dialed(svc, 4041))
+	assert.Equal(t, second, dialed(svc, 4041))
+
+	// backends without a port are connected on the requested one
+	_, port, _ := net.SplitHostPort(second)
+	portValue, _ := strconv.Atoi(port)
+	svc = service(&ExitService{Backends: []string{"127.0.0.1"}})
+	assert.Equal(t, "127.0.0.1", dialed(svc, portValue))
+
+	// stream limits and idle timeouts
+	svc = service(&ExitService{Backends: []string{first}, MaxConns: 1, IdleTimeout: 50 * time.Millisecond})
+
+	conn, _, err := svc.dial(ctx, 4041)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	_, _, err = svc.dial(ctx, 4041)
+	assert.Equal(t, ErrServiceBusy, errors.Cause(err))
+
+	_, err = conn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); assert.True(t, ok) {
+		assert.True(t, netErr.Timeout())
+	}
+
+	assert.NoError(t, conn.Close())
+	assert.Equal(t, first, dialed(svc, 4041))
+
+	// failed and paused services
+	_, _, err = service(&ExitService{Backends: []string{dead}}).dial(ctx, 4041)
+	assert.Equal(t, ErrServiceDown, errors.Cause(err))
+
+	_, _, err = service(&ExitService{Maintenance: true}).dial(ctx, 4041)
+	assert.Equal(t, ErrMaintenance, errors.Cause(err))
+}
+
+func TestExitAuth(t *testing.T) {
+
+	var keys = make([]*ecdsa.PrivateKey, 4)
+	for i := range keys {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		keys[i] = key
+	}
+
+	var (
+		organizer, exitKey, teammate, other = keys[0], keys[1], keys[2], keys[3]
+
+		ns = &NetworkSettings{Nodes: map[peer.ID]Member{
+			"exit":     {ID: "team1", OnionKey: exitKey.PublicKey},
+			"teammate": {ID: "team1", OnionKey: teammate.PublicKey},
+			"other":    {ID: "team2", OnionKey: other.PublicKey},
+		}}
+	)
+
+	request := func(kind byte, key *ecdsa.PrivateKey, exit peer.ID) *connectionOpenRequest {
+		var req = &connectionOpenRequest{Port: 22, Timestamp: time.Now().Unix(), StreamID: uuid.New()}
+		if key != nil {
+			assert.NoError(t, signExitAuth(req, exit, kind, key))
+		}
+		return req
+	}
+
+	check := func(req *connectionOpenRequest, access string) error {
+		return checkExitAuth(req, access, "exit", ns, &organizer.PublicKey)
+	}
+
+	// unrestricted services
+	assert.NoError(t, check(request(exitAuthNone, nil, ""), ""))
+
+	// owner-only services
+	assert.NoError(t, check(request(exitAuthMember, teammate, "exit"), AccessOwner))
+	assert.NoError(t, check(request(exitAuthMember, exitKey, "exit"), AccessOwner))
+	assert.Error(t, check(request(exitAuthMember, other, "exit"), AccessOwner))
+	assert.Error(t, check(request(exitAuthOrganizer, organizer, "exit"), AccessOwner))
+	assert.Error(t, check(request(exitAuthNone, nil, ""), AccessOwner))
+
+	// organizer-only services
+	assert.NoError(t, check(request(exitAuthOrganizer, organizer, "exit"), AccessOrganizer))
+	assert.Error(t, check(request(exitAuthMember, teammate, "exit"), AccessOrganizer))
+	assert.Error(t, check(request(exitAuthMember, organizer, "exit"), AccessOrganizer))
+
+	// proofs are bound to the exit, the request and its time
+	assert.Error(t, check(request(exitAuthOrganizer, organizer, "other"), AccessOrganizer))
+
+	req := request(exitAuthOrganizer, organizer, "exit")
+	req.Port = 23
+	assert.Error(t, check(req, AccessOrganizer))
+
+	req = &connectionOpenRequest{Port: 22, Timestamp: time.Now().Add(-time.Hour).Unix()}
+	assert.NoError(t, signExitAuth(req, "exit", exitAuthOrganizer, organizer))
+	assert.Equal(t, ErrAccessDenied, errors.Cause(check(req, AccessOrganizer)))
+}
+
+func TestExitAuthRequested(t *testing.T) {
+
+	organizer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	var c = &Client{Settings: &Settings{Crypto: &CryptoSettings{OrganizerPrivateKey: organizer}}}
+
+	// organizer nodes do not sign ordinary dials, exits could pick them out
+	req, err := c.newOpenRequest(context.Background(), "exit", net.ParseIP("10.0.0.2"), 4041, "")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, exitAuthNone, req.AuthKind)
+	assert.Equal(t, [64]byte{}, req.AuthSignature)
+
+	req, err = c.newOpenRequest(WithExitAuth(context.Background()), "exit", net.ParseIP("10.0.0.2"), 4041, "")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, exitAuthOrganizer, req.AuthKind)
+	assert.NoError(t, checkExitAuth(req, AccessOrganizer, "exit", &NetworkSettings{}, &organizer.PublicKey))
+}
@@ -0,0 +1,280 @@
+package common
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/derlaft/connectstream"
+	"github.com/pkg/errors"
+)
+
+// forwardAnyHost in a forward target binds one local port per team
+const forwardAnyHost = "*"
+
+// forwardSlots keeps the port offsets of teams by wildcard forward addr
+type forwardSlots map[string]map[string]int
+
+// portForward is a single local listener forwarding connections into the game network
+type portForward struct {
+	listener net.Listener
+
+	lock   sync.Mutex
+	target string // member ID or game address with port
+}
+
+func (pf *portForward) Target() string {
+	pf.lock.Lock()
+	defer pf.lock.Unlock()
+	return pf.target
+}
+
+func (pf *portForward) setTarget(target string) {
+	pf.lock.Lock()
+	defer pf.lock.Unlock()
+	pf.target = target
+}
+
+// StartForwards binds all configured port forwards and keeps them in sync with the network map
+func (c *Client) StartForwards() error {
+
+	err := c.applyForwards(c.Network())
+	if err != nil {
+		return err
+	}
+
+	c.OnNetworkChange(func(ns *NetworkSettings) {
+		err := c.applyForwards(ns)
+		if err != nil {
+			log.Errorf("Failed to reload port forwards: %v", err)
+		}
+	})
+
+	return nil
+}
+
+// expandForwards resolves wildcard forwards against the network map,
+// new teams are assigned the next free slots so that known teams keep their ports
+func expandForwards(fs ForwardSettings, ns *NetworkSettings, slots forwardSlots) (map[string]string, error) {
+
+	var (
+		ret   = make(map[string]string)
+		teams []string
+	)
+
+	for _, member := range ns.Nodes {
+		if !member.TrustedRelay {
+			teams = append(teams, member.ID)
+		}
+	}
+
+	sort.Strings(teams)
+
+	add := func(local, target string) error {
+		if prev, found := ret[local]; found && prev != target {
+			return errors.Errorf("local addr %v is used by both %v and %v", local, prev, target)
+		}
+		ret[local] = target
+		return nil
+	}
+
+	for local, target := range fs {
+
+		host, port, err := net.SplitHostPort(target)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing forward target %v", target)
+		}
+
+		if host != forwardAnyHost {
+			err = add(local, target)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		localHost, localPort, err := net.SplitHostPort(local)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing forward addr %v", local)
+		}
+
+		basePort, err := strconv.Atoi(localPort)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing forward port %v", localPort)
+		}
+
+		assigned, found := slots[local]
+		if !found {
+			assigned = make(map[string]int)
+			slots[local] = assigned
+		}
+
+		// slots of removed teams are not reused
+		var next int
+		for _, slot := range assigned {
+			if slot >= next {
+				next = slot + 1
+			}
+		}
+
+		for _, team := range teams {
+			slot, found := assigned[team]
+			if !found {
+				slot = next
+				assigned[team] = slot
+				next++
+			}
+
+			var teamLocal = net.JoinHostPort(localHost, strconv.Itoa(basePort+slot))
+
+			err = add(teamLocal, net.JoinHostPort(team, port))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// applyForwards opens, updates and closes listeners to match the config
+func (c *Client) applyForwards(ns *NetworkSettings) error {
+
+	if c.Settings.Forwards == nil {
+		return nil
+	}
+
+	c.forwardsLock.Lock()
+	defer c.forwardsLock.Unlock()
+
+	if c.forwardsClosed {
+		return nil
+	}
+
+	if c.forwardSlots == nil {
+		c.forwardSlots = make(forwardSlots)
+	}
+
+	desired, err := expandForwards(*c.Settings.Forwards, ns, c.forwardSlots)
+	if err != nil {
+		return err
+	}
+
+	if c.forwards == nil {
+		c.forwards = make(map[string]*portForward)
+	}
+
+	// close forwards that are gone, retarget the remaining ones
+	for local, pf := range c.forwards {
+
+		target, found := desired[local]
+		if !found {
+			log.Infof("Closing forward %v", local)
+			_ = pf.listener.Close()
+			delete(c.forwards, local)
+			continue
+		}
+
+		if pf.Target() != target {
+			log.Infof("Forwarding %v -> %v", local, target)
+			pf.setTarget(target)
+		}
+	}
+
+	var firstErr error
+
+	// open new forwards
+	for local, target := range desired {
+
+		if _, found := c.forwards[local]; found {
+			continue
+		}
+
+		listener, err := net.Listen("tcp", local)
+		if err != nil {
+			log.Errorf("Failed to bind forward %v: %v", local, err)
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "binding forward %v", local)
+			}
+			continue
+		}
+
+		log.Infof("Forwarding %v -> %v", local, target)
+
+		pf := &portForward{
+			listener: listener,
+			target:   target,
+		}
+
+		c.forwards[local] = pf
+		go c.serveForward(pf)
+	}
+
+	return firstErr
+}
+
+// stopForwards closes all forward listeners, they are not opened again on network changes
+func (c *Client) stopForwards() {
+
+	c.forwardsLock.Lock()
+	defer c.forwardsLock.Unlock()
+
+	c.forwardsClosed = true
+
+	for local, pf := range c.forwards {
+		_ = pf.listener.Close()
+		delete(c.forwards, local)
+	}
+}
+
+func (c *Client) serveForward(pf *portForward) {
+
+	for {
+		conn, err := pf.listener.Accept()
+		if err != nil {
+			log.Debugf("Forward listener %v stopped: %v", pf.listener.Addr(), err)
+			return
+		}
+
+		go c.handleForward(pf.Target(), conn)
+	}
+}
+
+func (c *Client) handleForward(target string, conn net.Conn) {
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		log.Errorf("Bad forward target %v: %v", target, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ProxyRelayDialTimeout)
+	defer cancel()
+
+	_, ip, err := c.Resolve(ctx, host)
+	if err != nil {
+		log.Errorf("Could not resolve forward target %v: %v", target, err)
+		return
+	}
+
+	if ip != nil {
+		host = ip.String()
+	}
+
+	remote, err := c.Dial(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		log.Errorf("Forward to %v failed: %v", target, err)
+		return
+	}
+
+	err = connectstream.Connect(conn, remote)
+	if err != nil {
+		log.Debugf("Forward to %v closed with error: %v", target, err)
+	}
+}
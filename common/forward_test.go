@@ -0,0 +1,62 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandForwards(t *testing.T) {
+
+	var ns = &NetworkSettings{
+		Nodes: map[peer.ID]Member{
+			"a": {ID: "team2", Address: "10.0.0.2"},
+			"b": {ID: "team1", Address: "10.0.0.1"},
+			"c": {ID: "relay1", Address: "13.37.0.1", TrustedRelay: true},
+		},
+	}
+
+	var (
+		fs = ForwardSettings{
+			"127.0.0.1:15001": "team2:4041",
+			"127.0.0.1:16000": "*:4041",
+		}
+		slots = make(forwardSlots)
+	)
+
+	forwards, err := expandForwards(fs, ns, slots)
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		"127.0.0.1:15001": "team2:4041",
+		"127.0.0.1:16000": "team1:4041",
+		"127.0.0.1:16001": "team2:4041",
+	}, forwards)
+
+	// teams keep their ports when others join or leave
+	ns.Nodes["d"] = Member{ID: "team0", Address: "10.0.0.3"}
+	delete(ns.Nodes, "b")
+
+	forwards, err = expandForwards(fs, ns, slots)
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		"127.0.0.1:15001": "team2:4041",
+		"127.0.0.1:16001": "team2:4041",
+		"127.0.0.1:16002": "team0:4041",
+	}, forwards)
+
+	ns.Nodes["b"] = Member{ID: "team1", Address: "10.0.0.1"}
+
+	forwards, err = expandForwards(fs, ns, slots)
+	assert.NoError(t, err)
+	assert.Equal(t, "team1:4041", forwards["127.0.0.1:16000"])
+
+	// overlapping ranges are rejected
+	_, err = expandForwards(ForwardSettings{
+		"127.0.0.1:16001": "team1:80",
+		"127.0.0.1:16000": "*:4041",
+	}, ns, make(forwardSlots))
+	assert.Error(t, err)
+}
@@ -0,0 +1,259 @@
+package common
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/derlaft/connectstream"
+	"github.com/derlaft/pe2pectf/go-socks5"
+)
+
+// hopHeaders are meaningful only for a single connection and are not forwarded
+var hopHeaders = []string{ //nolint:gochecknoglobals
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// startHTTP serves a HTTP proxy (CONNECT tunnels and plain HTTP requests)
+func (l *proxyListener) startHTTP() error {
+
+	listener, err := net.Listen("tcp", l.settings.Listen)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:           l,
+		ReadHeaderTimeout: l.client.Settings.ProxyHandshakeTimeout,
+		IdleTimeout:       l.client.Settings.ProxyIdleTimeout,
+	}
+
+	// tunnels are hijacked and not waited for
+	l.shutdown = func(ctx context.Context) error {
+		_ = listener.Close()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			_ = server.Close()
+		}
+		return err
+	}
+
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("Proxy %v stopped: %v", l.name, err)
+		}
+	}()
+
+	return nil
+}
+
+// ServeHTTP implements http.Handler
+func (l *proxyListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	name, ok := l.authenticate(r)
+	if !ok {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="pe2pectf"`)
+		http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+
+	var target = r.Host
+	if r.Method != http.MethodConnect {
+
+		if r.URL.Scheme != "http" {
+			http.Error(w, "Only http:// URLs and CONNECT are supported", http.StatusBadRequest)
+			return
+		}
+
+		target = r.URL.Host
+		if r.URL.Port() == "" {
+			target = net.JoinHostPort(r.URL.Hostname(), "80")
+		}
+	}
+
+	ctx, req, err := l.newRequest(r.Context(), target, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if client, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		req.RemoteAddr = &socks5.AddrSpec{IP: client.IP, Port: client.Port}
+	}
+
+	ctx, ok = l.Allow(ctx, req)
+	if !ok {
+		http.Error(w, "Target is not allowed", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		l.serveTunnel(ctx, w, req)
+		return
+	}
+
+	l.serveForward(ctx, w, r, req)
+}
+
+// authenticate returns the user of the request if authentication is required
+func (l *proxyListener) authenticate(r *http.Request) (string, bool) {
+
+	if l.users == nil {
+		return "", true
+	}
+
+	name, password, ok := parseProxyAuth(r.Header.Get("Proxy-Authorization"))
+	if !ok || !l.users.Valid(name, password) {
+		return "", false
+	}
+
+	return name, true
+}
+
+// parseProxyAuth decodes basic credentials from the Proxy-Authorization header
+func parseProxyAuth(header string) (string, string, bool) {
+
+	const prefix = "Basic "
+	if !strings.HasPrefix(header, prefix) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+// dialErrorStatus returns the response status of a failed dial
+func dialErrorStatus(err error) int {
+
+	ee := exitErrorOf(err)
+	if ee == nil {
+		return http.StatusBadGateway
+	}
+
+	switch ee.status {
+	case exitDenied:
+		return http.StatusForbidden
+	case exitMaintenance, exitBusy:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// serveTunnel connects the client to the target after CONNECT
+func (l *proxyListener) serveTunnel(ctx context.Context, w http.ResponseWriter, req *socks5.Request) {
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Tunnels are not supported", http.StatusInternalServerError)
+		return
+	}
+
+	target, err := l.dial(ctx, "tcp", req.DestAddr.Address())
+	if err != nil {
+		log.Infof("Connect to %v failed (proxy %v): %v", req.DestAddr, l.name, err)
+		http.Error(w, "Connect failed", dialErrorStatus(err))
+		return
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		log.Errorf("Hijacking failed (proxy %v): %v", l.name, err)
+		target.Close()
+		return
+	}
+
+	_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	if err == nil && buf.Reader.Buffered() > 0 {
+		// data the client sent right after the request
+		_, err = io.CopyN(target, buf, int64(buf.Reader.Buffered()))
+	}
+	if err != nil {
+		log.Errorf("Starting tunnel to %v failed (proxy %v): %v", req.DestAddr, l.name, err)
+		target.Close()
+		conn.Close()
+		return
+	}
+
+	err = connectstream.Connect(target, conn)
+	if err != nil {
+		log.Debugf("Tunnel to %v closed (proxy %v): %v", req.DestAddr, l.name, err)
+	}
+}
+
+// serveForward sends a plain HTTP request to the target
+func (l *proxyListener) serveForward(ctx context.Context, w http.ResponseWriter, r *http.Request, req *socks5.Request) {
+
+	// connections are never reused, each request is dialed with the policy of its user
+	transport := &http.Transport{
+		DialContext:       l.dial,
+		DisableKeepAlives: true,
+	}
+
+	out := r.WithContext(ctx)
+	out.RequestURI = ""
+	out.Close = true
+
+	outURL := *r.URL
+	outURL.Host = req.DestAddr.Address()
+	out.URL = &outURL
+
+	out.Header = make(http.Header, len(r.Header))
+	for key, values := range r.Header {
+		out.Header[key] = append([]string(nil), values...)
+	}
+	removeHopHeaders(out.Header)
+
+	resp, err := transport.RoundTrip(out)
+	if err != nil {
+		log.Infof("Request to %v failed (proxy %v): %v", req.DestAddr, l.name, err)
+		http.Error(w, "Request failed", dialErrorStatus(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		log.Debugf("Response from %v interrupted (proxy %v): %v", req.DestAddr, l.name, err)
+	}
+}
+
+func removeHopHeaders(header http.Header) {
+
+	for _, key := range header["Connection"] {
+		for _, field := range strings.Split(key, ",") {
+			header.Del(strings.TrimSpace(field))
+		}
+	}
+
+	for _, key := range hopHeaders {
+		header.Del(key)
+	}
+}
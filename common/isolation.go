@@ -0,0 +1,95 @@
+package common
+
+import (
+	"context"
+	"sync"
+
+	core "github.com/libp2p/go-libp2p-core"
+)
+
+// relayIsolation keeps relays used by different isolation groups disjoint
+// (every circuit is separate anyway, relays are what could link the streams)
+type relayIsolation struct {
+	lock   sync.Mutex
+	claims map[core.PeerID]*relayClaim
+}
+
+// relayClaim marks a relay as used by open circuits of a group
+type relayClaim struct {
+	group    string
+	circuits int
+}
+
+// usable checks if the group may route through the relay; own is set for relays already claimed by the group
+func (ri *relayIsolation) usable(group string, relay core.PeerID) (ok, own bool) {
+
+	if group == "" {
+		return true, false
+	}
+
+	claim, found := ri.claims[relay]
+	if !found {
+		return true, false
+	}
+
+	return claim.group == group, claim.group == group
+}
+
+// claim marks relays of a new circuit as used by the group
+func (ri *relayIsolation) claim(group string, relays []CryptoHop) {
+
+	if group == "" {
+		return
+	}
+
+	if ri.claims == nil {
+		ri.claims = make(map[core.PeerID]*relayClaim)
+	}
+
+	for _, relay := range relays {
+
+		claim, found := ri.claims[relay.HostID]
+		if !found {
+			claim = &relayClaim{group: group}
+			ri.claims[relay.HostID] = claim
+		}
+
+		claim.circuits++
+	}
+}
+
+// release frees relays of a closed circuit
+func (ri *relayIsolation) release(group string, relays []CryptoHop) {
+
+	if group == "" {
+		return
+	}
+
+	ri.lock.Lock()
+	defer ri.lock.Unlock()
+
+	for _, relay := range relays {
+
+		claim, found := ri.claims[relay.HostID]
+		if !found || claim.group != group {
+			continue
+		}
+
+		claim.circuits--
+		if claim.circuits <= 0 {
+			delete(ri.claims, relay.HostID)
+		}
+	}
+}
+
+// WithIsolation makes connections dialed with the context use relays
+// not shared with any other isolation group
+func WithIsolation(ctx context.Context, group string) context.Context {
+	return context.WithValue(ctx, isolationKey, group)
+}
+
+// isolationFromContext returns the isolation group ("" - not isolated)
+func isolationFromContext(ctx context.Context) string {
+	group, _ := ctx.Value(isolationKey).(string)
+	return group
+}
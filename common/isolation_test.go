@@ -0,0 +1,48 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelayIsolation(t *testing.T) {
+
+	var (
+		ri   relayIsolation
+		path = []CryptoHop{{HostID: "relay1"}, {HostID: "relay2"}}
+	)
+
+	ri.claim("alice", path)
+	ri.claim("alice", path[:1])
+
+	for _, tc := range []struct {
+		group, relay string
+		ok, own      bool
+	}{
+		{"alice", "relay1", true, true},
+		{"alice", "relay3", true, false},
+		{"bob", "relay1", false, false},
+		{"bob", "relay3", true, false},
+		{"", "relay1", true, false},
+	} {
+		ok, own := ri.usable(tc.group, peer.ID(tc.relay))
+		assert.Equal(t, tc.ok, ok, "%v via %v", tc.group, tc.relay)
+		assert.Equal(t, tc.own, own, "%v via %v", tc.group, tc.relay)
+	}
+
+	// relay2 is free after the first circuit is closed, relay1 is still used by the second one
+	ri.release("alice", path)
+
+	ok, _ := ri.usable("bob", "relay2")
+	assert.True(t, ok)
+
+	ok, _ = ri.usable("bob", "relay1")
+	assert.False(t, ok)
+
+	ri.release("alice", path[:1])
+
+	ok, _ = ri.usable("bob", "relay1")
+	assert.True(t, ok)
+}
@@ -0,0 +1,324 @@
+package common
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/derlaft/connectstream"
+	"github.com/derlaft/pe2pectf/go-socks5"
+	core "github.com/libp2p/go-libp2p-core"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/pkg/errors"
+)
+
+const (
+	// LightClientProtocol is the service team nodes provide for light clients
+	LightClientProtocol = "/pe2pe/light/0.0.1"
+	// LightProxy is the name of the proxy listener serving light clients
+	LightProxy = "light"
+	// maximum length of a target in a light client request
+	lightMaxTarget = 255
+)
+
+// light client response codes
+const (
+	lightGranted byte = iota
+	lightRefused
+	lightFailed
+	lightMaintenance
+)
+
+// isLightClient reports whether connections are tunneled through a team node
+func (c *Client) isLightClient() bool {
+	return c.Settings.LightNode != ""
+}
+
+// ConnectLightNode connects a light client to its team node
+func (c *Client) ConnectLightNode(ctx context.Context) error {
+
+	addr, err := multiaddr.NewMultiaddr(c.Settings.LightNode)
+	if err != nil {
+		return errors.Wrapf(err, "parsing team node addr %v", c.Settings.LightNode)
+	}
+
+	info, err := peer.AddrInfoFromP2pAddr(addr)
+	if err != nil {
+		return errors.Wrapf(err, "parsing team node addr %v", c.Settings.LightNode)
+	}
+
+	// keep the addrs, so the team node is redialed after disconnects
+	c.Host.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.PermanentAddrTTL)
+	c.lightNode = info.ID
+
+	childContext, cancel := context.WithTimeout(ctx, ConnectTimeout)
+	defer cancel()
+
+	err = c.Host.Connect(childContext, *info)
+	if err != nil {
+		log.Warningf("Unable to connect to team node %v: %v", addr, err)
+	} else {
+		log.Infof("Connected to team node %v", addr)
+	}
+
+	return nil
+}
+
+// lightDial asks the team node to dial a game target
+func (c *Client) lightDial(ctx context.Context, proto, addr string) (net.Conn, error) {
+
+	if proto != "tcp" {
+		return nil, errors.Errorf("Protocol %v is not supported", proto)
+	}
+
+	if len(addr) > lightMaxTarget {
+		return nil, errors.Errorf("target %v is too long", addr)
+	}
+
+	stream, err := c.Host.NewStream(ctx, c.lightNode, LightClientProtocol)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open stream to team node %v", c.lightNode)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+
+	// the team node may dial for long, stop waiting once the caller gives up
+	var (
+		answered = make(chan struct{})
+		watched  = make(chan struct{})
+	)
+
+	go func() {
+		defer close(watched)
+
+		select {
+		case <-ctx.Done():
+			_ = stream.Reset()
+		case <-answered:
+		}
+	}()
+
+	var request = append([]byte{byte(len(addr))}, addr...)
+	_, err = stream.Write(request)
+
+	var resp [1]byte
+	if err == nil {
+		_, err = io.ReadFull(stream, resp[:])
+	}
+
+	close(answered)
+	<-watched
+
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		_ = stream.Reset()
+		return nil, errors.Wrap(err, "failed to get response of team node")
+	}
+
+	_ = stream.SetDeadline(time.Time{})
+
+	switch resp[0] {
+	case lightGranted:
+	case lightRefused:
+		_ = stream.Close()
+		return nil, errors.Errorf("connection to %v refused by team node", addr)
+	case lightMaintenance:
+		_ = stream.Close()
+		return nil, errors.Wrapf(ErrMaintenance, "connection to %v", addr)
+	default:
+		_ = stream.Close()
+		return nil, errors.Errorf("team node failed to connect to %v", addr)
+	}
+
+	insideEnd, returnEnd := net.Pipe()
+
+	go func() {
+		err := connectstream.Connect(stream, insideEnd)
+		if err != nil {
+			log.Debugf("Light client stream to %v closed: %v", addr, err)
+		}
+	}()
+
+	return returnEnd, nil
+}
+
+// checkLightUsers makes sure every light client is authenticated by its peer ID
+func checkLightUsers(users map[string]*ProxyUser) error {
+
+	for name, user := range users {
+		if user.PeerID == "" {
+			return errors.Errorf("light client %v has no peer ID", name)
+		}
+	}
+
+	return nil
+}
+
+// StartLightService lets light clients of the team tunnel through this node
+func (c *Client) StartLightService() error {
+
+	if _, found := c.proxies[LightProxy]; found {
+		return errors.Errorf("proxy %v is already used", LightProxy)
+	}
+
+	l := &proxyListener{
+		name: LightProxy,
+		settings: &ProxySettings{
+			Users:     c.Settings.LightUsersConfig,
+			Isolation: IsolateUser,
+			users:     c.Settings.LightUsers,
+		},
+		client: c,
+		users:  newProxyUsers(c.Settings.LightUsers),
+	}
+
+	l.shutdown = func(ctx context.Context) error {
+		c.Host.RemoveStreamHandler(LightClientProtocol)
+		return nil
+	}
+
+	if c.proxies == nil {
+		c.proxies = make(map[string]*proxyListener)
+	}
+	c.proxies[LightProxy] = l
+
+	c.Host.SetStreamHandler(LightClientProtocol, l.serveLight)
+
+	log.Infof("Serving light clients")
+
+	return nil
+}
+
+// serveLight handles a single stream of a light client
+func (l *proxyListener) serveLight(s network.Stream) {
+
+	var remote = s.Conn().RemotePeer()
+
+	name, found := l.users.lightClient(remote)
+	if !found {
+		log.Infof("Refused light client %v: unknown peer", remote)
+		_ = s.Reset()
+		return
+	}
+
+	status, err := l.serveLightStream(name, s)
+	if err != nil {
+		log.Infof("Light client %v (%v): %v", name, remote, err)
+	}
+
+	if status != lightGranted {
+		_, _ = s.Write([]byte{status})
+		_ = s.Close()
+	}
+}
+
+// serveLightStream connects the stream to the requested target, the returned status
+// is sent to the client if the connection was not established
+func (l *proxyListener) serveLightStream(name string, s network.Stream) (byte, error) {
+
+	if timeout := l.client.Settings.ProxyHandshakeTimeout; timeout > 0 {
+		_ = s.SetReadDeadline(time.Now().Add(timeout))
+	}
+
+	var length [1]byte
+	_, err := io.ReadFull(s, length[:])
+	if err != nil {
+		return lightFailed, errors.Wrap(err, "reading request")
+	}
+
+	var target = make([]byte, length[0])
+	_, err = io.ReadFull(s, target)
+	if err != nil {
+		return lightFailed, errors.Wrap(err, "reading request")
+	}
+
+	_ = s.SetReadDeadline(time.Time{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctx, req, err := l.newRequest(ctx, string(target), name)
+	if err != nil {
+		return lightRefused, err
+	}
+
+	req.RemoteAddr = addrSpecFromMultiaddr(s.Conn().RemoteMultiaddr())
+
+	ctx, ok := l.Allow(ctx, req)
+	if !ok {
+		return lightRefused, errors.Errorf("connect to %v blocked by rules", req.DestAddr)
+	}
+
+	conn, err := l.dial(ctx, "tcp", req.DestAddr.Address())
+	if errors.Cause(err) == ErrMaintenance {
+		return lightMaintenance, errors.Wrapf(err, "connect to %v failed", req.DestAddr)
+	}
+	if errors.Cause(err) == ErrAccessDenied {
+		return lightRefused, errors.Wrapf(err, "connect to %v failed", req.DestAddr)
+	}
+	if err != nil {
+		return lightFailed, errors.Wrapf(err, "connect to %v failed", req.DestAddr)
+	}
+
+	_, err = s.Write([]byte{lightGranted})
+	if err != nil {
+		_ = conn.Close()
+		return lightGranted, errors.Wrap(err, "sending response")
+	}
+
+	err = connectstream.Connect(conn, s)
+	if err != nil {
+		log.Debugf("Light client stream to %v closed: %v", req.DestAddr, err)
+	}
+
+	return lightGranted, nil
+}
+
+// addrSpecFromMultiaddr returns the IP and TCP port of a multiaddr (nil if it has none)
+func addrSpecFromMultiaddr(addr multiaddr.Multiaddr) *socks5.AddrSpec {
+
+	ip, err := addr.ValueForProtocol(multiaddr.P_IP4)
+	if err != nil {
+		ip, err = addr.ValueForProtocol(multiaddr.P_IP6)
+	}
+	if err != nil {
+		return nil
+	}
+
+	port, err := addr.ValueForProtocol(multiaddr.P_TCP)
+	if err != nil {
+		return nil
+	}
+
+	portValue, err := strconv.Atoi(port)
+	if err != nil {
+		return nil
+	}
+
+	return &socks5.AddrSpec{IP: net.ParseIP(ip), Port: portValue}
+}
+
+// lightClient returns the name of the user with the peer ID
+func (pu *proxyUsers) lightClient(id core.PeerID) (string, bool) {
+
+	pu.lock.RLock()
+	defer pu.lock.RUnlock()
+
+	for name, user := range pu.users {
+		if user.PeerID != "" && user.PeerID == id.Pretty() {
+			return name, true
+		}
+	}
+
+	return "", false
+}
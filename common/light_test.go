@@ -0,0 +1,96 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLightClients(t *testing.T) {
+
+	const laptop = "QmSwAg7JidksX1mZHPpMv9yVVCUAkU9ajtCUtHX47SZf33"
+
+	fname := writeTemp(t, `{
+		"laptop": {"PeerID": "`+laptop+`", "Allow": ["team3:4041"]},
+		"player": {"Password": "secret"}
+	}`)
+	defer os.Remove(fname)
+
+	users, err := LoadProxyUsers(fname)
+	assert.NoError(t, err)
+
+	var pu = newProxyUsers(users)
+
+	id, err := peer.IDB58Decode(laptop)
+	assert.NoError(t, err)
+
+	name, found := pu.lightClient(id)
+	assert.True(t, found)
+	assert.Equal(t, "laptop", name)
+
+	id, err = peer.IDB58Decode("QmZeFykRKmid2bhKXrZGDourB1wAv2seBogABN1Vjv11er")
+	assert.NoError(t, err)
+
+	_, found = pu.lightClient(id)
+	assert.False(t, found)
+
+	// bad peer ID
+	bad := writeTemp(t, `{"laptop": {"PeerID": "team1"}}`)
+	defer os.Remove(bad)
+
+	_, err = LoadProxyUsers(bad)
+	assert.Error(t, err)
+
+	// reloaded light clients still need a peer ID
+	c := &Client{proxies: map[string]*proxyListener{
+		LightProxy: {settings: &ProxySettings{Users: fname}, users: pu},
+	}}
+	assert.Error(t, c.ReloadProxyUsers())
+
+	assert.NoError(t, ioutil.WriteFile(fname, []byte(`{"laptop": {"PeerID": "`+laptop+`"}}`), 0600))
+	assert.NoError(t, c.ReloadProxyUsers())
+}
+
+func TestLightClientProxies(t *testing.T) {
+
+	users := writeTemp(t, `{"player": {"Password": "secret", "Allow": ["team2:*"]}}`)
+	defer os.Remove(users)
+
+	var load = func(proxies string) error {
+
+		fname := writeTemp(t, proxies)
+		defer os.Remove(fname)
+
+		var s = &Settings{
+			LightNode:   "/ip4/127.0.0.1/tcp/4501/p2p/QmZeFykRKmid2bhKXrZGDourB1wAv2seBogABN1Vjv11er",
+			Crypto:      &CryptoSettings{},
+			ProxyConfig: fname,
+		}
+		return s.Load()
+	}
+
+	assert.NoError(t, load(`{"fast": {"Listen": "127.0.0.1:9051"}}`))
+
+	// light clients do not know the members, targets are checked by the team node only
+	assert.Error(t, load(`{"fast": {"Listen": "127.0.0.1:9051", "Allow": ["team2:*"]}}`))
+	assert.Error(t, load(`{"fast": {"Listen": "127.0.0.1:9051", "Users": "`+users+`"}}`))
+}
+
+func TestAddrSpecFromMultiaddr(t *testing.T) {
+
+	addr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/4501")
+	assert.NoError(t, err)
+
+	spec := addrSpecFromMultiaddr(addr)
+	if assert.NotNil(t, spec) {
+		assert.Equal(t, "127.0.0.1:4501", spec.Address())
+	}
+
+	addr, err = multiaddr.NewMultiaddr("/ip4/127.0.0.1/udp/4501/quic")
+	assert.NoError(t, err)
+	assert.Nil(t, addrSpecFromMultiaddr(addr))
+}
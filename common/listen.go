@@ -0,0 +1,185 @@
+package common
+
+import (
+	"net"
+	"strconv"
+	"sync"
+
+	core "github.com/libp2p/go-libp2p-core"
+	"github.com/pkg/errors"
+)
+
+// listenBacklog is the amount of connections waiting for Accept before new ones are refused
+const listenBacklog = 128
+
+// OverlayAddr is an address in the game network
+type OverlayAddr struct {
+	Host string // game address or stream ID
+	Port int
+}
+
+// Network implements net.Addr
+func (a OverlayAddr) Network() string {
+	return "pe2pe"
+}
+
+func (a OverlayAddr) String() string {
+	return net.JoinHostPort(a.Host, strconv.Itoa(a.Port))
+}
+
+// overlayConn is an accepted connection with overlay addresses
+type overlayConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (oc *overlayConn) LocalAddr() net.Addr {
+	return oc.local
+}
+
+func (oc *overlayConn) RemoteAddr() net.Addr {
+	return oc.remote
+}
+
+// overlayListener accepts onion streams of a virtual port
+type overlayListener struct {
+	client *Client
+	addr   OverlayAddr
+	conns  chan net.Conn
+
+	lock     sync.Mutex
+	isClosed bool
+	closed   chan struct{}
+}
+
+// Listen serves a virtual port of this node in the game network.
+// Accepted connections are decrypted onion streams, no local socket is used.
+func (c *Client) Listen(port int) (net.Listener, error) {
+
+	if port <= 0 || port > 0xffff {
+		return nil, errors.Errorf("invalid port %v", port)
+	}
+
+	if c.exitNode().IsPortAllowed(port) {
+		return nil, errors.Errorf("port %v is mapped in the exit node config", port)
+	}
+
+	c.listenersLock.Lock()
+	defer c.listenersLock.Unlock()
+
+	if _, found := c.listeners[port]; found {
+		return nil, errors.Errorf("port %v is already used", port)
+	}
+
+	ol := &overlayListener{
+		client: c,
+		addr:   c.overlayAddr(c.Host.ID(), nil, port),
+		conns:  make(chan net.Conn, listenBacklog),
+		closed: make(chan struct{}),
+	}
+
+	if c.listeners == nil {
+		c.listeners = make(map[int]*overlayListener)
+	}
+	c.listeners[port] = ol
+
+	log.Infof("Listening on virtual port %v", port)
+
+	return ol, nil
+}
+
+// overlayAddr returns the game address of a member: the requested IP,
+// the primary address or the "<peer ID>.pe2pe" name
+func (c *Client) overlayAddr(id core.PeerID, ip net.IP, port int) OverlayAddr {
+
+	if ip != nil {
+		return OverlayAddr{Host: ip.String(), Port: port}
+	}
+
+	if member, found := c.Network().Nodes[id]; found && member.Address != "" {
+		return OverlayAddr{Host: member.Address, Port: port}
+	}
+
+	return OverlayAddr{Host: id.Pretty() + PeerDomain, Port: port}
+}
+
+// overlayListener returns the listener of a virtual port
+func (c *Client) overlayListener(port int) (*overlayListener, bool) {
+
+	c.listenersLock.Lock()
+	defer c.listenersLock.Unlock()
+
+	ol, found := c.listeners[port]
+	return ol, found
+}
+
+// connect queues a new connection from remote and returns its other end
+func (ol *overlayListener) connect(remote string) (net.Conn, error) {
+
+	insideEnd, returnEnd := net.Pipe()
+
+	var conn = &overlayConn{
+		Conn:   returnEnd,
+		local:  ol.addr,
+		remote: OverlayAddr{Host: remote},
+	}
+
+	ol.lock.Lock()
+	defer ol.lock.Unlock()
+
+	if ol.isClosed {
+		return nil, errors.Errorf("port %v is closed", ol.addr.Port)
+	}
+
+	select {
+	case ol.conns <- conn:
+		return insideEnd, nil
+	default:
+		return nil, errors.Errorf("backlog of port %v is full", ol.addr.Port)
+	}
+}
+
+// Accept implements net.Listener
+func (ol *overlayListener) Accept() (net.Conn, error) {
+
+	select {
+	case conn := <-ol.conns:
+		return conn, nil
+	case <-ol.closed:
+		return nil, errors.Errorf("port %v is closed", ol.addr.Port)
+	}
+}
+
+// Close implements net.Listener, queued connections are closed
+func (ol *overlayListener) Close() error {
+
+	ol.lock.Lock()
+	defer ol.lock.Unlock()
+
+	if ol.isClosed {
+		return nil
+	}
+
+	var c = ol.client
+
+	c.listenersLock.Lock()
+	delete(c.listeners, ol.addr.Port)
+	c.listenersLock.Unlock()
+
+	ol.isClosed = true
+	close(ol.closed)
+
+	for {
+		select {
+		case conn := <-ol.conns:
+			_ = conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Addr implements net.Listener
+func (ol *overlayListener) Addr() net.Addr {
+	return ol.addr
+}
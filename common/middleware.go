@@ -0,0 +1,221 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+
+	"github.com/derlaft/connectstream"
+	"github.com/pkg/errors"
+)
+
+// errors returned by stream filters
+var (
+	ErrDropStream  = errors.New("stream dropped by middleware") // closes both sides
+	ErrResetStream = errors.New("stream reset by middleware")   // resets the onion stream
+)
+
+// StreamMeta describes a stream to a service
+type StreamMeta struct {
+	ID      string
+	Service string // mapping of the service
+	Port    int
+	Backend string // set once the service is dialed, after Middleware.Stream
+	// synthetic source address of the circuit (the same for streams of one isolation group)
+	Circuit net.IP
+}
+
+// Middleware filters the streams of a service, it is created once per mapping
+// (again on every reload of the exit node config)
+type Middleware interface {
+	// Stream returns the filter of a new stream, errors refuse the stream before the
+	// service is dialed. It may block until ctx is done to delay the stream.
+	Stream(ctx context.Context, meta *StreamMeta) (StreamFilter, error)
+}
+
+// StreamFilter inspects and changes the data of a stream. The returned data is passed on
+// (empty - nothing yet), ErrDropStream closes the stream after it, ErrResetStream resets it.
+// Request and Response are called concurrently and may block to delay their direction.
+type StreamFilter interface {
+	// data sent to the service
+	Request(data []byte) ([]byte, error)
+	// data sent to the client
+	Response(data []byte) ([]byte, error)
+}
+
+// MiddlewareFactory creates a middleware from its options in the exit node config
+type MiddlewareFactory func(options json.RawMessage) (Middleware, error)
+
+// MiddlewareConfig is a middleware of a service in the exit node config
+type MiddlewareConfig struct {
+	// name of a registered middleware
+	Type    string
+	Options json.RawMessage
+	// used instead of the registered type by embedders
+	Middleware Middleware `json:"-"`
+}
+
+var (
+	middlewareLock      sync.RWMutex                    //nolint:gochecknoglobals
+	middlewareFactories = map[string]MiddlewareFactory{ //nolint:gochecknoglobals
+		"blocklist": newBlocklistMiddleware,
+		"ratelimit": newRateLimitMiddleware,
+		"maxsize":   newMaxSizeMiddleware,
+	}
+)
+
+// RegisterMiddleware makes a middleware type available to exit node configs,
+// types registered later replace the earlier ones
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+
+	middlewareLock.Lock()
+	defer middlewareLock.Unlock()
+
+	middlewareFactories[name] = factory
+}
+
+// build creates the middleware of the config
+func (mc *MiddlewareConfig) build() (Middleware, error) {
+
+	if mc.Middleware != nil {
+		return mc.Middleware, nil
+	}
+
+	middlewareLock.RLock()
+	factory, found := middlewareFactories[mc.Type]
+	middlewareLock.RUnlock()
+
+	if !found {
+		return nil, errors.Errorf("unknown middleware type %q", mc.Type)
+	}
+
+	middleware, err := factory(mc.Options)
+	if err != nil {
+		return nil, errors.Wrapf(err, "middleware %v", mc.Type)
+	}
+
+	return middleware, nil
+}
+
+// admitExit asks the middlewares of a service about a new stream before the service
+// is dialed, streams refused by them are reported as ErrAccessDenied unless they
+// return an ExitError
+func admitExit(ctx context.Context, middlewares []Middleware, meta *StreamMeta) ([]StreamFilter, error) {
+
+	var filters []StreamFilter
+
+	for i := len(middlewares) - 1; i >= 0; i-- {
+
+		filter, err := middlewares[i].Stream(ctx, meta)
+		if err != nil {
+			if _, ok := errors.Cause(err).(*ExitError); !ok {
+				err = errors.Wrapf(ErrAccessDenied, "%v", err)
+			}
+			return nil, err
+		}
+
+		// nil filters let the stream through unchanged
+		if filter != nil {
+			filters = append(filters, filter)
+		}
+	}
+
+	return filters, nil
+}
+
+// wrapExit passes a connection to the service through the admitted filters
+// (the one of the first middleware sees the data of the client first)
+func wrapExit(conn net.Conn, filters []StreamFilter) net.Conn {
+
+	for _, filter := range filters {
+		conn = &filteredConn{Conn: conn, filter: filter}
+	}
+
+	return conn
+}
+
+// middlewareResult returns the result of a stream stopped by a filter:
+// nil for dropped streams (closed gracefully), ErrResetStream for reset ones
+func middlewareResult(err error) error {
+
+	ce, ok := err.(*connectstream.ConnectError)
+	if !ok {
+		return err
+	}
+
+	var dropped bool
+	for _, copyErr := range []error{ce.CopyA, ce.CopyB} {
+		switch errors.Cause(copyErr) {
+		case ErrResetStream:
+			return ErrResetStream
+		case ErrDropStream:
+			dropped = true
+		}
+	}
+
+	if dropped {
+		return nil
+	}
+
+	return err
+}
+
+// filteredConn passes the data of a service connection through a filter
+type filteredConn struct {
+	net.Conn
+	filter StreamFilter
+
+	pending []byte // filtered response data not read yet
+	readErr error
+	buf     []byte
+}
+
+func (fc *filteredConn) Read(b []byte) (int, error) {
+
+	for len(fc.pending) == 0 {
+		if fc.readErr != nil {
+			return 0, fc.readErr
+		}
+
+		if len(fc.buf) < len(b) {
+			fc.buf = make([]byte, len(b))
+		}
+
+		n, err := fc.Conn.Read(fc.buf[:len(b)])
+		fc.readErr = err
+
+		if n > 0 {
+			data, err := fc.filter.Response(fc.buf[:n])
+			if err != nil {
+				fc.readErr = err
+			}
+			if err != ErrResetStream {
+				fc.pending = append(fc.pending[:0], data...)
+			}
+		}
+	}
+
+	n := copy(b, fc.pending)
+	fc.pending = fc.pending[n:]
+
+	return n, nil
+}
+
+func (fc *filteredConn) Write(b []byte) (int, error) {
+
+	data, filterErr := fc.filter.Request(b)
+
+	if len(data) > 0 && filterErr != ErrResetStream {
+		_, err := fc.Conn.Write(data)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if filterErr != nil {
+		return 0, filterErr
+	}
+
+	return len(b), nil
+}
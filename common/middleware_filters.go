@@ -0,0 +1,359 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// what built-in middlewares do with offending streams
+const (
+	MiddlewareDrop  = "drop"  // close the stream (default)
+	MiddlewareReset = "reset" // reset the onion stream
+)
+
+const (
+	blocklistOverlap     = 1024 // data kept between reads (patterns split across them)
+	rateLimitMaxCircuits = 4096 // idle buckets are pruned above this amount
+)
+
+// middlewareAction returns the error of an action
+func middlewareAction(action string) (error, error) {
+
+	switch action {
+	case "", MiddlewareDrop:
+		return ErrDropStream, nil
+	case MiddlewareReset:
+		return ErrResetStream, nil
+	default:
+		return nil, errors.Errorf("unknown action %v", action)
+	}
+}
+
+// decodeOptions decodes the options of a middleware, unknown fields are errors
+func decodeOptions(options json.RawMessage, dest interface{}) error {
+
+	if len(options) == 0 {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(options))
+	decoder.DisallowUnknownFields()
+
+	return errors.Wrap(decoder.Decode(dest), "decoding options")
+}
+
+// blocklistMiddleware stops streams with data matching any of the patterns:
+// {"Patterns": ["\\.\\./", "(?i)union\\s+select"], "Responses": false, "Action": "drop"}
+type blocklistMiddleware struct {
+	pattern   *regexp.Regexp
+	responses bool
+	action    error
+}
+
+type blocklistOptions struct {
+	Patterns []string
+	// responses are checked too
+	Responses bool
+	Action    string
+}
+
+func newBlocklistMiddleware(options json.RawMessage) (Middleware, error) {
+
+	var opts blocklistOptions
+
+	err := decodeOptions(options, &opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(opts.Patterns) == 0 {
+		return nil, errors.New("no patterns")
+	}
+
+	var alternatives = make([]string, 0, len(opts.Patterns))
+	for _, pattern := range opts.Patterns {
+		_, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing pattern %v", pattern)
+		}
+		alternatives = append(alternatives, "(?:"+pattern+")")
+	}
+
+	action, err := middlewareAction(opts.Action)
+	if err != nil {
+		return nil, err
+	}
+
+	return &blocklistMiddleware{
+		pattern:   regexp.MustCompile(strings.Join(alternatives, "|")),
+		responses: opts.Responses,
+		action:    action,
+	}, nil
+}
+
+func (bm *blocklistMiddleware) Stream(_ context.Context, meta *StreamMeta) (StreamFilter, error) {
+	return &blocklistFilter{middleware: bm, meta: meta}, nil
+}
+
+type blocklistFilter struct {
+	middleware *blocklistMiddleware
+	meta       *StreamMeta
+	tails      [2][]byte // the end of the data so far: requests, responses
+}
+
+func (bf *blocklistFilter) Request(data []byte) ([]byte, error) {
+	return bf.check(0, data)
+}
+
+func (bf *blocklistFilter) Response(data []byte) ([]byte, error) {
+
+	if !bf.middleware.responses {
+		return data, nil
+	}
+
+	return bf.check(1, data)
+}
+
+// check looks for the patterns in the data of a direction
+func (bf *blocklistFilter) check(dir int, data []byte) ([]byte, error) {
+
+	var buf = append(bf.tails[dir], data...)
+
+	if loc := bf.middleware.pattern.FindIndex(buf); loc != nil {
+		log.Infof("Blocked stream %v of %v: %q", bf.meta.ID, bf.meta.Service, buf[loc[0]:loc[1]])
+		return nil, bf.middleware.action
+	}
+
+	if len(buf) > blocklistOverlap {
+		buf = buf[len(buf)-blocklistOverlap:]
+	}
+	bf.tails[dir] = append(bf.tails[dir][:0], buf...)
+
+	return data, nil
+}
+
+// rateLimitMiddleware limits the rate of new streams of every circuit and of all of them:
+// {"Rate": 2, "Burst": 10, "Total": 50, "MaxDelay": "5s"} - streams over the rate wait up to MaxDelay
+// for their turn and are refused with ErrServiceBusy after that (the state is kept
+// until the exit node config is reloaded). Circuits are chosen by the clients (streams
+// that are not isolated get a new one each), so only Total bounds a flood of the service.
+type rateLimitMiddleware struct {
+	rate     float64 // streams per second of a circuit
+	burst    float64
+	total    float64 // streams per second of all circuits (0 - unlimited)
+	maxDelay time.Duration
+
+	lock    sync.Mutex
+	buckets map[string]*rateBucket
+	all     rateBucket
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last use
+func (rb *rateBucket) refill(now time.Time, rate, burst float64) {
+
+	rb.tokens += now.Sub(rb.last).Seconds() * rate
+	if rb.tokens > burst {
+		rb.tokens = burst
+	}
+	rb.last = now
+}
+
+// wait returns how long the next token takes
+func (rb *rateBucket) wait(rate float64) time.Duration {
+
+	if rb.tokens >= 1 {
+		return 0
+	}
+
+	return time.Duration((1 - rb.tokens) / rate * float64(time.Second))
+}
+
+type rateLimitOptions struct {
+	Rate     float64
+	Burst    int
+	Total    float64 // burst of the same size
+	MaxDelay string
+}
+
+func newRateLimitMiddleware(options json.RawMessage) (Middleware, error) {
+
+	var opts rateLimitOptions
+
+	err := decodeOptions(options, &opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Rate <= 0 || opts.Burst < 0 || opts.Total < 0 {
+		return nil, errors.New("rate must be positive")
+	}
+
+	var rm = &rateLimitMiddleware{
+		rate:    opts.Rate,
+		burst:   float64(opts.Burst),
+		total:   opts.Total,
+		buckets: make(map[string]*rateBucket),
+	}
+
+	if rm.burst < 1 {
+		rm.burst = 1
+	}
+
+	if opts.MaxDelay != "" {
+		rm.maxDelay, err = time.ParseDuration(opts.MaxDelay)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing max delay %v", opts.MaxDelay)
+		}
+	}
+
+	return rm, nil
+}
+
+func (rm *rateLimitMiddleware) Stream(ctx context.Context, meta *StreamMeta) (StreamFilter, error) {
+
+	delay := rm.reserve(meta.Circuit.String(), time.Now())
+	if delay == 0 {
+		return nil, nil
+	}
+
+	if delay > rm.maxDelay {
+		log.Infof("Rate limited stream %v of %v (circuit %v)", meta.ID, meta.Service, meta.Circuit)
+		return nil, errors.Wrap(ErrServiceBusy, "rate limited")
+	}
+
+	var timer = time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// reserve takes a token of the circuit (and of all circuits) and returns how long to wait for it,
+// tokens are not taken if the wait is longer than the maximum delay
+func (rm *rateLimitMiddleware) reserve(circuit string, now time.Time) time.Duration {
+
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+
+	bucket, found := rm.buckets[circuit]
+	if !found {
+		if len(rm.buckets) >= rateLimitMaxCircuits {
+			rm.prune(now)
+		}
+
+		bucket = &rateBucket{tokens: rm.burst, last: now}
+		rm.buckets[circuit] = bucket
+	}
+
+	bucket.refill(now, rm.rate, rm.burst)
+	delay := bucket.wait(rm.rate)
+
+	if rm.total > 0 {
+		rm.all.refill(now, rm.total, math.Max(rm.total, 1))
+		if totalDelay := rm.all.wait(rm.total); totalDelay > delay {
+			delay = totalDelay
+		}
+	}
+
+	if delay <= rm.maxDelay {
+		bucket.tokens--
+		if rm.total > 0 {
+			rm.all.tokens--
+		}
+	}
+
+	return delay
+}
+
+// prune removes buckets that are full again (the lock is held)
+func (rm *rateLimitMiddleware) prune(now time.Time) {
+	for circuit, bucket := range rm.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*rm.rate >= rm.burst {
+			delete(rm.buckets, circuit)
+		}
+	}
+}
+
+// maxSizeMiddleware stops streams sending more data than allowed:
+// {"Request": 65536, "Response": 1048576, "Action": "reset"} (0 - unlimited)
+type maxSizeMiddleware struct {
+	limits [2]int64
+	action error
+}
+
+type maxSizeOptions struct {
+	Request  int64
+	Response int64
+	Action   string
+}
+
+func newMaxSizeMiddleware(options json.RawMessage) (Middleware, error) {
+
+	var opts maxSizeOptions
+
+	err := decodeOptions(options, &opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Request < 0 || opts.Response < 0 {
+		return nil, errors.New("negative limits")
+	}
+
+	action, err := middlewareAction(opts.Action)
+	if err != nil {
+		return nil, err
+	}
+
+	return &maxSizeMiddleware{
+		limits: [2]int64{opts.Request, opts.Response},
+		action: action,
+	}, nil
+}
+
+func (mm *maxSizeMiddleware) Stream(_ context.Context, meta *StreamMeta) (StreamFilter, error) {
+	return &maxSizeFilter{middleware: mm, meta: meta}, nil
+}
+
+type maxSizeFilter struct {
+	middleware *maxSizeMiddleware
+	meta       *StreamMeta
+	sizes      [2]int64
+}
+
+func (mf *maxSizeFilter) Request(data []byte) ([]byte, error) {
+	return mf.count(0, data)
+}
+
+func (mf *maxSizeFilter) Response(data []byte) ([]byte, error) {
+	return mf.count(1, data)
+}
+
+func (mf *maxSizeFilter) count(dir int, data []byte) ([]byte, error) {
+
+	mf.sizes[dir] += int64(len(data))
+
+	if limit := mf.middleware.limits[dir]; limit > 0 && mf.sizes[dir] > limit {
+		log.Infof("Stream %v of %v is over the size limit (%v bytes)", mf.meta.ID, mf.meta.Service, limit)
+		return nil, mf.middleware.action
+	}
+
+	return data, nil
+}
@@ -0,0 +1,198 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/derlaft/connectstream"
+	"github.com/stretchr/testify/assert"
+)
+
+// upperMiddleware is a team-written filter changing the data
+type upperMiddleware struct{}
+
+func (upperMiddleware) Stream(context.Context, *StreamMeta) (StreamFilter, error) {
+	return upperMiddleware{}, nil
+}
+
+func (upperMiddleware) Request(data []byte) ([]byte, error) {
+	return []byte(string(data) + "!"), nil
+}
+
+func (upperMiddleware) Response(data []byte) ([]byte, error) {
+	var out = make([]byte, 0, len(data))
+	for _, b := range data {
+		if b >= 'a' && b <= 'z' {
+			b -= 'a' - 'A'
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+func TestMiddlewareConfig(t *testing.T) {
+
+	RegisterMiddleware("upper", func(json.RawMessage) (Middleware, error) {
+		return upperMiddleware{}, nil
+	})
+
+	var en ExitNodeSettings
+	err := json.Unmarshal([]byte(`{
+		"4041": {
+			"Backends": ["127.0.0.1:8080"],
+			"Middleware": [
+				{"Type": "blocklist", "Options": {"Patterns": ["\\.\\./"], "Action": "reset"}},
+				{"Type": "ratelimit", "Options": {"Rate": 1, "Burst": 5, "MaxDelay": "1s"}},
+				{"Type": "maxsize", "Options": {"Request": 1024}},
+				{"Type": "upper"}
+			]
+		}
+	}`), &en)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	if !assert.NoError(t, en.validate()) {
+		t.FailNow()
+	}
+	assert.Len(t, en["4041"].middleware, 4)
+
+	for _, config := range []string{
+		`{"Type": "nope"}`,
+		`{"Type": "blocklist"}`,
+		`{"Type": "blocklist", "Options": {"Patterns": ["("]}}`,
+		`{"Type": "blocklist", "Options": {"Patterns": ["a"], "Action": "explode"}}`,
+		`{"Type": "ratelimit", "Options": {"Rate": 0}}`,
+		`{"Type": "maxsize", "Options": {"Request": 10, "Typo": 1}}`,
+	} {
+		var en ExitNodeSettings
+		assert.NoError(t, json.Unmarshal([]byte(`{"80": {"Backends": ["127.0.0.1:80"], "Middleware": [`+config+`]}}`), &en))
+		assert.Error(t, en.validate(), config)
+	}
+}
+
+// connectFiltered bridges a client pipe to a service pipe through the middlewares
+func connectFiltered(t *testing.T, middlewares ...Middleware) (client, service net.Conn, result chan error) {
+
+	clientSide, client := net.Pipe()
+	service, serviceSide := net.Pipe()
+
+	filters, err := admitExit(context.Background(), middlewares, &StreamMeta{ID: "test", Circuit: net.IPv6loopback})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	var conn = wrapExit(serviceSide, filters)
+
+	result = make(chan error, 1)
+	go func() {
+		result <- middlewareResult(connectstream.Connect(clientSide, conn))
+	}()
+
+	return client, service, result
+}
+
+func TestMiddlewareFilters(t *testing.T) {
+
+	blocklist, err := newBlocklistMiddleware(json.RawMessage(`{"Patterns": ["\\.\\./"]}`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	client, service, result := connectFiltered(t, blocklist, upperMiddleware{})
+
+	// data is changed in both directions
+	go func() {
+		_, _ = client.Write([]byte("get"))
+	}()
+	var buf = make([]byte, 16)
+	n, _ := io.ReadAtLeast(service, buf, 4)
+	assert.Equal(t, "get!", string(buf[:n]))
+
+	go func() {
+		_, _ = service.Write([]byte("flag"))
+	}()
+	n, _ = io.ReadAtLeast(client, buf, 4)
+	assert.Equal(t, "FLAG", string(buf[:n]))
+
+	// blocked data split between writes does not reach the service and closes the stream
+	go func() {
+		_, _ = client.Write([]byte("/."))
+		_, _ = client.Write([]byte("./etc/passwd"))
+	}()
+	n, _ = io.ReadAtLeast(service, buf, 3)
+	assert.Equal(t, "/.!", string(buf[:n]))
+
+	_, err = service.Read(buf)
+	assert.Equal(t, io.EOF, err)
+	assert.NoError(t, <-result)
+
+	// oversized responses reset the stream
+	maxsize, err := newMaxSizeMiddleware(json.RawMessage(`{"Response": 4, "Action": "reset"}`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	client, service, result = connectFiltered(t, maxsize)
+	go func() {
+		_, _ = service.Write([]byte("1234"))
+		_, _ = service.Write([]byte("5"))
+	}()
+	n, _ = io.ReadAtLeast(client, buf, 4)
+	assert.Equal(t, "1234", string(buf[:n]))
+	_, err = client.Read(buf)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, ErrResetStream, <-result)
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+
+	middleware, err := newRateLimitMiddleware(json.RawMessage(`{"Rate": 2, "Burst": 2, "MaxDelay": "600ms"}`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	rm := middleware.(*rateLimitMiddleware)
+
+	var now = time.Now()
+
+	assert.Equal(t, time.Duration(0), rm.reserve("a", now))
+	assert.Equal(t, time.Duration(0), rm.reserve("a", now))
+	assert.Equal(t, 500*time.Millisecond, rm.reserve("a", now))
+	// refused streams do not take tokens
+	assert.Equal(t, time.Second, rm.reserve("a", now))
+	assert.Equal(t, time.Duration(0), rm.reserve("a", now.Add(time.Second)))
+
+	// circuits have their own limits
+	assert.Equal(t, time.Duration(0), rm.reserve("b", now))
+
+	// refused streams are reported as busy
+	var meta = StreamMeta{Circuit: net.ParseIP("fd70::1")}
+	for i := 0; i < 2; i++ {
+		_, err = rm.Stream(context.Background(), &meta)
+		assert.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = rm.Stream(ctx, &meta)
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = admitExit(context.Background(), []Middleware{rm}, &meta)
+	assert.Equal(t, exitBusy, exitStatus(err))
+
+	// new circuits do not get around the total rate
+	middleware, err = newRateLimitMiddleware(json.RawMessage(`{"Rate": 2, "Burst": 2, "Total": 3}`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	rm = middleware.(*rateLimitMiddleware)
+
+	for _, circuit := range []string{"a", "b", "c"} {
+		assert.Equal(t, time.Duration(0), rm.reserve(circuit, now))
+	}
+	assert.NotEqual(t, time.Duration(0), rm.reserve("d", now))
+	assert.Equal(t, time.Duration(0), rm.reserve("e", now.Add(time.Second)))
+}
@@ -0,0 +1,367 @@
+package common
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	core "github.com/libp2p/go-libp2p-core"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/pkg/errors"
+)
+
+const (
+	// NetworkMapProtocol serves the signed network map to other nodes
+	NetworkMapProtocol = "/pe2pe/nmap/0.0.1"
+	// SignatureSuffix is appended to the map file name (or URL) to get its signature
+	SignatureSuffix = ".sig"
+	// maximum size of a network map received from other nodes
+	maxNetworkMapSize = 4 << 20
+	// how long fetching a map from a single source may take
+	networkFetchTimeout = 30 * time.Second
+)
+
+// signedNetworkMap is a network map in transit
+type signedNetworkMap struct {
+	Map       []byte
+	Signature []byte
+}
+
+// ecdsaSignature is the ASN.1 form of a signature
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// SignNetworkMap returns the signature of a network map file (base64 text)
+func SignNetworkMap(data []byte, key *ecdsa.PrivateKey) ([]byte, error) {
+
+	hash := sha256.Sum256(data)
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "signing network map")
+	}
+
+	sig, err := asn1.Marshal(ecdsaSignature{R: r, S: s})
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding signature")
+	}
+
+	return []byte(base64.StdEncoding.EncodeToString(sig) + "\n"), nil
+}
+
+// verifyNetworkMap checks the organizer signature of a network map
+func verifyNetworkMap(data, signature []byte, key *ecdsa.PublicKey) error {
+
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return errors.Wrap(err, "decoding signature")
+	}
+
+	var es ecdsaSignature
+	rest, err := asn1.Unmarshal(sig, &es)
+	if err != nil || len(rest) > 0 || es.R == nil || es.S == nil {
+		return errors.New("malformed signature")
+	}
+
+	hash := sha256.Sum256(data)
+	if !ecdsa.Verify(key, hash[:], es.R, es.S) {
+		return errors.New("network map is not signed by the organizers")
+	}
+
+	return nil
+}
+
+// parseSignedNetwork verifies and decodes a network map
+func parseSignedNetwork(data, signature []byte, key *ecdsa.PublicKey) (*NetworkSettings, error) {
+
+	err := verifyNetworkMap(data, signature, key)
+	if err != nil {
+		return nil, err
+	}
+
+	ns, err := ParseNetworkSettings(data)
+	if err != nil {
+		return nil, err
+	}
+
+	ns.raw, ns.signature = data, signature
+
+	return ns, nil
+}
+
+// readSignedNetwork reads a network map file and its signature
+func readSignedNetwork(fname string) ([]byte, []byte, error) {
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signature, err := ioutil.ReadFile(fname + SignatureSuffix)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "reading signature")
+	}
+
+	return data, signature, nil
+}
+
+// LoadSignedNetworkSettings reads a network map signed by the organizer key
+func LoadSignedNetworkSettings(fname string, key *ecdsa.PublicKey) (*NetworkSettings, error) {
+
+	data, signature, err := readSignedNetwork(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSignedNetwork(data, signature, key)
+}
+
+// applyNetworkMap replaces the network map if the signed one is newer
+func (c *Client) applyNetworkMap(data, signature []byte, source string) (bool, error) {
+
+	ns, err := parseSignedNetwork(data, signature, c.Settings.Crypto.OrganizerKey)
+	if err != nil {
+		return false, err
+	}
+
+	c.networkUpdateLock.Lock()
+	defer c.networkUpdateLock.Unlock()
+
+	if current := c.Network(); current != nil && ns.Version <= current.Version {
+		return false, nil
+	}
+
+	c.UpdateNetwork(ns)
+
+	log.Infof("Network map updated to version %v from %v (%v nodes)", ns.Version, source, len(ns.Nodes))
+
+	return true, nil
+}
+
+// StartNetworkUpdates serves the signed network map to other nodes
+// and periodically fetches newer versions
+func (c *Client) StartNetworkUpdates() error {
+
+	if c.Settings.Crypto.OrganizerKey == nil {
+		if c.Settings.NetworkURL != "" {
+			return errors.New("organizer key is required for network map updates")
+		}
+		return nil
+	}
+
+	c.Host.SetStreamHandler(NetworkMapProtocol, c.serveNetworkMap)
+
+	var interval = c.Settings.NetworkUpdateInterval
+	if interval <= 0 {
+		return nil
+	}
+
+	// the goroutine keeps its own channel, stopNetworkUpdates resets the field
+	var done = make(chan struct{})
+	c.networkUpdatesDone = done
+
+	go func(done <-chan struct{}) {
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := c.FetchNetwork(ctx)
+			cancel()
+
+			if err != nil {
+				log.Warningf("Network map update failed: %v", err)
+			}
+		}
+	}(done)
+
+	return nil
+}
+
+// stopNetworkUpdates stops fetching newer network maps
+func (c *Client) stopNetworkUpdates() {
+	if c.networkUpdatesDone != nil {
+		close(c.networkUpdatesDone)
+		c.networkUpdatesDone = nil
+	}
+}
+
+// FetchNetwork asks the network URL and the trusted relays for a newer network map,
+// an error is returned only if no source could be asked
+func (c *Client) FetchNetwork(ctx context.Context) error {
+
+	var (
+		asked   bool
+		lastErr error
+	)
+
+	if url := c.Settings.NetworkURL; url != "" {
+		applied, err := c.fetchNetworkURL(ctx, url)
+		if err != nil {
+			log.Debugf("Fetching network map from %v failed: %v", url, err)
+			lastErr = errors.Wrapf(err, "fetching %v", url)
+		} else if applied {
+			return nil
+		} else {
+			asked = true
+		}
+	}
+
+	for _, id := range c.trustedRelays() {
+		applied, err := c.fetchNetworkPeer(ctx, id)
+		if err != nil {
+			log.Debugf("Fetching network map from %v failed: %v", id, err)
+			lastErr = errors.Wrapf(err, "fetching from %v", id)
+		} else if applied {
+			return nil
+		} else {
+			asked = true
+		}
+	}
+
+	if asked {
+		return nil
+	}
+
+	return lastErr
+}
+
+// trustedRelays returns the organizer nodes serving the network map
+func (c *Client) trustedRelays() []core.PeerID {
+
+	var ids []core.PeerID
+
+	for id, member := range c.Network().Nodes {
+		if member.TrustedRelay && id != c.Host.ID() {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	return ids
+}
+
+// fetchNetworkURL downloads the network map and its signature over HTTP
+func (c *Client) fetchNetworkURL(ctx context.Context, url string) (bool, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, networkFetchTimeout)
+	defer cancel()
+
+	data, err := httpGet(ctx, url)
+	if err != nil {
+		return false, err
+	}
+
+	signature, err := httpGet(ctx, url+SignatureSuffix)
+	if err != nil {
+		return false, err
+	}
+
+	return c.applyNetworkMap(data, signature, url)
+}
+
+// httpGet returns the body of a successful response
+func httpGet(ctx context.Context, url string) ([]byte, error) {
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %v", resp.Status)
+	}
+
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxNetworkMapSize))
+}
+
+// fetchNetworkPeer asks another node for a network map newer than the current one
+func (c *Client) fetchNetworkPeer(ctx context.Context, id core.PeerID) (bool, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, networkFetchTimeout)
+	defer cancel()
+
+	s, err := c.Host.NewStream(ctx, id, NetworkMapProtocol)
+	if err != nil {
+		return false, err
+	}
+	defer s.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	}
+
+	err = binary.Write(s, binary.BigEndian, c.Network().Version)
+	if err != nil {
+		_ = s.Reset()
+		return false, err
+	}
+
+	// no response - the node has nothing newer
+	var m signedNetworkMap
+	err = json.NewDecoder(io.LimitReader(s, maxNetworkMapSize)).Decode(&m)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		_ = s.Reset()
+		return false, err
+	}
+
+	return c.applyNetworkMap(m.Map, m.Signature, id.Pretty())
+}
+
+// serveNetworkMap sends the signed network map if it is newer than the one of the remote node
+func (c *Client) serveNetworkMap(s network.Stream) {
+
+	defer s.Close()
+
+	_ = s.SetDeadline(time.Now().Add(networkFetchTimeout))
+
+	var version uint64
+	err := binary.Read(s, binary.BigEndian, &version)
+	if err != nil {
+		_ = s.Reset()
+		return
+	}
+
+	ns := c.Network()
+	if ns.raw == nil || ns.Version <= version {
+		return
+	}
+
+	err = json.NewEncoder(s).Encode(signedNetworkMap{Map: ns.raw, Signature: ns.signature})
+	if err != nil {
+		log.Debugf("Sending network map to %v failed: %v", s.Conn().RemotePeer(), err)
+		_ = s.Reset()
+	}
+}
@@ -0,0 +1,112 @@
+package common
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignedNetwork(t *testing.T) {
+
+	organizer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	var (
+		v1 = []byte("Version=1\n[Rules]\nPorts=4041\n")
+		v2 = []byte("Version=2\n[Rules]\nPorts=4041,80\n")
+	)
+
+	sig1, err := SignNetworkMap(v1, organizer)
+	assert.NoError(t, err)
+
+	sig2, err := SignNetworkMap(v2, organizer)
+	assert.NoError(t, err)
+
+	forged, err := SignNetworkMap(v2, other)
+	assert.NoError(t, err)
+
+	ns, err := parseSignedNetwork(v1, sig1, &organizer.PublicKey)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, uint64(1), ns.Version)
+
+	_, err = parseSignedNetwork(v2, sig1, &organizer.PublicKey)
+	assert.Error(t, err, "signature of another map")
+
+	_, err = parseSignedNetwork(v2, forged, &organizer.PublicKey)
+	assert.Error(t, err, "signed by another key")
+
+	_, err = parseSignedNetwork(v2, []byte("garbage"), &organizer.PublicKey)
+	assert.Error(t, err, "malformed signature")
+
+	// the map is fetched over HTTP
+	var files = map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, found := files[r.URL.Path]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+	}))
+	defer srv.Close()
+
+	c := &Client{Settings: &Settings{
+		Crypto:     &CryptoSettings{OrganizerKey: &organizer.PublicKey},
+		Network:    ns,
+		NetworkURL: srv.URL + "/nmap.ini",
+	}}
+
+	assert.Error(t, c.FetchNetwork(context.Background()), "not published")
+
+	files["/nmap.ini"], files["/nmap.ini.sig"] = v2, forged
+	assert.Error(t, c.FetchNetwork(context.Background()), "forged")
+	assert.Equal(t, uint64(1), c.Network().Version)
+
+	files["/nmap.ini.sig"] = sig2
+	assert.NoError(t, c.FetchNetwork(context.Background()))
+	assert.Equal(t, uint64(2), c.Network().Version)
+	assert.True(t, c.Network().Rules.Ports.Contains(80))
+
+	// older versions are ignored
+	files["/nmap.ini"], files["/nmap.ini.sig"] = v1, sig1
+	assert.NoError(t, c.FetchNetwork(context.Background()))
+	assert.Equal(t, uint64(2), c.Network().Version)
+}
+
+func TestNetworkHooksOrder(t *testing.T) {
+
+	var (
+		c    = &Client{Settings: &Settings{}}
+		seen *NetworkSettings
+		wg   sync.WaitGroup
+	)
+
+	c.OnNetworkChange(func(ns *NetworkSettings) {
+		seen = ns
+	})
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(version uint64) {
+			defer wg.Done()
+			c.UpdateNetwork(&NetworkSettings{Version: version})
+		}(uint64(i))
+	}
+
+	wg.Wait()
+
+	// the last hook call got the map that is in use
+	assert.Equal(t, c.Network(), seen)
+}
@@ -0,0 +1,81 @@
+package common
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Network returns the current network map
+func (c *Client) Network() *NetworkSettings {
+
+	c.networkLock.RLock()
+	defer c.networkLock.RUnlock()
+
+	return c.Settings.Network
+}
+
+// UpdateNetwork replaces the network map and notifies the subscribers
+func (c *Client) UpdateNetwork(ns *NetworkSettings) {
+
+	c.hooksLock.Lock()
+	defer c.hooksLock.Unlock()
+
+	c.networkLock.Lock()
+	c.Settings.Network = ns
+	hooks := append([]func(*NetworkSettings){}, c.networkHooks...)
+	c.networkLock.Unlock()
+
+	for _, hook := range hooks {
+		hook(ns)
+	}
+}
+
+// OnNetworkChange registers a function called whenever the network map is replaced
+func (c *Client) OnNetworkChange(hook func(*NetworkSettings)) {
+
+	c.networkLock.Lock()
+	defer c.networkLock.Unlock()
+
+	c.networkHooks = append(c.networkHooks, hook)
+}
+
+// ReloadNetwork reads the network map from the disk again
+func (c *Client) ReloadNetwork() error {
+
+	// light clients have no network map
+	if c.isLightClient() {
+		return nil
+	}
+
+	// signed maps only replace older versions
+	if c.Settings.Crypto.OrganizerKey != nil {
+		data, signature, err := readSignedNetwork(c.Settings.NetworkConfig)
+		if err != nil {
+			return errors.Wrap(err, "reloading network map")
+		}
+
+		applied, err := c.applyNetworkMap(data, signature, c.Settings.NetworkConfig)
+		if err != nil {
+			return errors.Wrap(err, "reloading network map")
+		}
+
+		if !applied {
+			log.Infof("Network map is not newer than version %v, keeping it", c.Network().Version)
+		}
+
+		return nil
+	}
+
+	ns, err := LoadNetworkSettings(c.Settings.NetworkConfig)
+	if err != nil {
+		return errors.Wrap(err, "reloading network map")
+	}
+
+	// replaced like signed maps, so concurrent updates do not interleave
+	c.networkUpdateLock.Lock()
+	defer c.networkUpdateLock.Unlock()
+
+	log.Infof("Network map reloaded (%v nodes)", len(ns.Nodes))
+
+	c.UpdateNetwork(ns)
+	return nil
+}
@@ -25,23 +25,51 @@ type CryptoHop struct {
 	ECDSAPublic ecdsa.PublicKey
 }
 
-// NumHops that each packet is required to travel
+// NumHops that each packet is required to travel by default
 const NumHops = 2 // @TODO debug only
 
-// GenPath creates a path of nodes that a packet could travel through
-func (c *Client) GenPath(dest core.PeerID) ([]CryptoHop, error) {
+// WithHops overrides the path length of connections dialed with the context
+func WithHops(ctx context.Context, hops int) context.Context {
+	return context.WithValue(ctx, hopsKey, hops)
+}
+
+// hopsFromContext returns the requested path length
+func hopsFromContext(ctx context.Context) int {
+	if hops, ok := ctx.Value(hopsKey).(int); ok && hops > 0 {
+		return hops
+	}
+	return NumHops
+}
+
+// WithEntryRelay makes connections dialed with the context enter the network through
+// the relay if it is usable for the path
+func WithEntryRelay(ctx context.Context, relay core.PeerID) context.Context {
+	return context.WithValue(ctx, entryRelayKey, relay)
+}
+
+// entryRelayFromContext returns the requested first relay ("" - any)
+func entryRelayFromContext(ctx context.Context) core.PeerID {
+	relay, _ := ctx.Value(entryRelayKey).(core.PeerID)
+	return relay
+}
+
+// GenPath creates a path of numHops nodes that a packet could travel through.
+// Relays used by other isolation groups are skipped, the relays of the path are claimed
+// for the group until ReleasePath is called. The entry relay (if not empty and usable)
+// becomes the first hop.
+func (c *Client) GenPath(dest core.PeerID, numHops int, group string, entry core.PeerID) ([]CryptoHop, error) {
 
 	var (
-		hops = NumHops - 1 // the last hop is dest
-		ret  = make([]CryptoHop, 0, NumHops)
+		hops      = numHops - 1 // the last hop is dest
+		ret       = make([]CryptoHop, 0, numHops)
+		network   = c.Network()
+		own, free []CryptoHop
 	)
 
-	for addr, info := range c.Settings.Network.Nodes {
+	c.isolation.lock.Lock()
+	defer c.isolation.lock.Unlock()
 
-		// check return (here to allow 1 hops for testing purposes)
-		if hops == 0 {
-			break
-		}
+	for addr, info := range network.Nodes {
 
 		// exclude own addr
 		if addr == c.Host.ID() {
@@ -53,17 +81,44 @@ func (c *Client) GenPath(dest core.PeerID) ([]CryptoHop, error) {
 			continue
 		}
 
-		// decode && append next hop
-		ret = append(ret, CryptoHop{
+		// exclude relays of other isolation groups
+		ok, owned := c.isolation.usable(group, addr)
+		if !ok {
+			continue
+		}
+
+		var hop = CryptoHop{
 			ECDSAPublic: info.OnionKey,
 			HostID:      addr,
-		})
+		}
+
+		// prefer relays the group already uses, leaving the rest to others
+		if owned {
+			own = append(own, hop)
+		} else {
+			free = append(free, hop)
+		}
+	}
+
+	var relays = append(own, free...)
+	for i, hop := range relays {
+		if hop.HostID == entry {
+			relays[0], relays[i] = relays[i], relays[0]
+			break
+		}
+	}
+
+	// (here to allow 1 hops for testing purposes)
+	for _, hop := range relays {
+		if hops == 0 {
+			break
+		}
 
-		// decrement counter
+		ret = append(ret, hop)
 		hops--
 	}
 
-	destHopInfo, found := c.Settings.Network.Nodes[dest]
+	destHopInfo, found := network.Nodes[dest]
 	if !found {
 		return nil, errors.Errorf("dest hop %v not found in network map", dest)
 	}
@@ -74,13 +129,22 @@ func (c *Client) GenPath(dest core.PeerID) ([]CryptoHop, error) {
 		ECDSAPublic: destHopInfo.OnionKey,
 	})
 
-	if len(ret) != NumHops {
-		return nil, fmt.Errorf("not enough hops: %v/%v", len(ret), NumHops)
+	if len(ret) != numHops {
+		return nil, fmt.Errorf("not enough hops: %v/%v", len(ret), numHops)
 	}
 
+	c.isolation.claim(group, ret[:len(ret)-1])
+
 	return ret, nil
 }
 
+// ReleasePath frees relays of a path created by GenPath
+func (c *Client) ReleasePath(path []CryptoHop, group string) {
+	if len(path) > 0 {
+		c.isolation.release(group, path[:len(path)-1])
+	}
+}
+
 // ConstructRelayHeader returns an onion-wrapped welcome message with e2e encryption keys
 func (c *Client) ConstructRelayHeader(hops []CryptoHop, payload [256]byte) ([]byte, error) {
 
@@ -128,8 +192,36 @@ func (c *Client) ConstructRelayHeader(hops []CryptoHop, payload [256]byte) ([]by
 	return buf.Bytes(), nil
 }
 
-// OnionDial establishs an encrypted onion e2e-connection
-func (c *Client) OnionDial(ctx context.Context, proto string, host core.PeerID, port int) (net.Conn, error) {
+// newOpenRequest creates the connection request of a new circuit to the host
+func (c *Client) newOpenRequest(ctx context.Context, host core.PeerID, addr net.IP, port int, group string) (*connectionOpenRequest, error) {
+
+	var request = &connectionOpenRequest{
+		Port:      uint32(port),
+		Timestamp: time.Now().Unix(),
+		StreamID:  uuid.New(),
+	}
+
+	// exits with several addresses choose the backend by it
+	copy(request.Addr[:], addr.To16())
+
+	// backends of the exit may tell isolated clients apart by it (other streams get a new one each)
+	request.Circuit = c.circuitID(group)
+
+	// restricted services of the exit check it, only requested proofs are sent
+	// (every exit can verify them and would single out the stream)
+	if exitAuthFromContext(ctx) {
+		err := c.attachExitAuth(request, host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return request, nil
+}
+
+// OnionDial establishs an encrypted onion e2e-connection,
+// addr is the game address of the host requested by the client (nil - not specified)
+func (c *Client) OnionDial(ctx context.Context, proto string, host core.PeerID, addr net.IP, port int) (net.Conn, error) {
 
 	// validate network
 	if proto != "tcp" {
@@ -137,22 +229,31 @@ func (c *Client) OnionDial(ctx context.Context, proto string, host core.PeerID,
 	}
 
 	// construct onion chain
-	chain, err := c.GenPath(host)
+	var group = isolationFromContext(ctx)
+	chain, err := c.GenPath(host, hopsFromContext(ctx), group, entryRelayFromContext(ctx))
 	if err != nil {
 		return nil, err
 	}
 
+	// relays are released either here or when the established connection is closed
+	var circuitOpen bool
+	defer func() {
+		if !circuitOpen {
+			c.ReleasePath(chain, group)
+		}
+	}()
+
 	// create payload && connection request
 	var (
 		payload [256]byte
-		request = connectionOpenRequest{
-			Port:      uint32(port),
-			Timestamp: time.Now().Unix(),
-			StreamID:  uuid.New(),
-		}
-		buf = &bytes.Buffer{}
+		buf     = &bytes.Buffer{}
 	)
 
+	request, err := c.newOpenRequest(ctx, host, addr, port, group)
+	if err != nil {
+		return nil, err
+	}
+
 	{ // log the packet path
 		var debugPath []string
 		for _, hop := range chain {
@@ -231,6 +332,8 @@ func (c *Client) OnionDial(ctx context.Context, proto string, host core.PeerID,
 			}
 			log.Debugf("connecting cleanup stuff (stream=%v)", request.StreamID)
 
+			c.ReleasePath(chain, group)
+
 			err = stream.Close()
 			if err != nil {
 				log.Errorf("Error while closing connected stream (stream=%v): %v",
@@ -263,12 +366,20 @@ func (c *Client) OnionDial(ctx context.Context, proto string, host core.PeerID,
 
 	log.Debugf("got magic (stream=%v)", request.StreamID)
 
-	// check magic byte
+	// check magic byte (or the reason the exit node could not connect)
 	if respBuf[0] != MagicWelcomeByte {
+		if exitErr := exitErrorFromStatus(respBuf[0]); exitErr != nil {
+			return nil, errors.Wrapf(exitErr, "%v:%v (stream=%v)", host.Pretty(), port, request.StreamID)
+		}
 		return nil, errors.Errorf("bad magic response number %v (stream=%v)", respBuf[0], request.StreamID)
 	}
 
 	// establish encrypted connection
 	connectionEstablished = true
-	return returnEnd, nil
+	circuitOpen = true
+	return &overlayConn{
+		Conn:   returnEnd,
+		local:  c.overlayAddr(c.Host.ID(), nil, 0),
+		remote: c.overlayAddr(host, addr, port),
+	}, nil
 }
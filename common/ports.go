@@ -0,0 +1,70 @@
+package common
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	From, To int
+}
+
+// PortSet is a list of port ranges ("80,8000-8100")
+type PortSet []PortRange
+
+// ParsePortSet parses a comma-separated list of ports and port ranges
+func ParsePortSet(value string) (PortSet, error) {
+
+	var ret PortSet
+
+	for _, part := range strings.Split(value, ",") {
+
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		var (
+			bounds = strings.SplitN(part, "-", 2)
+			ports  [2]int
+		)
+
+		for i := range ports {
+
+			var bound = bounds[0]
+			if i < len(bounds) {
+				bound = bounds[i]
+			}
+
+			port, err := strconv.Atoi(strings.TrimSpace(bound))
+			if err != nil || port < 1 || port > 65535 {
+				return nil, errors.Errorf("invalid port %q", bound)
+			}
+
+			ports[i] = port
+		}
+
+		if ports[0] > ports[1] {
+			return nil, errors.Errorf("invalid port range %q", part)
+		}
+
+		ret = append(ret, PortRange{From: ports[0], To: ports[1]})
+	}
+
+	return ret, nil
+}
+
+// Contains checks if the port is in the set
+func (ps PortSet) Contains(port int) bool {
+
+	for _, r := range ps {
+		if port >= r.From && port <= r.To {
+			return true
+		}
+	}
+
+	return false
+}
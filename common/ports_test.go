@@ -0,0 +1,36 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePortSet(t *testing.T) {
+
+	ps, err := ParsePortSet("80, 4041,8000-8100")
+	assert.NoError(t, err)
+	assert.Equal(t, PortSet{{80, 80}, {4041, 4041}, {8000, 8100}}, ps)
+
+	for port, expected := range map[int]bool{
+		80:   true,
+		81:   false,
+		4041: true,
+		7999: false,
+		8000: true,
+		8050: true,
+		8100: true,
+		8101: false,
+	} {
+		assert.Equal(t, expected, ps.Contains(port), "port %v", port)
+	}
+
+	ps, err = ParsePortSet("")
+	assert.NoError(t, err)
+	assert.Empty(t, ps)
+
+	for _, bad := range []string{"http", "0", "65536", "90-80", "1-2-3"} {
+		_, err = ParsePortSet(bad)
+		assert.Error(t, err, bad)
+	}
+}
@@ -2,98 +2,335 @@ package common
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"sort"
 	"strconv"
 
 	"github.com/derlaft/pe2pectf/go-socks5"
 	"github.com/pkg/errors"
 )
 
-// StartProxy binds a local port for proxy
+// DefaultProxy is the name of the proxy listener from the command line
+const DefaultProxy = "default"
+
+// proxy listener protocols
+const (
+	ProxySOCKS5 = "socks5"
+	ProxyHTTP   = "http"
+)
+
+// relay isolation of proxy listeners
+const (
+	// streams of different users never share relays
+	IsolateUser = "user"
+	// streams of different listeners never share relays
+	IsolateListener = "listener"
+	// relays are shared with everyone
+	IsolateNone = "none"
+)
+
+// LoadProxySettings reads a JSON file with proxy listeners
+func LoadProxySettings(fname string) (ProxiesSettings, error) {
+
+	bytes, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	var proxies ProxiesSettings
+	err = json.Unmarshal(bytes, &proxies)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding proxy listeners")
+	}
+
+	for name, ps := range proxies {
+
+		if ps == nil {
+			return nil, errors.Errorf("proxy %v has no settings", name)
+		}
+
+		err := ps.load(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return proxies, nil
+}
+
+// load validates the settings and reads the users of a proxy listener
+func (ps *ProxySettings) load(name string) error {
+
+	if ps.Listen == "" {
+		return errors.Errorf("proxy %v has no listen addr", name)
+	}
+
+	switch ps.Protocol {
+	case "":
+		ps.Protocol = ProxySOCKS5
+	case ProxySOCKS5, ProxyHTTP:
+	default:
+		return errors.Errorf("proxy %v has unknown protocol %v", name, ps.Protocol)
+	}
+
+	switch ps.Isolation {
+	case "":
+		ps.Isolation = IsolateUser
+	case IsolateUser, IsolateListener, IsolateNone:
+	default:
+		return errors.Errorf("proxy %v has unknown isolation %v", name, ps.Isolation)
+	}
+
+	if ps.Hops < 0 {
+		return errors.Errorf("proxy %v has negative hops", name)
+	}
+
+	ps.targets = nil
+	for _, allow := range ps.Allow {
+		tp, err := parseTargetPattern(allow)
+		if err != nil {
+			return errors.Wrapf(err, "proxy %v", name)
+		}
+		ps.targets = append(ps.targets, tp)
+	}
+
+	if ps.Users > "" {
+		users, err := LoadProxyUsers(ps.Users)
+		if err != nil {
+			return errors.Wrapf(err, "proxy %v", name)
+		}
+		ps.users = users
+	}
+
+	return nil
+}
+
+// proxyListener is a running proxy listener
+type proxyListener struct {
+	name     string
+	settings *ProxySettings
+	client   *Client
+	users    *proxyUsers // nil - no authentication
+	shutdown func(ctx context.Context) error
+}
+
+// isolationGroup returns the relay isolation group of a stream of the user
+func (l *proxyListener) isolationGroup(user string) string {
+
+	switch l.settings.Isolation {
+	case IsolateNone:
+		return ""
+	case IsolateListener:
+		return l.name
+	}
+
+	if user == "" {
+		return ""
+	}
+
+	return l.name + "/" + user
+}
+
+// StartProxy binds all configured proxy listeners
 func (c *Client) StartProxy() error {
 
+	var names = make([]string, 0, len(c.Settings.Proxies))
+	for name := range c.Settings.Proxies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if c.proxies == nil {
+		c.proxies = make(map[string]*proxyListener, len(names))
+	}
+
+	var started []string
+
+	for _, name := range names {
+
+		var (
+			ps = c.Settings.Proxies[name]
+			l  = &proxyListener{
+				name:     name,
+				settings: ps,
+				client:   c,
+			}
+			err error
+		)
+
+		// require authentication if users are configured
+		if ps.users != nil {
+			l.users = newProxyUsers(ps.users)
+		}
+
+		switch ps.Protocol {
+		case ProxyHTTP:
+			err = l.startHTTP()
+		default:
+			err = l.startSOCKS5()
+		}
+		if err != nil {
+			c.stopStartedProxies(started)
+			return errors.Wrapf(err, "starting proxy %v", name)
+		}
+
+		log.Infof("Proxy %v (%v) is listening on %v", name, ps.Protocol, ps.Listen)
+
+		c.proxies[name] = l
+		started = append(started, name)
+	}
+
+	return nil
+}
+
+// stopStartedProxies releases the listeners bound before a failed StartProxy
+func (c *Client) stopStartedProxies(names []string) {
+
+	for _, name := range names {
+
+		err := c.proxies[name].shutdown(context.Background())
+		if err != nil {
+			log.Errorf("Failed to stop proxy %v: %v", name, err)
+		}
+
+		delete(c.proxies, name)
+	}
+}
+
+// startSOCKS5 serves a SOCKS proxy
+func (l *proxyListener) startSOCKS5() error {
+
+	var c = l.client
+
 	conf := &socks5.Config{
-		Dial:     c.Dial,
-		Resolver: c,
+		Dial:             l.dial,
+		Resolver:         c,
+		Rules:            l,
+		HandshakeTimeout: c.Settings.ProxyHandshakeTimeout,
+		IdleTimeout:      c.Settings.ProxyIdleTimeout,
+		MaxConns:         c.Settings.ProxyMaxConns,
+	}
+
+	if l.users != nil {
+		conf.Credentials = l.users
 	}
+
 	server, err := socks5.New(conf)
 	if err != nil {
 		return err
 	}
 
+	listener, err := net.Listen("tcp", l.settings.Listen)
+	if err != nil {
+		return err
+	}
+
+	// the listener is closed right away even if Serve has not picked it up yet
+	l.shutdown = func(ctx context.Context) error {
+		_ = listener.Close()
+		return server.Shutdown(ctx)
+	}
+
 	go func() {
-		err := server.ListenAndServe("tcp", c.Settings.ProxyAddr)
-		if err != nil {
-			log.Fatal(err)
+		err := server.Serve(listener)
+		if err != nil && err != socks5.ErrServerClosed {
+			log.Errorf("Proxy %v stopped: %v", l.name, err)
 		}
-
 	}()
 
 	return nil
 }
 
+// StopProxy stops accepting proxy connections and waits for the active ones until ctx expires
+func (c *Client) StopProxy(ctx context.Context) error {
+
+	var ret error
+
+	for name, l := range c.proxies {
+
+		log.Infof("Stopping proxy %v", name)
+
+		err := l.shutdown(ctx)
+		if err != nil {
+			ret = errors.Wrapf(err, "stopping proxy %v", name)
+		}
+	}
+
+	return ret
+}
+
 // Resolve virtual IP in the game network
 func (c *Client) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
 
-	for _, client := range c.Settings.Network.Nodes {
-		if client.ID == name || client.Address == name {
-			return ctx, net.ParseIP(client.Address), nil
-		}
+	// names are resolved by the team node of a light client
+	if c.isLightClient() {
+		return ctx, nil, nil
 	}
 
-	log.Errorf("Could not resolve addr %v", name)
+	ns := c.Network()
+
+	peerID, found := ns.PeerIDForHost(name)
+	if !found {
+		log.Errorf("Could not resolve addr %v", name)
+		return nil, nil, errors.New("not found")
+	}
 
-	// @TODO: actually implement some resolving
-	return nil, nil, errors.New("not found")
+	// members without a game address are dialed by name (nil IP)
+	return ctx, net.ParseIP(ns.Nodes[peerID].Address), nil
 }
 
 // Dial some host in a virtual network
 func (c *Client) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
 
+	if c.isLightClient() {
+		return c.lightDial(ctx, network, addr)
+	}
+
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, errors.New("Error parsing network addr")
 	}
 
-	if addr == c.Settings.Network.Nodes[c.Settings.Crypto.ID].Address {
-		dialer := net.Dialer{}
-
-		if c.Settings.ExitNode == nil {
-			return nil, errors.New("Exit node is disabled")
-		}
-
-		dialTo := (*c.Settings.ExitNode)[port]
-		if dialTo == "" {
-			return nil, errors.Errorf("Port %v is disabled", port)
-		}
-
-		localConn, err := dialer.DialContext(ctx, "tcp", dialTo)
-		if err != nil {
-			return nil, errors.Wrap(err, "Failed to open local socket")
-		}
-
-		return localConn, nil
-	}
+	ns := c.Network()
 
 	portValue, err := strconv.Atoi(port)
 	if err != nil {
 		return nil, errors.New("Error parsing network addr port")
 	}
 
-	peerID, found := c.Settings.Network.PeerIDForAddr(host)
+	peerID, found := ns.PeerIDForHost(host)
 	if !found {
 		return nil, errors.Errorf("Addr %v is not in static routing table", addr)
 	}
 
+	// virtual ports of this node
+	if peerID == c.Host.ID() {
+		if ol, found := c.overlayListener(portValue); found {
+			return ol.connect("local")
+		}
+	}
+
+	var ip = net.ParseIP(host)
+
 	// in case of this node
-	if peerID == c.Host.ID() && c.Settings.ExitNode != nil {
+	if en := c.exitNode(); peerID == c.Host.ID() && en != nil {
 
 		log.Debugf("A new local connection to port %v", portValue)
 
+		// mapped services are dialed like for remote clients (restricted ones included, the node owns them)
+		if svc := en.Service(ip, portValue); svc != nil {
+			conn, _, err := svc.dial(ctx, portValue)
+			return conn, err
+		}
+
 		// just dial addr locally - it's on this node
+		dialTo := fmt.Sprintf("localhost:%v", portValue)
+
 		dialer := &net.Dialer{}
-		conn, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%v", portValue))
+		conn, err := dialer.DialContext(ctx, "tcp", dialTo)
 		if err != nil {
 			return nil, errors.Wrap(err, "Failed to open local socket")
 		}
@@ -106,7 +343,7 @@ func (c *Client) Dial(ctx context.Context, network, addr string) (net.Conn, erro
 
 	log.Debugf("A new remote connection to %v:%v", peerID, portValue)
 
-	conn, err := c.OnionDial(ctx, network, peerID, portValue)
+	conn, err := c.OnionDial(ctx, network, peerID, ip, portValue)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,184 @@
+package common
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTemp(t *testing.T, content string) string {
+
+	f, err := ioutil.TempFile("", "pe2pe")
+	assert.NoError(t, err)
+
+	_, err = f.WriteString(content)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	return f.Name()
+}
+
+func TestProxySettings(t *testing.T) {
+
+	users := writeTemp(t, `{"player": {"Password": "secret"}}`)
+	defer os.Remove(users)
+
+	proxies := writeTemp(t, `{
+		"fast": {"Listen": "127.0.0.1:9051", "Hops": 1, "Allow": ["team2:*"]},
+		"exploits": {"Listen": "127.0.0.1:9052", "Protocol": "http", "Hops": 3, "Users": "`+users+`", "Isolation": "listener"}
+	}`)
+	defer os.Remove(proxies)
+
+	ps, err := LoadProxySettings(proxies)
+	assert.NoError(t, err)
+
+	var (
+		fast     = ps["fast"]
+		exploits = ps["exploits"]
+		team2    = Member{ID: "team2", Address: "10.0.0.2"}
+		team3    = Member{ID: "team3", Address: "10.0.0.3"}
+	)
+
+	if !assert.NotNil(t, fast) || !assert.NotNil(t, exploits) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, ProxySOCKS5, fast.Protocol)
+	assert.Equal(t, IsolateUser, fast.Isolation)
+	assert.Nil(t, fast.users)
+	assert.True(t, matchTargets(fast.targets, team2, nil, 4041))
+	assert.False(t, matchTargets(fast.targets, team3, nil, 4041))
+
+	assert.Equal(t, ProxyHTTP, exploits.Protocol)
+	assert.Contains(t, exploits.users, "player")
+
+	// relay isolation groups
+	l := &proxyListener{name: "fast", settings: fast}
+	assert.Equal(t, "", l.isolationGroup(""))
+	assert.Equal(t, "fast/player", l.isolationGroup("player"))
+
+	l = &proxyListener{name: "exploits", settings: exploits}
+	assert.Equal(t, "exploits", l.isolationGroup("player"))
+
+	// bad settings
+	for _, bad := range []string{
+		`{"x": {"Protocol": "socks5"}}`,
+		`{"x": {"Listen": ":1", "Protocol": "ftp"}}`,
+		`{"x": {"Listen": ":1", "Isolation": "team"}}`,
+		`{"x": {"Listen": ":1", "Allow": ["team2"]}}`,
+		`{"x": {"Listen": ":1", "Users": "/nonexistent"}}`,
+	} {
+		fname := writeTemp(t, bad)
+		_, err := LoadProxySettings(fname)
+		assert.Error(t, err, bad)
+		os.Remove(fname)
+	}
+}
+
+func TestParseProxyAuth(t *testing.T) {
+
+	name, password, ok := parseProxyAuth("Basic cGxheWVyOnNlYzpyZXQ=")
+	assert.True(t, ok)
+	assert.Equal(t, "player", name)
+	assert.Equal(t, "sec:ret", password)
+
+	for _, bad := range []string{"", "Bearer xyz", "Basic !!!", "Basic cGxheWVy"} {
+		_, _, ok := parseProxyAuth(bad)
+		assert.False(t, ok, bad)
+	}
+}
+
+func TestPeerIDForHost(t *testing.T) {
+
+	team1, err := peer.IDB58Decode("QmZeFykRKmid2bhKXrZGDourB1wAv2seBogABN1Vjv11er")
+	assert.NoError(t, err)
+
+	team2, err := peer.IDB58Decode("Qmb2PW7BxToPJdKmkcFaRJ53UvZPxLjzknEW1PNf9ZuPjx")
+	assert.NoError(t, err)
+
+	// team2 has no primary game address, only a subnet
+	ns := &NetworkSettings{
+		Nodes: map[peer.ID]Member{
+			team1: {ID: "team1", Address: "10.0.0.1"},
+			team2: {ID: "team2", Networks: []*net.IPNet{{IP: net.IP{10, 60, 2, 0}, Mask: net.CIDRMask(24, 32)}}},
+		},
+	}
+
+	for host, expected := range map[string]peer.ID{
+		"10.0.0.1":                team1,
+		"team1":                   team1,
+		"team1.node":              team1,
+		"team2.node.":             team2,
+		"10.60.2.3":               team2,
+		team2.Pretty() + ".pe2pe": team2,
+	} {
+		id, found := ns.PeerIDForHost(host)
+		assert.True(t, found, host)
+		assert.Equal(t, expected, id, host)
+	}
+
+	for _, host := range []string{"", ".node", "10.0.0.2", "10.60.3.1", "team3.node", "bad.pe2pe", "QmdTpWGiRkBewFBayCicPMoUriopSnxcRwM1CQp2p5xntW.pe2pe"} {
+		_, found := ns.PeerIDForHost(host)
+		assert.False(t, found, host)
+	}
+}
+
+func TestStartProxyFailure(t *testing.T) {
+
+	// a free port for the first listener
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	var freeAddr = free.Addr().String()
+	assert.NoError(t, free.Close())
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer taken.Close()
+
+	var c = &Client{Settings: &Settings{Proxies: ProxiesSettings{
+		"a": {Listen: freeAddr, Protocol: ProxySOCKS5},
+		"b": {Listen: taken.Addr().String(), Protocol: ProxyHTTP},
+	}}}
+
+	assert.Error(t, c.StartProxy())
+	assert.Empty(t, c.proxies)
+
+	// the listener started before the failure is closed
+	l, err := net.Listen("tcp", freeAddr)
+	if assert.NoError(t, err) {
+		l.Close()
+	}
+}
+
+func TestDialErrorStatus(t *testing.T) {
+
+	// the HTTP transport hands dial errors back in its own wrappers
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: errors.Wrap(ErrServiceBusy, "dialing")}
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://10.0.0.2:4041/", nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	_, err = transport.RoundTrip(req)
+	assert.Equal(t, http.StatusServiceUnavailable, dialErrorStatus(err))
+
+	assert.Equal(t, http.StatusForbidden, dialErrorStatus(errors.Wrap(ErrAccessDenied, "owner only")))
+	assert.Equal(t, http.StatusBadGateway, dialErrorStatus(ErrServiceDown))
+	assert.Equal(t, http.StatusBadGateway, dialErrorStatus(errors.New("service is restricted")))
+}
@@ -0,0 +1,101 @@
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// PROXY protocol v2 header (https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt)
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n") //nolint:gochecknoglobals
+
+const (
+	proxyV2Command      = 0x21 // version 2, PROXY
+	proxyV2TCP6         = 0x21 // AF_INET6, STREAM
+	proxyV2TypeUniqueID = 0x05
+)
+
+// circuitPrefix is the network of synthetic source addresses (fd70:6532:7065::/64, "pe2pe")
+var circuitPrefix = net.IP{0xfd, 0x70, 0x65, 0x32, 0x70, 0x65, 0, 0} //nolint:gochecknoglobals
+
+// circuitID returns the pseudonym of a new circuit. Streams that are not isolated get a random one
+// each, so exits can not link them; isolated groups keep theirs while the node runs (the group
+// is meant to be linked anyway), different for every group and not derived from the node identity.
+func (c *Client) circuitID(group string) [8]byte {
+
+	var id [8]byte
+
+	if group == "" {
+		_, err := rand.Read(id[:])
+		if err != nil {
+			log.Errorf("Failed to generate circuit ID: %v", err)
+		}
+		return id
+	}
+
+	c.circuitOnce.Do(func() {
+		_, err := rand.Read(c.circuitSalt[:])
+		if err != nil {
+			log.Errorf("Failed to generate circuit salt: %v", err)
+		}
+	})
+
+	var mac = hmac.New(sha256.New, c.circuitSalt[:])
+
+	_, _ = mac.Write([]byte(group))
+	copy(id[:], mac.Sum(nil))
+
+	return id
+}
+
+// circuitAddr returns the synthetic source address of a circuit
+func circuitAddr(circuit [8]byte) net.IP {
+
+	var ip = make(net.IP, net.IPv6len)
+	copy(ip, circuitPrefix)
+	copy(ip[8:], circuit[:])
+
+	return ip
+}
+
+// writeProxyHeader sends a PROXY protocol v2 header of a stream to the backend:
+// the source is the synthetic address of the circuit, the destination is the requested
+// game address (:: - not specified), the stream ID is sent as PP2_TYPE_UNIQUE_ID
+func writeProxyHeader(w io.Writer, req *connectionOpenRequest) error {
+
+	var (
+		body     bytes.Buffer
+		streamID = req.StreamID.String()
+		dst      = net.IP(req.Addr[:]).To16()
+	)
+
+	// source and destination addresses and ports (the source port is taken from the stream ID)
+	body.Write(circuitAddr(req.Circuit))
+	body.Write(dst)
+	body.Write(req.StreamID[:2])
+	_ = binary.Write(&body, binary.BigEndian, uint16(req.Port))
+
+	// the stream ID (as logged by the nodes)
+	body.WriteByte(proxyV2TypeUniqueID)
+	_ = binary.Write(&body, binary.BigEndian, uint16(len(streamID)))
+	body.WriteString(streamID)
+
+	var header = make([]byte, 0, len(proxyV2Signature)+4+body.Len())
+	header = append(header, proxyV2Signature...)
+	header = append(header, proxyV2Command, proxyV2TCP6, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-2:], uint16(body.Len()))
+	header = append(header, body.Bytes()...)
+
+	_, err := w.Write(header)
+	if err != nil {
+		return errors.Wrap(err, "sending PROXY header")
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitID(t *testing.T) {
+
+	var c = &Client{}
+
+	assert.Equal(t, c.circuitID("user1"), c.circuitID("user1"))
+	assert.NotEqual(t, c.circuitID("user1"), c.circuitID("user2"))
+	assert.NotEqual(t, c.circuitID("user1"), (&Client{}).circuitID("user1"))
+
+	// streams that are not isolated can not be linked by the exit
+	assert.NotEqual(t, c.circuitID(""), c.circuitID(""))
+	assert.NotEqual(t, c.circuitID(""), c.circuitID("user1"))
+
+	ip := circuitAddr(c.circuitID("user1"))
+	_, prefix, _ := net.ParseCIDR("fd70:6532:7065::/64")
+	assert.True(t, prefix.Contains(ip))
+}
+
+func TestProxyHeader(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer l.Close()
+
+	var received = make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var header = make([]byte, 16)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+
+		body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		received <- append(header, body...)
+	}()
+
+	var (
+		en = ExitNodeSettings{"10.0.0.2:4041": {Backends: []string{l.Addr().String()}, ProxyProtocol: true}}
+		c  = &Client{Settings: &Settings{ExitNode: &en}}
+	)
+	if !assert.NoError(t, en.validate()) {
+		t.FailNow()
+	}
+
+	var req = connectionOpenRequest{Port: 4041, StreamID: uuid.New(), Circuit: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}}
+	copy(req.Addr[:], net.ParseIP("10.0.0.2").To16())
+
+	conn, _, err := c.dialExit(context.Background(), &req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	header := <-received
+	assert.True(t, bytes.HasPrefix(header, proxyV2Signature))
+	assert.Equal(t, []byte{proxyV2Command, proxyV2TCP6}, header[12:14])
+
+	var (
+		addrs = header[16:]
+		tlv   = header[16+36:]
+		srcIP = net.IP(addrs[:16])
+		dstIP = net.IP(addrs[16:32])
+		port  = binary.BigEndian.Uint16(addrs[34:36])
+	)
+
+	assert.Equal(t, "fd70:6532:7065:0:102:304:506:708", srcIP.String())
+	assert.Equal(t, "10.0.0.2", dstIP.String())
+	assert.Equal(t, uint16(4041), port)
+
+	assert.Equal(t, byte(proxyV2TypeUniqueID), tlv[0])
+	assert.Equal(t, req.StreamID.String(), string(tlv[3:3+binary.BigEndian.Uint16(tlv[1:3])]))
+}
@@ -5,7 +5,6 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/gob"
-	"fmt"
 	"net"
 	"time"
 
@@ -36,6 +35,13 @@ type connectionOpenRequest struct {
 	Port      uint32
 	Key       [chacha20poly1305.KeySize]byte
 	StreamID  uuid.UUID
+	// requested game address of the exit (zero - not specified)
+	Addr [net.IPv6len]byte
+	// pseudonym of the client isolation group (PROXY protocol source address)
+	Circuit [8]byte
+	// access proof of restricted services: exitAuth* kind, r || s signature
+	AuthKind      byte
+	AuthSignature [64]byte
 }
 
 // StartRelay starts the relay service
@@ -56,8 +62,8 @@ func (c *Client) StartRelay() error {
 			log.Error("resetting the stream", err)
 			_ = s.Reset()
 		} else {
-			log.Error("resetting the stream (no error)")
-			_ = s.Reset()
+			// let the last response reach the other end
+			_ = s.Close()
 		}
 	})
 
@@ -82,16 +88,12 @@ func (c *Client) serveRelayPackets(ctx context.Context, s network.Stream) error
 		return errors.Wrap(err, "processing relay header")
 	}
 
-	if nextPacket.IsLast() && c.Settings.ExitNode != nil {
+	if nextPacket.IsLast() {
 		// @TODO handle exit node
 		return c.serveExitNode(ctx, nextPacket.Payload, s)
-
-	} else if nextPacket.IsLast() {
-		return fmt.Errorf("dead-end")
 	}
 
-	var dialAddr core.PeerID
-	err = dialAddr.UnmarshalBinary(nextAddr[:34])
+	dialAddr, err := hopAddr(nextAddr[:])
 	if err != nil {
 		return errors.Wrap(err, "parsing next hop addr")
 	}
@@ -111,8 +113,8 @@ func (c *Client) serveRelayPackets(ctx context.Context, s network.Stream) error
 	return connectstream.Connect(stream, s)
 }
 
-// serveExitNode connects stream s to a local port
-// @TODO: write errors back?
+// serveExitNode connects stream s to a local port,
+// failed dials are reported with a status byte instead of the magic
 func (c *Client) serveExitNode(ctx context.Context, payload [256]byte, remoteConn network.Stream) error {
 
 	log.Debugf("Payload is %v", payload)
@@ -128,37 +130,40 @@ func (c *Client) serveExitNode(ctx context.Context, payload [256]byte, remoteCon
 		return errors.Wrap(err, "Failed to read request header")
 	}
 
-	if c.Settings.ExitNode == nil {
-		return errors.New("Exit node is disabled")
+	var addr = net.IP(header.Addr[:])
+	if addr.IsUnspecified() {
+		addr = nil
 	}
 
-	dialTo := (*c.Settings.ExitNode)[fmt.Sprintf("%v", header.Port)]
-
-	if dialTo == "" {
-		return errors.Errorf("Port %v is not allowed", header.Port)
+	// create an encrypted readwriter
+	secureConn, err := NewCryptoReadWriter(remoteConn, header.Key[:])
+	if err != nil {
+		return errors.Wrap(err, "Failed to open secure connection")
 	}
 
-	var dialer = &net.Dialer{}
-
-	// open the local socket
-	// @TODO: configurable ip addr
-	localConn, err := dialer.DialContext(ctx, "tcp", dialTo)
+	localConn, target, err := c.dialExit(ctx, &header)
 	if err != nil {
-		return errors.Wrap(err, "Failed to open local socket")
+		log.Infof("Exit connection failed (stream=%v): %v", header.StreamID, err)
+		_, err = secureConn.Write([]byte{exitStatus(err)})
+		return errors.Wrap(err, "Failed to report exit error")
 	}
 
 	defer func() {
 		log.Debugf("COCC closing conn")
 		err := localConn.Close()
 		if err != nil {
-			log.Errorf("Failed to close connection: %v", err)
+			log.Debugf("Failed to close connection: %v", err)
 		}
 	}()
 
-	// create an encrypted readwriter
-	secureConn, err := NewCryptoReadWriter(remoteConn, header.Key[:])
-	if err != nil {
-		return errors.Wrap(err, "Failed to open secure connection")
+	// mapped services are closed on reload if their mapping changes
+	if target != "" {
+		defer c.trackExitStream(&exitStream{
+			addr:   addr,
+			port:   int(header.Port),
+			target: target,
+			conn:   localConn,
+		})()
 	}
 
 	// dial is OK! fienally now we can send back the magic
@@ -168,5 +173,109 @@ func (c *Client) serveExitNode(ctx context.Context, payload [256]byte, remoteCon
 	}
 
 	// connect secure stream with local pipe
-	return connectstream.Connect(secureConn, localConn)
+	return middlewareResult(connectstream.Connect(secureConn, localConn))
+}
+
+// dialExit connects to a service of this node: a virtual port or a mapped local socket
+// (target is the backend of the service, empty for virtual ports)
+func (c *Client) dialExit(ctx context.Context, req *connectionOpenRequest) (conn net.Conn, target string, err error) {
+
+	var (
+		addr = net.IP(req.Addr[:])
+		port = int(req.Port)
+	)
+
+	if ol, found := c.overlayListener(port); found {
+		conn, err = ol.connect(req.StreamID.String())
+		return conn, "", err
+	}
+
+	if addr.IsUnspecified() {
+		addr = nil
+	}
+
+	svc := c.exitNode().Service(addr, port)
+	if svc == nil {
+		return nil, "", errors.Wrapf(ErrPortNotMapped, "port %v", port)
+	}
+
+	if svc.Access != "" {
+		err = checkExitAuth(req, svc.Access, c.Host.ID(), c.Network(), c.Settings.Crypto.OrganizerKey)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "port %v", port)
+		}
+	}
+
+	// middlewares refuse streams before they take a slot of the service
+	var (
+		meta = StreamMeta{
+			ID:      req.StreamID.String(),
+			Service: svc.mapping,
+			Port:    port,
+			Circuit: circuitAddr(req.Circuit),
+		}
+		filters []StreamFilter
+	)
+
+	if len(svc.middleware) > 0 {
+		filters, err = admitExit(ctx, svc.middleware, &meta)
+		if err != nil {
+			log.Infof("Stream %v refused by middleware: %v", meta.ID, err)
+			return nil, "", errors.Wrapf(err, "port %v", port)
+		}
+	}
+
+	conn, target, err = svc.dial(ctx, port)
+	if err != nil {
+		return nil, "", err
+	}
+
+	meta.Backend = target
+
+	if svc.ProxyProtocol {
+		err = writeProxyHeader(conn, req)
+		if err != nil {
+			_ = conn.Close()
+			log.Debugf("Failed to send PROXY header to %v: %v", target, err)
+			return nil, "", errors.Wrapf(ErrServiceDown, "port %v", port)
+		}
+	}
+
+	// the shadow gets the same data as the service
+	if svc.Shadow != "" {
+		conn = c.mirrorExit(svc, port, req, conn)
+	}
+
+	// filtered data is what the service gets, capture and analyzer see the client side
+	conn = wrapExit(conn, filters)
+
+	// the game side of the stream is recorded (without the PROXY header)
+	if c.capture != nil {
+		conn = c.capture.wrap(svc.mapping, conn, req)
+	}
+
+	if c.analyzer != nil {
+		conn = c.analyzer.wrap(svc.mapping, target, conn, req)
+	}
+
+	return conn, target, nil
+}
+
+// hopAddr decodes the peer ID of the next hop from its zero-padded sphinx address;
+// the multihash header tells its length (sha256 and inline identity IDs differ)
+func hopAddr(addr []byte) (core.PeerID, error) {
+
+	_, codeLen := binary.Uvarint(addr)
+	if codeLen <= 0 {
+		return "", errors.New("bad multihash code")
+	}
+
+	digestLen, lenLen := binary.Uvarint(addr[codeLen:])
+	if lenLen <= 0 || digestLen > uint64(len(addr)-codeLen-lenLen) {
+		return "", errors.New("bad multihash length")
+	}
+
+	var id core.PeerID
+	err := id.UnmarshalBinary(addr[:codeLen+lenLen+int(digestLen)])
+	return id, err
 }
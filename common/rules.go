@@ -0,0 +1,155 @@
+package common
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/derlaft/pe2pectf/go-socks5"
+	"github.com/pkg/errors"
+)
+
+// Allow implements socks5.RuleSet: only game addresses and ports are reachable
+func (l *proxyListener) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+
+	err := l.checkRequest(req)
+	if err != nil {
+		log.Infof("Refused request from %v to %v (proxy %v): %v", req.RemoteAddr, req.DestAddr, l.name, err)
+		return ctx, false
+	}
+
+	// pass the user to dial
+	if name, found := proxyUserFromRequest(req); found {
+		ctx = withProxyUser(ctx, name)
+	}
+
+	return ctx, true
+}
+
+// proxyUserFromRequest returns the name of the authenticated user
+func proxyUserFromRequest(req *socks5.Request) (string, bool) {
+
+	if req.AuthContext == nil || req.AuthContext.Method != socks5.UserPassAuth {
+		return "", false
+	}
+
+	name, found := req.AuthContext.Payload["Username"]
+	return name, found
+}
+
+// newRequest describes a request of other protocols like a SOCKS one, so the same rules apply
+func (l *proxyListener) newRequest(ctx context.Context, target, name string) (context.Context, *socks5.Request, error) {
+
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "parsing target %v", target)
+	}
+
+	portValue, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "parsing target %v", target)
+	}
+
+	var dest = &socks5.AddrSpec{Port: portValue, IP: net.ParseIP(host)}
+	if dest.IP == nil {
+		dest.FQDN = host
+
+		ctx, dest.IP, err = l.client.Resolve(ctx, host)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "resolving %v", host)
+		}
+	}
+
+	var req = &socks5.Request{
+		Command:     socks5.ConnectCommand,
+		DestAddr:    dest,
+		AuthContext: &socks5.AuthContext{Method: socks5.NoAuth},
+	}
+
+	if name != "" {
+		req.AuthContext = &socks5.AuthContext{
+			Method:  socks5.UserPassAuth,
+			Payload: map[string]string{"Username": name},
+		}
+	}
+
+	return ctx, req, nil
+}
+
+// checkRequest returns the reason a proxy request is not allowed
+func (l *proxyListener) checkRequest(req *socks5.Request) error {
+
+	// the team node applies the rules to requests of light clients (Load refuses local targets)
+	if l.client.isLightClient() && req.Command == socks5.ConnectCommand {
+		return nil
+	}
+
+	member, err := l.client.checkRequest(req)
+	if err != nil {
+		return err
+	}
+
+	// members requested by name are dialed at their primary address
+	var ip = req.DestAddr.IP
+	if ip == nil {
+		ip = net.ParseIP(member.Address)
+	}
+
+	if len(l.settings.targets) > 0 && !matchTargets(l.settings.targets, member, ip, req.DestAddr.Port) {
+		return errors.Errorf("target is not allowed on proxy %v", l.name)
+	}
+
+	if name, found := proxyUserFromRequest(req); found && l.users != nil {
+		return l.users.checkTarget(name, member, ip, req.DestAddr.Port)
+	}
+
+	return nil
+}
+
+// checkRequest returns the reason a proxy request is against the game rules
+func (c *Client) checkRequest(req *socks5.Request) (Member, error) {
+
+	if req.Command != socks5.ConnectCommand {
+		return Member{}, errors.Errorf("command %v is not supported", req.Command)
+	}
+
+	var (
+		ns   = c.Network()
+		dest = req.DestAddr
+	)
+
+	// names of members without a game address stay unresolved
+	var host = dest.FQDN
+	if dest.IP != nil {
+		host = dest.IP.String()
+	}
+
+	if host == "" {
+		return Member{}, errors.New("destination is not resolved")
+	}
+
+	peerID, found := ns.PeerIDForHost(host)
+	if !found {
+		return Member{}, errors.New("not a game address")
+	}
+
+	var (
+		member          = ns.Nodes[peerID]
+		self, selfFound = ns.Nodes[c.Host.ID()]
+	)
+
+	// other nodes of the same team share the member ID
+	if c.Settings.BlockSelf && (peerID == c.Host.ID() || selfFound && self.ID != "" && self.ID == member.ID) {
+		return Member{}, errors.New("own address is blocked")
+	}
+
+	if member.TrustedRelay && ns.Rules.OrganizerPorts.Contains(dest.Port) {
+		return Member{}, errors.New("organizer port is blocked")
+	}
+
+	if !member.TrustedRelay && len(ns.Rules.Ports) > 0 && !ns.Rules.Ports.Contains(dest.Port) {
+		return Member{}, errors.New("not a game port")
+	}
+
+	return member, nil
+}
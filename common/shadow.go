@@ -0,0 +1,391 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"hash"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	shadowTimeout     = 5 * time.Second // the shadow may answer for this long after the stream closes
+	shadowQueue       = 256             // client writes queued for a slow shadow
+	shadowCompareSize = 64 << 10        // response bytes kept to find the first difference
+	shadowSnippet     = 64              // response bytes reported from the difference
+	shadowDivergences = 20              // divergent streams kept per service
+)
+
+// ShadowStats compares the responses of a service and its shadow backend
+type ShadowStats struct {
+	// mirrored streams
+	Streams   int64
+	Identical int64
+	Diverged  int64
+	// the shadow could not be reached or did not keep up with the client
+	Failed int64
+	// the latest divergent streams
+	Divergences []ShadowDivergence
+}
+
+// ShadowDivergence is a stream the shadow answered differently
+type ShadowDivergence struct {
+	Stream string
+	Time   time.Time
+	// the first different byte (-1 - somewhere after the compared part)
+	Offset int64
+	// response sizes
+	Production int64
+	Shadow     int64
+	// response bytes from the difference
+	ProductionData string
+	ShadowData     string
+}
+
+// shadowStats are the stats of all services
+type shadowStats struct {
+	lock     sync.Mutex
+	services map[string]*ShadowStats
+}
+
+// ShadowStats returns the shadow stats of services by mapping
+func (c *Client) ShadowStats() map[string]ShadowStats {
+	return c.shadow.snapshot()
+}
+
+// LogShadowStats writes the shadow stats of services to the log
+func (c *Client) LogShadowStats() {
+
+	var (
+		stats    = c.shadow.snapshot()
+		mappings = make([]string, 0, len(stats))
+	)
+
+	for mapping := range stats {
+		mappings = append(mappings, mapping)
+	}
+	sort.Strings(mappings)
+
+	for _, mapping := range mappings {
+		s := stats[mapping]
+		log.Infof("Shadow of %v: streams=%v identical=%v diverged=%v failed=%v",
+			mapping, s.Streams, s.Identical, s.Diverged, s.Failed)
+	}
+}
+
+func (ss *shadowStats) snapshot() map[string]ShadowStats {
+
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	var result = make(map[string]ShadowStats, len(ss.services))
+	for mapping, stats := range ss.services {
+		var copied = *stats
+		copied.Divergences = append([]ShadowDivergence(nil), stats.Divergences...)
+		result[mapping] = copied
+	}
+
+	return result
+}
+
+// record updates the stats of a service with a finished stream
+// (divergence is nil for identical responses)
+func (ss *shadowStats) record(mapping string, failed bool, divergence *ShadowDivergence) {
+
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	if ss.services == nil {
+		ss.services = make(map[string]*ShadowStats)
+	}
+
+	stats, found := ss.services[mapping]
+	if !found {
+		stats = &ShadowStats{}
+		ss.services[mapping] = stats
+	}
+
+	stats.Streams++
+
+	switch {
+	case failed:
+		stats.Failed++
+	case divergence == nil:
+		stats.Identical++
+	default:
+		stats.Diverged++
+		stats.Divergences = append(stats.Divergences, *divergence)
+		if len(stats.Divergences) > shadowDivergences {
+			stats.Divergences = append(stats.Divergences[:0:0], stats.Divergences[1:]...)
+		}
+	}
+}
+
+// mirrorExit copies the client data of a stream to the shadow backend of the service,
+// the shadow is dialed with the first data (streams refused by middleware or closed
+// without data never reach it)
+func (c *Client) mirrorExit(svc *ExitService, port int, req *connectionOpenRequest, conn net.Conn) net.Conn {
+
+	var ss = &shadowStream{
+		stats:      &c.shadow,
+		mapping:    svc.mapping,
+		id:         req.StreamID.String(),
+		queue:      make(chan []byte, shadowQueue),
+		production: newResponseDigest(),
+		shadow:     newResponseDigest(),
+	}
+
+	network, addr := backendAddr(svc.Shadow, port)
+
+	ss.dial = func(ctx context.Context) (net.Conn, error) {
+
+		var dialer = &net.Dialer{Timeout: svc.ConnectTimeout}
+
+		shadowConn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if svc.ProxyProtocol {
+			err = writeProxyHeader(shadowConn, req)
+			if err != nil {
+				_ = shadowConn.Close()
+				return nil, err
+			}
+		}
+
+		return shadowConn, nil
+	}
+
+	return &mirroredConn{Conn: conn, stream: ss}
+}
+
+// shadowStream is a stream mirrored to the shadow backend
+type shadowStream struct {
+	stats   *shadowStats
+	mapping string
+	id      string
+	dial    func(ctx context.Context) (net.Conn, error)
+
+	lock       sync.Mutex
+	queue      chan []byte
+	started    bool
+	closed     bool
+	overflow   bool
+	production *responseDigest
+	shadow     *responseDigest
+}
+
+// mirror queues client data for the shadow, it never blocks the stream
+func (ss *shadowStream) mirror(data []byte) {
+
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	if ss.closed || ss.overflow {
+		return
+	}
+
+	if !ss.started {
+		ss.started = true
+		go ss.run()
+	}
+
+	select {
+	case ss.queue <- append([]byte(nil), data...):
+	default:
+		ss.overflow = true
+	}
+}
+
+// close ends the client data
+func (ss *shadowStream) close() {
+
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	if !ss.closed {
+		ss.closed = true
+		close(ss.queue)
+	}
+}
+
+// run sends the client data to the shadow, waits for its response and records the result
+func (ss *shadowStream) run() {
+
+	ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+	shadowConn, err := ss.dial(ctx)
+	cancel()
+
+	if err != nil {
+		log.Debugf("Failed to connect shadow of %v (stream %v): %v", ss.mapping, ss.id, err)
+		ss.stats.record(ss.mapping, true, nil)
+		return
+	}
+
+	defer shadowConn.Close()
+
+	var responded = make(chan struct{})
+	go func() {
+		defer close(responded)
+
+		var buf = make([]byte, 32<<10)
+		for {
+			n, err := shadowConn.Read(buf)
+			ss.shadow.write(buf[:n])
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var failed bool
+	for data := range ss.queue {
+		if failed {
+			continue
+		}
+
+		_, err = shadowConn.Write(data)
+		if err != nil {
+			log.Debugf("Failed to mirror stream %v to the shadow of %v: %v", ss.id, ss.mapping, err)
+			failed = true
+		}
+	}
+
+	// the shadow gets the end of the client data like the service
+	if cw, ok := shadowConn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+
+	select {
+	case <-responded:
+	case <-time.After(shadowTimeout):
+	}
+
+	ss.lock.Lock()
+	failed = failed || ss.overflow
+	ss.lock.Unlock()
+
+	var divergence = compareResponses(ss.production, ss.shadow)
+	if divergence != nil {
+		divergence.Stream = ss.id
+		log.Infof("Shadow of %v diverged in stream %v at byte %v", ss.mapping, ss.id, divergence.Offset)
+	}
+
+	ss.stats.record(ss.mapping, failed, divergence)
+}
+
+// responseDigest summarizes a response
+type responseDigest struct {
+	lock sync.Mutex
+	hash hash.Hash
+	size int64
+	head []byte
+}
+
+func newResponseDigest() *responseDigest {
+	return &responseDigest{hash: sha256.New()}
+}
+
+func (rd *responseDigest) write(data []byte) {
+
+	rd.lock.Lock()
+	defer rd.lock.Unlock()
+
+	_, _ = rd.hash.Write(data)
+	rd.size += int64(len(data))
+
+	if rest := shadowCompareSize - len(rd.head); rest > 0 {
+		if len(data) > rest {
+			data = data[:rest]
+		}
+		rd.head = append(rd.head, data...)
+	}
+}
+
+func (rd *responseDigest) summary() ([]byte, int64, []byte) {
+
+	rd.lock.Lock()
+	defer rd.lock.Unlock()
+
+	return rd.hash.Sum(nil), rd.size, append([]byte(nil), rd.head...)
+}
+
+// compareResponses returns the difference of the responses (nil - identical)
+func compareResponses(production, shadow *responseDigest) *ShadowDivergence {
+
+	var (
+		prodSum, prodSize, prodHead       = production.summary()
+		shadowSum, shadowSize, shadowHead = shadow.summary()
+	)
+
+	if prodSize == shadowSize && bytes.Equal(prodSum, shadowSum) {
+		return nil
+	}
+
+	var divergence = ShadowDivergence{
+		Time:       time.Now(),
+		Offset:     -1,
+		Production: prodSize,
+		Shadow:     shadowSize,
+	}
+
+	// the first difference within the kept heads (or the end of the shorter one)
+	var offset int
+	for offset < len(prodHead) && offset < len(shadowHead) && prodHead[offset] == shadowHead[offset] {
+		offset++
+	}
+
+	if offset < len(prodHead) || offset < len(shadowHead) {
+		divergence.Offset = int64(offset)
+		divergence.ProductionData = snippet(prodHead, offset)
+		divergence.ShadowData = snippet(shadowHead, offset)
+	}
+
+	return &divergence
+}
+
+// snippet returns the response bytes from the offset
+func snippet(head []byte, offset int) string {
+
+	if offset >= len(head) {
+		return ""
+	}
+
+	head = head[offset:]
+	if len(head) > shadowSnippet {
+		head = head[:shadowSnippet]
+	}
+
+	return string(head)
+}
+
+// mirroredConn copies the client data of a service connection to the shadow
+type mirroredConn struct {
+	net.Conn
+	stream *shadowStream
+}
+
+func (mc *mirroredConn) Read(b []byte) (int, error) {
+	n, err := mc.Conn.Read(b)
+	if n > 0 {
+		mc.stream.production.write(b[:n])
+	}
+	return n, err
+}
+
+func (mc *mirroredConn) Write(b []byte) (int, error) {
+	n, err := mc.Conn.Write(b)
+	if n > 0 {
+		mc.stream.mirror(b[:n])
+	}
+	return n, err
+}
+
+func (mc *mirroredConn) Close() error {
+	mc.stream.close()
+	return mc.Conn.Close()
+}
@@ -0,0 +1,206 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveLines answers every line with the reply and closes connections on EOF,
+// accepted connections are counted
+func serveLines(t *testing.T, reply func(string) string) (net.Listener, chan string, *int64) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	var (
+		received = make(chan string, 16)
+		accepted int64
+	)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&accepted, 1)
+
+			go func() {
+				defer conn.Close()
+
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					received <- scanner.Text()
+					_, _ = io.WriteString(conn, reply(scanner.Text())+"\n")
+				}
+			}()
+		}
+	}()
+
+	return l, received, &accepted
+}
+
+func TestShadow(t *testing.T) {
+
+	production, _, accepted := serveLines(t, func(line string) string {
+		if line == "exploit" {
+			return "FLAG"
+		}
+		return "ok " + line
+	})
+	defer production.Close()
+
+	// the patched service does not leak the flag
+	shadow, mirrored, dialed := serveLines(t, func(line string) string {
+		if line == "exploit" {
+			return "no"
+		}
+		return "ok " + line
+	})
+	defer shadow.Close()
+
+	var (
+		en = ExitNodeSettings{
+			"4041": {Backends: []string{production.Addr().String()}, Shadow: shadow.Addr().String()},
+			"4042": {
+				Backends:   []string{production.Addr().String()},
+				Shadow:     shadow.Addr().String(),
+				Middleware: []MiddlewareConfig{{Type: "ratelimit", Options: json.RawMessage(`{"Rate": 0.001}`)}},
+			},
+		}
+		c = &Client{Settings: &Settings{ExitNode: &en}}
+	)
+	if !assert.NoError(t, en.validate()) {
+		t.FailNow()
+	}
+
+	var exchange = func(lines ...string) string {
+
+		var req = connectionOpenRequest{Port: 4041, StreamID: uuid.New()}
+
+		conn, _, err := c.dialExit(context.Background(), &req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		var (
+			reader  = bufio.NewReader(conn)
+			replies []string
+		)
+
+		for _, line := range lines {
+			_, err = io.WriteString(conn, line+"\n")
+			assert.NoError(t, err)
+
+			reply, err := reader.ReadString('\n')
+			assert.NoError(t, err)
+			replies = append(replies, strings.TrimSpace(reply))
+		}
+
+		assert.NoError(t, conn.Close())
+
+		return strings.Join(replies, ",")
+	}
+
+	// streams without client data and refused ones do not reach the shadow
+	exchange()
+
+	for i := 0; i < 2; i++ {
+		var req = connectionOpenRequest{Port: 4042, StreamID: uuid.New()}
+
+		conn, _, err := c.dialExit(context.Background(), &req)
+		if i == 0 && assert.NoError(t, err) {
+			assert.NoError(t, conn.Close())
+		}
+		if i == 1 {
+			assert.Equal(t, exitBusy, exitStatus(err))
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int64(0), atomic.LoadInt64(dialed))
+
+	// refused streams do not reach the service either
+	assert.Equal(t, int64(2), atomic.LoadInt64(accepted))
+	assert.Empty(t, c.ShadowStats())
+
+	// the client gets the production responses only
+	assert.Equal(t, "ok a,ok b", exchange("a", "b"))
+	assert.Equal(t, "ok c,FLAG", exchange("c", "exploit"))
+
+	for _, line := range []string{"a", "b", "c", "exploit"} {
+		select {
+		case mirroredLine := <-mirrored:
+			assert.Equal(t, line, mirroredLine)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the shadow did not get the stream")
+		}
+	}
+
+	var stats ShadowStats
+	for i := 0; i < 100; i++ {
+		stats = c.ShadowStats()["4041"]
+		if stats.Streams == 2 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	assert.Equal(t, int64(2), stats.Streams)
+	assert.Equal(t, int64(1), stats.Identical)
+	assert.Equal(t, int64(1), stats.Diverged)
+
+	if assert.Len(t, stats.Divergences, 1) {
+		assert.Equal(t, int64(5), stats.Divergences[0].Offset)
+		assert.Equal(t, "FLAG\n", stats.Divergences[0].ProductionData)
+		assert.Equal(t, "no\n", stats.Divergences[0].ShadowData)
+	}
+
+	// unreachable shadows are counted as failed
+	shadow.Close()
+	exchange("d")
+
+	for i := 0; i < 100 && c.ShadowStats()["4041"].Failed == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, int64(1), c.ShadowStats()["4041"].Failed)
+}
+
+func TestCompareResponses(t *testing.T) {
+
+	var digest = func(data string) *responseDigest {
+		rd := newResponseDigest()
+		rd.write([]byte(data))
+		return rd
+	}
+
+	assert.Nil(t, compareResponses(digest("same"), digest("same")))
+
+	d := compareResponses(digest("response"), digest("resp"))
+	if assert.NotNil(t, d) {
+		assert.Equal(t, int64(4), d.Offset)
+		assert.Equal(t, "onse", d.ProductionData)
+		assert.Equal(t, "", d.ShadowData)
+		assert.Equal(t, int64(8), d.Production)
+		assert.Equal(t, int64(4), d.Shadow)
+	}
+
+	// differences after the compared part have no offset
+	var long = strings.Repeat("x", shadowCompareSize)
+	d = compareResponses(digest(long+"a"), digest(long+"b"))
+	if assert.NotNil(t, d) {
+		assert.Equal(t, int64(-1), d.Offset)
+	}
+}
@@ -0,0 +1,401 @@
+package common
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pkg/errors"
+)
+
+// targetAnyHost matches every game address in a user policy
+const targetAnyHost = "*"
+
+// ProxyUser is the policy of a single proxy user
+type ProxyUser struct {
+	Password string
+	// reachable targets like "team2:4041", "*:80", "10.0.0.3:*", "10.60.2.0/24:80" (empty - any)
+	Allow []string
+	// onion path length (0 - NumHops)
+	Hops int
+	// maximum amount of concurrent streams (0 - unlimited)
+	MaxStreams int
+	// peer ID of a light client, authenticates it instead of the password
+	PeerID string
+
+	targets []targetPattern
+}
+
+// ProxyUserStats are traffic counters of a proxy user
+type ProxyUserStats struct {
+	Streams      int64 // currently open
+	TotalStreams int64
+	Sent         int64 // bytes sent to the game network
+	Received     int64 // bytes received from the game network
+}
+
+type targetPattern struct {
+	host    string     // member ID or targetAnyHost
+	network *net.IPNet // game address or subnet instead of host
+	ports   PortSet    // nil - any
+}
+
+func parseTargetPattern(value string) (targetPattern, error) {
+
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return targetPattern{}, errors.Wrapf(err, "parsing target %v", value)
+	}
+
+	var tp = targetPattern{host: host}
+
+	if net.ParseIP(host) != nil || strings.Contains(host, "/") {
+		_, networks, err := parseMemberAddress(host)
+		if err != nil {
+			return targetPattern{}, errors.Wrapf(err, "parsing target %v", value)
+		}
+		tp.host, tp.network = "", networks[0]
+	}
+
+	if port == "*" {
+		return tp, nil
+	}
+
+	tp.ports, err = ParsePortSet(port)
+	if err != nil {
+		return targetPattern{}, errors.Wrapf(err, "parsing target %v", value)
+	}
+
+	return tp, nil
+}
+
+// match reports whether the pattern allows the port on the requested game address of the member
+func (tp targetPattern) match(member Member, ip net.IP, port int) bool {
+
+	switch {
+	case tp.network != nil:
+		if ip == nil || !tp.network.Contains(ip) || !member.HasIP(ip) {
+			return false
+		}
+	case tp.host != targetAnyHost && tp.host != member.ID:
+		return false
+	}
+
+	return tp.ports == nil || tp.ports.Contains(port)
+}
+
+// matchTargets reports whether any of the patterns matches the member port
+func matchTargets(targets []targetPattern, member Member, ip net.IP, port int) bool {
+
+	for _, tp := range targets {
+		if tp.match(member, ip, port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LoadProxyUsers reads a JSON file with proxy users
+func LoadProxyUsers(fname string) (map[string]*ProxyUser, error) {
+
+	bytes, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	var users map[string]*ProxyUser
+	err = json.Unmarshal(bytes, &users)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding proxy users")
+	}
+
+	for name, user := range users {
+
+		if user == nil {
+			return nil, errors.Errorf("user %v has no policy", name)
+		}
+
+		if user.Hops < 0 || user.MaxStreams < 0 {
+			return nil, errors.Errorf("user %v has negative limits", name)
+		}
+
+		if user.PeerID == "" && user.Password == "" {
+			return nil, errors.Errorf("user %v has neither password nor peer ID", name)
+		}
+
+		if user.PeerID != "" {
+			_, err := peer.IDB58Decode(user.PeerID)
+			if err != nil {
+				return nil, errors.Wrapf(err, "user %v has invalid peer ID", name)
+			}
+		}
+
+		for _, allow := range user.Allow {
+			tp, err := parseTargetPattern(allow)
+			if err != nil {
+				return nil, errors.Wrapf(err, "user %v", name)
+			}
+			user.targets = append(user.targets, tp)
+		}
+	}
+
+	return users, nil
+}
+
+// proxyUsers authenticates proxy users, enforces their policies and counts their traffic
+type proxyUsers struct {
+	lock  sync.RWMutex
+	users map[string]*ProxyUser
+	stats map[string]*ProxyUserStats // kept across reloads
+}
+
+func newProxyUsers(users map[string]*ProxyUser) *proxyUsers {
+
+	pu := &proxyUsers{
+		stats: make(map[string]*ProxyUserStats),
+	}
+	pu.update(users)
+
+	return pu
+}
+
+func (pu *proxyUsers) update(users map[string]*ProxyUser) {
+
+	pu.lock.Lock()
+	defer pu.lock.Unlock()
+
+	pu.users = users
+
+	for name := range users {
+		if _, found := pu.stats[name]; !found {
+			pu.stats[name] = new(ProxyUserStats)
+		}
+	}
+}
+
+func (pu *proxyUsers) get(name string) (*ProxyUser, *ProxyUserStats, bool) {
+
+	pu.lock.RLock()
+	defer pu.lock.RUnlock()
+
+	user, found := pu.users[name]
+	return user, pu.stats[name], found
+}
+
+// Valid implements socks5.CredentialStore
+func (pu *proxyUsers) Valid(name, password string) bool {
+
+	// light clients without a password authenticate by peer ID only
+	user, _, found := pu.get(name)
+	if !found || user.Password == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1
+}
+
+// checkTarget returns the reason a user is not allowed to reach the port on the member address
+func (pu *proxyUsers) checkTarget(name string, member Member, ip net.IP, port int) error {
+
+	user, _, found := pu.get(name)
+	if !found {
+		return errors.Errorf("unknown user %v", name)
+	}
+
+	if len(user.targets) == 0 || matchTargets(user.targets, member, ip, port) {
+		return nil
+	}
+
+	return errors.Errorf("target is not allowed for user %v", name)
+}
+
+// acquire reserves a stream for the user
+func (pu *proxyUsers) acquire(name string) (*ProxyUser, *ProxyUserStats, error) {
+
+	user, stats, found := pu.get(name)
+	if !found {
+		return nil, nil, errors.Errorf("unknown user %v", name)
+	}
+
+	for {
+		streams := atomic.LoadInt64(&stats.Streams)
+
+		if user.MaxStreams > 0 && streams >= int64(user.MaxStreams) {
+			return nil, nil, errors.Errorf("stream limit of user %v reached (%v)", name, user.MaxStreams)
+		}
+
+		if atomic.CompareAndSwapInt64(&stats.Streams, streams, streams+1) {
+			atomic.AddInt64(&stats.TotalStreams, 1)
+			return user, stats, nil
+		}
+	}
+}
+
+// Stats returns a copy of all counters
+func (pu *proxyUsers) Stats() map[string]ProxyUserStats {
+
+	pu.lock.RLock()
+	defer pu.lock.RUnlock()
+
+	var ret = make(map[string]ProxyUserStats, len(pu.stats))
+	for name, stats := range pu.stats {
+		ret[name] = ProxyUserStats{
+			Streams:      atomic.LoadInt64(&stats.Streams),
+			TotalStreams: atomic.LoadInt64(&stats.TotalStreams),
+			Sent:         atomic.LoadInt64(&stats.Sent),
+			Received:     atomic.LoadInt64(&stats.Received),
+		}
+	}
+
+	return ret
+}
+
+// countedConn updates user counters and releases the stream on close
+type countedConn struct {
+	net.Conn
+	stats     *ProxyUserStats
+	closeOnce sync.Once
+}
+
+func (cc *countedConn) Read(p []byte) (int, error) {
+	n, err := cc.Conn.Read(p)
+	atomic.AddInt64(&cc.stats.Received, int64(n))
+	return n, err
+}
+
+func (cc *countedConn) Write(p []byte) (int, error) {
+	n, err := cc.Conn.Write(p)
+	atomic.AddInt64(&cc.stats.Sent, int64(n))
+	return n, err
+}
+
+func (cc *countedConn) Close() error {
+	cc.closeOnce.Do(func() {
+		atomic.AddInt64(&cc.stats.Streams, -1)
+	})
+	return cc.Conn.Close()
+}
+
+type contextKey int
+
+const (
+	proxyUserKey contextKey = iota
+	hopsKey
+	isolationKey
+	entryRelayKey
+	exitAuthKey
+)
+
+// withProxyUser stores the authenticated proxy user name
+func withProxyUser(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, proxyUserKey, name)
+}
+
+// proxyUserFromContext returns the authenticated proxy user name
+func proxyUserFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(proxyUserKey).(string)
+	return name, ok
+}
+
+// dial is used by the proxy to apply listener and user policies before dialing
+func (l *proxyListener) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+
+	var c = l.client
+
+	if l.settings.Hops > 0 {
+		ctx = WithHops(ctx, l.settings.Hops)
+	}
+
+	if l.settings.ExitAuth {
+		ctx = WithExitAuth(ctx)
+	}
+
+	name, found := proxyUserFromContext(ctx)
+	if !found || l.users == nil {
+		return c.Dial(WithIsolation(ctx, l.isolationGroup("")), network, addr)
+	}
+
+	user, stats, err := l.users.acquire(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Hops > 0 {
+		ctx = WithHops(ctx, user.Hops)
+	}
+
+	conn, err := c.Dial(WithIsolation(ctx, l.isolationGroup(name)), network, addr)
+	if err != nil {
+		atomic.AddInt64(&stats.Streams, -1)
+		return nil, err
+	}
+
+	return &countedConn{Conn: conn, stats: stats}, nil
+}
+
+// ReloadProxyUsers reads users of all proxy listeners from the disk again
+func (c *Client) ReloadProxyUsers() error {
+
+	for name, l := range c.proxies {
+
+		if l.users == nil {
+			continue
+		}
+
+		users, err := LoadProxyUsers(l.settings.Users)
+		if err == nil && name == LightProxy {
+			err = checkLightUsers(users)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "reloading users of proxy %v", name)
+		}
+
+		log.Infof("Users of proxy %v reloaded (%v users)", name, len(users))
+
+		l.users.update(users)
+	}
+
+	return nil
+}
+
+// LogProxyUserStats writes traffic counters of all proxy users to the log
+func (c *Client) LogProxyUserStats() {
+
+	var proxies = make([]string, 0, len(c.proxies))
+	for name := range c.proxies {
+		proxies = append(proxies, name)
+	}
+	sort.Strings(proxies)
+
+	for _, proxy := range proxies {
+
+		l := c.proxies[proxy]
+		if l.users == nil {
+			continue
+		}
+
+		var (
+			stats = l.users.Stats()
+			names = make([]string, 0, len(stats))
+		)
+
+		for name := range stats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			s := stats[name]
+			log.Infof("Proxy user %v/%v: streams=%v total=%v sent=%v received=%v",
+				proxy, name, s.Streams, s.TotalStreams, s.Sent, s.Received)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package common
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyUsers(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "users")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`{
+		"player": {"Password": "secret", "Allow": ["team2:4041", "*:80-81"], "MaxStreams": 1},
+		"farm": {"Password": "farm", "Hops": 3}
+	}`)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	users, err := LoadProxyUsers(f.Name())
+	assert.NoError(t, err)
+
+	var (
+		pu    = newProxyUsers(users)
+		team2 = Member{ID: "team2", Address: "10.0.0.2"}
+		team3 = Member{ID: "team3", Address: "10.0.0.3"}
+	)
+
+	assert.True(t, pu.Valid("player", "secret"))
+	assert.False(t, pu.Valid("player", "farm"))
+	assert.False(t, pu.Valid("nobody", ""))
+
+	// users of light clients have no password
+	light := newProxyUsers(map[string]*ProxyUser{"laptop": {PeerID: "QmLaptop"}})
+	assert.False(t, light.Valid("laptop", ""))
+
+	anonymous := writeTemp(t, `{"anyone": {"Allow": ["team2:*"]}}`)
+	defer os.Remove(anonymous)
+
+	_, err = LoadProxyUsers(anonymous)
+	assert.Error(t, err, "no password")
+
+	assert.NoError(t, pu.checkTarget("player", team2, nil, 4041))
+	assert.NoError(t, pu.checkTarget("player", team3, nil, 81))
+	assert.Error(t, pu.checkTarget("player", team3, nil, 4041))
+	assert.NoError(t, pu.checkTarget("farm", team3, nil, 4041))
+	assert.Error(t, pu.checkTarget("nobody", team3, nil, 4041))
+
+	// stream limit
+	_, stats, err := pu.acquire("player")
+	assert.NoError(t, err)
+	_, _, err = pu.acquire("player")
+	assert.Error(t, err)
+
+	stats.Streams--
+	_, _, err = pu.acquire("player")
+	assert.NoError(t, err)
+
+	// counters survive reloads
+	pu.update(users)
+	assert.Equal(t, int64(2), pu.Stats()["player"].TotalStreams)
+}
+
+func TestTargetAddresses(t *testing.T) {
+
+	_, networks, err := parseMemberAddress("10.60.2.3, 10.60.2.0/24")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	var (
+		team2   = Member{ID: "team2", Address: "10.60.2.3", Networks: networks}
+		vulnbox = net.ParseIP("10.60.2.3")
+		router  = net.ParseIP("10.60.2.1")
+		targets []targetPattern
+	)
+
+	for _, value := range []string{"10.60.2.1:80", "10.60.2.0/28:22", "team2:4041"} {
+		tp, err := parseTargetPattern(value)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		targets = append(targets, tp)
+	}
+
+	// secondary addresses and subnets of the member
+	assert.True(t, matchTargets(targets, team2, router, 80))
+	assert.False(t, matchTargets(targets, team2, vulnbox, 80))
+	assert.True(t, matchTargets(targets, team2, vulnbox, 22))
+	assert.False(t, matchTargets(targets, team2, net.ParseIP("10.60.2.20"), 22))
+
+	// member IDs match any of its addresses
+	assert.True(t, matchTargets(targets, team2, router, 4041))
+
+	// addresses of other members never match
+	var team3 = Member{ID: "team3", Address: "10.60.2.1"}
+	assert.False(t, matchTargets(targets, team3, router, 80))
+
+	_, err = parseTargetPattern("10.60.2.0/33:80")
+	assert.Error(t, err)
+}
@@ -0,0 +1,48 @@
+package common
+
+import (
+	"net"
+
+	"github.com/derlaft/pe2pectf/tun"
+	"github.com/pkg/errors"
+)
+
+// StartTun creates a TUN device routing the game subnet through the overlay
+func (c *Client) StartTun() error {
+
+	ip, subnet, err := net.ParseCIDR(c.Settings.TunAddr)
+	if err != nil {
+		return errors.Wrap(err, "parsing tun address")
+	}
+
+	conf := &tun.Config{
+		Name: c.Settings.TunDevice,
+		Addr: &net.IPNet{IP: ip, Mask: subnet.Mask},
+		Dial: c.Dial,
+		// a SYN flood to unreachable addresses must not pile up dials
+		DialTimeout: ProxyRelayDialTimeout,
+	}
+	server, err := tun.New(conf)
+	if err != nil {
+		return err
+	}
+
+	// open the device right away so configuration errors are not deferred
+	dev, err := tun.Open(conf.Name, conf.Addr, conf.MTU)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Routing %v through device %v", subnet, conf.Name)
+
+	c.tunDevice = dev
+
+	go func() {
+		err := server.Serve(dev)
+		if err != nil {
+			log.Infof("Device %v stopped: %v", conf.Name, err)
+		}
+	}()
+
+	return nil
+}
@@ -6,9 +6,12 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"encoding/base64"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 
+	"github.com/derlaft/pe2pectf/common"
 	"github.com/libp2p/go-libp2p-core/crypto"
 )
 
@@ -26,10 +29,49 @@ func bytesToString(b []byte) string {
 }
 
 func main() {
+
+	// sign a network map with the organizer key instead
+	sign := flag.String("sign", "", "Network map file to sign (the signature is written next to it with .sig)")
+	key := flag.String("key", "", "Organizer ecdsa private key (base64, as printed by genkey)")
+	flag.Parse()
+
+	if *sign != "" {
+		signNetworkMap(*sign, *key)
+		return
+	}
+
 	genRSA()
 	genECDSA()
 }
 
+func signNetworkMap(fname, key string) {
+
+	keyBytes, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		log.Fatalf("Error while decoding key: %v", err)
+	}
+
+	ecp, err := x509.ParseECPrivateKey(keyBytes)
+	if err != nil {
+		log.Fatalf("Error while parsing key: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	signature, err := common.SignNetworkMap(data, ecp)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(fname+common.SignatureSuffix, signature, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
 func genECDSA() {
 
 	fmt.Println("ecdsa")
@@ -0,0 +1,104 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// closeWriter is implemented by connections that support half-close
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// activityWriter records the time of the last successful write
+type activityWriter struct {
+	io.Writer
+	last *int64
+}
+
+func (w activityWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if n > 0 {
+		atomic.StoreInt64(w.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// proxy copies data between the client and the target.
+// When the client is done sending, the target is half-closed (if supported)
+// so the response can still be received; when the target is done,
+// both connections are closed. With idleTimeout > 0 both connections are
+// closed after no data was sent in either direction for that long.
+func proxy(target net.Conn, client io.Writer, clientReader io.Reader, closeAll func(), idleTimeout time.Duration) error {
+	var (
+		last    = time.Now().UnixNano()
+		errs    = make(chan error, 2)
+		done    = make(chan struct{})
+		once    sync.Once
+		idle    int32
+		closeUp = func() { once.Do(closeAll) }
+	)
+
+	go func() {
+		_, err := io.Copy(activityWriter{target, &last}, clientReader)
+		if cw, ok := target.(closeWriter); ok && err == nil {
+			err = cw.CloseWrite()
+		} else {
+			closeUp()
+		}
+		errs <- err
+	}()
+
+	go func() {
+		_, err := io.Copy(activityWriter{client, &last}, target)
+		closeUp()
+		errs <- err
+	}()
+
+	if idleTimeout > 0 {
+		go func() {
+			ticker := time.NewTicker(idleTimeout / 4)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-done:
+					return
+				case now := <-ticker.C:
+					if now.Sub(time.Unix(0, atomic.LoadInt64(&last))) >= idleTimeout {
+						atomic.StoreInt32(&idle, 1)
+						closeUp()
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	var err error
+	for i := 0; i < 2; i++ {
+		if e := <-errs; err == nil && !isClosedErr(e) {
+			err = e
+		}
+	}
+	close(done)
+
+	if atomic.LoadInt32(&idle) == 1 {
+		return fmt.Errorf("Idle timeout of %v reached", idleTimeout)
+	}
+
+	return err
+}
+
+// isClosedErr reports errors caused by closing the other side of the proxy
+func isClosedErr(err error) bool {
+	if err == nil || err == io.ErrClosedPipe {
+		return true
+	}
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
@@ -7,8 +7,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
-
-	"github.com/derlaft/connectstream"
+	"time"
 )
 
 const (
@@ -32,10 +31,40 @@ const (
 	addrTypeNotSupported
 )
 
+// Reply codes a ReplyError may choose
+const (
+	ReplyServerFailure      = serverFailure
+	ReplyNotAllowed         = ruleFailure
+	ReplyNetworkUnreachable = networkUnreachable
+	ReplyHostUnreachable    = hostUnreachable
+	ReplyConnectionRefused  = connectionRefused
+)
+
 var (
 	unrecognizedAddrType = fmt.Errorf("Unrecognized address type")
 )
 
+// ReplyError is a dial error that chooses the reply code sent to the client
+type ReplyError interface {
+	error
+	ReplyCode() uint8
+}
+
+// replyCode returns the reply code of a dial error (or of its cause)
+func replyCode(err error) (uint8, bool) {
+	for err != nil {
+		if re, ok := err.(ReplyError); ok {
+			return re.ReplyCode(), true
+		}
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = cause.Cause()
+	}
+	return 0, false
+}
+
 // AddressRewriter is used to rewrite a destination transparently
 type AddressRewriter interface {
 	Rewrite(ctx context.Context, request *Request) (context.Context, *AddrSpec)
@@ -118,14 +147,15 @@ func NewRequest(bufConn io.Reader) (*Request, error) {
 
 // handleRequest is used for request processing after authentication
 func (s *Server) handleRequest(req *Request, conn conn) error {
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	// Resolve the address if we have a FQDN
 	dest := req.DestAddr
 	if dest.FQDN != "" {
 		ctx_, addr, err := s.config.Resolver.Resolve(ctx, dest.FQDN)
 		if err != nil {
-			if err := sendReply(conn, hostUnreachable, nil); err != nil {
+			if err := replyTo(req, conn, hostUnreachable, nil); err != nil {
 				return fmt.Errorf("Failed to send reply: %v", err)
 			}
 			return fmt.Errorf("Failed to resolve destination '%v': %v", dest.FQDN, err)
@@ -149,7 +179,7 @@ func (s *Server) handleRequest(req *Request, conn conn) error {
 	case AssociateCommand:
 		return s.handleAssociate(ctx, conn, req)
 	default:
-		if err := sendReply(conn, commandNotSupported, nil); err != nil {
+		if err := replyTo(req, conn, commandNotSupported, nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
 		return fmt.Errorf("Unsupported command: %v", req.Command)
@@ -160,7 +190,7 @@ func (s *Server) handleRequest(req *Request, conn conn) error {
 func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) error {
 	// Check if this is allowed
 	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
+		if err := replyTo(req, conn, ruleFailure, nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
 		return fmt.Errorf("Connect to %v blocked by rules", req.DestAddr)
@@ -171,20 +201,27 @@ func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) err
 	// Attempt to connect
 	dial := s.config.Dial
 	if dial == nil {
-		dial = func(ctx context.Context, net_, addr string) (net.Conn, error) {
-			return net.Dial(net_, addr)
-		}
+		dial = new(net.Dialer).DialContext
 	}
+
+	// Stop dialing if the client goes away
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stopWatch := watchDisconnect(conn, req.bufConn, cancel)
 	target, err := dial(ctx, "tcp", req.realDestAddr.Address())
+	stopWatch()
 	if err != nil {
 		msg := err.Error()
 		resp := hostUnreachable
-		if strings.Contains(msg, "refused") {
+		if code, ok := replyCode(err); ok {
+			resp = code
+		} else if strings.Contains(msg, "refused") {
 			resp = connectionRefused
 		} else if strings.Contains(msg, "network is unreachable") {
 			resp = networkUnreachable
 		}
-		if err := sendReply(conn, resp, nil); err != nil {
+		if err := replyTo(req, conn, resp, nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
 		return fmt.Errorf("Connect to %v failed: %v", req.DestAddr, err)
@@ -195,29 +232,58 @@ func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) err
 	}()
 
 	// Send success
-	if err := sendReply(conn, successReply, addrSpecFromNetAddr(target.LocalAddr())); err != nil {
+	if err := replyTo(req, conn, successReply, addrSpecFromNetAddr(target.LocalAddr())); err != nil {
 		return fmt.Errorf("Failed to send reply: %v", err)
 	}
 
-	rwcloser := struct {
-		io.Reader
-		io.Writer
-		io.Closer
-	}{
-		Reader: req.bufConn,
-		Writer: conn,
-		Closer: conn,
+	// Start proxying
+	closeAll := func() {
+		target.Close()
+		conn.Close()
+	}
+	return proxy(target, conn, req.bufConn, closeAll, s.config.IdleTimeout)
+}
+
+// watchDisconnect calls cancel if the client connection fails before stop is called.
+// A plain EOF is a client that half-closed after its request and still waits for the
+// reply, so it does not cancel. Data sent by the client in the meantime stays buffered in bufConn.
+func watchDisconnect(conn conn, bufConn io.Reader, cancel func()) (stop func()) {
+	deadliner, ok := conn.(interface {
+		SetReadDeadline(time.Time) error
+	})
+	if !ok {
+		return func() {}
 	}
 
-	// Start proxying
-	return connectstream.Connect(target, rwcloser)
+	peeker, ok := bufConn.(interface {
+		Peek(int) ([]byte, error)
+	})
+	if !ok {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := peeker.Peek(1)
+		if netErr, ok := err.(net.Error); err != nil && err != io.EOF && !(ok && netErr.Timeout()) {
+			cancel()
+		}
+	}()
+
+	return func() {
+		// Interrupt the pending peek and wait for it before the conn is used again
+		deadliner.SetReadDeadline(time.Now())
+		<-done
+		deadliner.SetReadDeadline(time.Time{})
+	}
 }
 
 // handleBind is used to handle a connect command
 func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error {
 	// Check if this is allowed
 	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
+		if err := replyTo(req, conn, ruleFailure, nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
 		return fmt.Errorf("Bind to %v blocked by rules", req.DestAddr)
@@ -226,7 +292,7 @@ func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error
 	}
 
 	// TODO: Support bind
-	if err := sendReply(conn, commandNotSupported, nil); err != nil {
+	if err := replyTo(req, conn, commandNotSupported, nil); err != nil {
 		return fmt.Errorf("Failed to send reply: %v", err)
 	}
 	return nil
@@ -236,7 +302,7 @@ func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error
 func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) error {
 	// Check if this is allowed
 	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
+		if err := replyTo(req, conn, ruleFailure, nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
 		return fmt.Errorf("Associate to %v blocked by rules", req.DestAddr)
@@ -245,7 +311,7 @@ func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) e
 	}
 
 	// TODO: Support associate
-	if err := sendReply(conn, commandNotSupported, nil); err != nil {
+	if err := replyTo(req, conn, commandNotSupported, nil); err != nil {
 		return fmt.Errorf("Failed to send reply: %v", err)
 	}
 	return nil
@@ -307,7 +373,21 @@ func addrSpecFromNetAddr(addr net.Addr) *AddrSpec {
 	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
 		return &AddrSpec{IP: tcpAddr.IP, Port: tcpAddr.Port}
 	}
-	return nil
+
+	// Other addresses are used if they are an IP with a port
+	if addr == nil {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	portNum, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &AddrSpec{IP: ip, Port: portNum}
 }
 
 // sendReply is used to send a reply message
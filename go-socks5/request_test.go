@@ -9,6 +9,9 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 type MockConn struct {
@@ -32,17 +35,20 @@ func TestRequest_Connect(t *testing.T) {
 	go func() {
 		conn, err := l.Accept()
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		defer conn.Close()
 
 		buf := make([]byte, 4)
 		if _, err := io.ReadAtLeast(conn, buf, 4); err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 
 		if !bytes.Equal(buf, []byte("ping")) {
-			t.Fatalf("bad: %v", buf)
+			t.Errorf("bad: %v", buf)
+			return
 		}
 		conn.Write([]byte("pong"))
 	}()
@@ -107,17 +113,20 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 	go func() {
 		conn, err := l.Accept()
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		defer conn.Close()
 
 		buf := make([]byte, 4)
 		if _, err := io.ReadAtLeast(conn, buf, 4); err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 
 		if !bytes.Equal(buf, []byte("ping")) {
-			t.Fatalf("bad: %v", buf)
+			t.Errorf("bad: %v", buf)
+			return
 		}
 		conn.Write([]byte("pong"))
 	}()
@@ -167,3 +176,168 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 		t.Fatalf("bad: %v %v", out, expected)
 	}
 }
+
+// serveOneTCP serves a single TCP connection and returns its client end
+func serveOneTCP(t *testing.T, s *Server) *net.TCPConn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err == nil {
+			s.ServeConn(conn)
+		}
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := client.SetDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := []byte{5, 1, NoAuth, 5, 1, 0, 1, 127, 0, 0, 1, 0, 80}
+	if _, err := client.Write(req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out := make([]byte, 2)
+	if _, err := io.ReadFull(client, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	return client.(*net.TCPConn)
+}
+
+func TestRequest_Connect_ClientGone(t *testing.T) {
+	dialing := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	// Make server with a dial that only ends when cancelled
+	s, err := New(&Config{
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			close(dialing)
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client := serveOneTCP(t, s)
+
+	// Reset the connection while the target is being dialed
+	<-dialing
+	client.SetLinger(0)
+	client.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatalf("dial was not cancelled")
+	}
+}
+
+func TestRequest_Connect_HalfClose(t *testing.T) {
+	// Make server with a slow dial
+	s, err := New(&Config{
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(100 * time.Millisecond):
+			}
+			target, _ := net.Pipe()
+			return target, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client := serveOneTCP(t, s)
+	defer client.Close()
+
+	// The client is done sending, but still waits for the reply
+	if err := client.CloseWrite(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out := make([]byte, 10)
+	if _, err := io.ReadFull(client, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[1] != successReply {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+type stringAddr string
+
+func (a stringAddr) Network() string { return "overlay" }
+func (a stringAddr) String() string  { return string(a) }
+
+func TestAddrSpecFromNetAddr(t *testing.T) {
+	spec := addrSpecFromNetAddr(stringAddr("[fd00::2]:4041"))
+	if spec == nil || !spec.IP.Equal(net.ParseIP("fd00::2")) || spec.Port != 4041 {
+		t.Fatalf("bad addr spec: %v", spec)
+	}
+
+	for _, addr := range []net.Addr{nil, stringAddr("pipe"), stringAddr("team1.node:4041")} {
+		if spec := addrSpecFromNetAddr(addr); spec != nil {
+			t.Fatalf("unexpected addr spec for %v: %v", addr, spec)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := sendReply(&buf, successReply, spec); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out := buf.Bytes(); len(out) != 22 || out[3] != ipv6Address {
+		t.Fatalf("bad reply: %v", out)
+	}
+}
+
+type maintenanceError struct{}
+
+func (maintenanceError) Error() string    { return "service is in maintenance" }
+func (maintenanceError) ReplyCode() uint8 { return ReplyServerFailure }
+
+type wrappedError struct{ cause error }
+
+func (e wrappedError) Error() string { return "port 80: " + e.cause.Error() }
+func (e wrappedError) Cause() error  { return e.cause }
+
+func TestRequest_Connect_ReplyError(t *testing.T) {
+	s := &Server{config: &Config{
+		Rules:    PermitAll(),
+		Resolver: DNSResolver{},
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, wrappedError{maintenanceError{}}
+		},
+	}}
+
+	// the reply code of the wrapped cause is used
+	req, err := NewRequest(bytes.NewBuffer([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80}))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	resp := &MockConn{}
+	if err := s.handleRequest(req, resp); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	if out := resp.Bytes(); len(out) < 2 || out[1] != ReplyServerFailure {
+		t.Fatalf("bad reply: %v", out)
+	}
+}
@@ -0,0 +1,153 @@
+package socks5
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	socks4Version = uint8(4)
+
+	// reply version and codes of SOCKS4
+	socks4ReplyVersion = uint8(0)
+	socks4Granted      = uint8(90)
+	socks4Rejected     = uint8(91)
+
+	// maximum length of SOCKS4 user id and SOCKS4a hostname
+	socks4MaxString = 255
+)
+
+// NewRequest4 creates a new Request from a SOCKS4 or SOCKS4a connection.
+// The version byte is expected to be already consumed.
+func NewRequest4(bufConn io.Reader) (*Request, error) {
+	// Read command, port and address
+	header := []byte{0, 0, 0, 0, 0, 0, 0}
+	if _, err := io.ReadAtLeast(bufConn, header, len(header)); err != nil {
+		return nil, fmt.Errorf("Failed to get command: %v", err)
+	}
+
+	dest := &AddrSpec{
+		Port: (int(header[1]) << 8) | int(header[2]),
+		IP:   net.IP(header[3:7]),
+	}
+
+	userID, err := readString4(bufConn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read user id: %v", err)
+	}
+
+	// SOCKS4a: address 0.0.0.x (x != 0) means a hostname follows
+	if dest.IP[0] == 0 && dest.IP[1] == 0 && dest.IP[2] == 0 && dest.IP[3] != 0 {
+		fqdn, err := readString4(bufConn)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read hostname: %v", err)
+		}
+		if fqdn == "" {
+			return nil, fmt.Errorf("Empty SOCKS4a hostname")
+		}
+		dest.FQDN = fqdn
+		dest.IP = nil
+	}
+
+	request := &Request{
+		Version:  socks4Version,
+		Command:  header[0],
+		DestAddr: dest,
+		AuthContext: &AuthContext{
+			Method:  NoAuth,
+			Payload: map[string]string{"UserID": userID},
+		},
+		bufConn: bufConn,
+	}
+
+	return request, nil
+}
+
+// readString4 reads a null-terminated string
+func readString4(r io.Reader) (string, error) {
+	var (
+		buf []byte
+		b   = []byte{0}
+	)
+
+	for {
+		if _, err := io.ReadAtLeast(r, b, 1); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		if len(buf) == socks4MaxString {
+			return "", fmt.Errorf("String is too long")
+		}
+		buf = append(buf, b[0])
+	}
+}
+
+// serveConn4 is used to serve a SOCKS4 connection after the version byte
+func (s *Server) serveConn4(conn net.Conn, bufConn *bufio.Reader) error {
+	// SOCKS4 has no way to authenticate, so it is only allowed in "auth-less" mode
+	if _, ok := s.authMethods[NoAuth]; !ok {
+		if err := sendReply4(conn, socks4Rejected, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		err := fmt.Errorf("SOCKS4 is not allowed when authentication is required")
+		s.config.Logger.Printf("[ERR] socks: %v", err)
+		return err
+	}
+
+	request, err := NewRequest4(bufConn)
+	if err != nil {
+		if err := sendReply4(conn, socks4Rejected, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Failed to read destination address: %v", err)
+	}
+	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		request.RemoteAddr = &AddrSpec{IP: client.IP, Port: client.Port}
+	}
+
+	// Handshake is done
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("Failed to clear deadline: %v", err)
+	}
+
+	// Process the client request
+	if err := s.handleRequest(request, conn); err != nil {
+		err = fmt.Errorf("Failed to handle request: %v", err)
+		s.config.Logger.Printf("[ERR] socks: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// sendReply4 is used to send a SOCKS4 reply message
+func sendReply4(w io.Writer, resp uint8, addr *AddrSpec) error {
+	msg := make([]byte, 8)
+	msg[0] = socks4ReplyVersion
+	msg[1] = resp
+
+	if addr != nil && addr.IP.To4() != nil {
+		msg[2] = byte(addr.Port >> 8)
+		msg[3] = byte(addr.Port & 0xff)
+		copy(msg[4:], addr.IP.To4())
+	}
+
+	_, err := w.Write(msg)
+	return err
+}
+
+// replyTo sends a reply in the protocol version of the request
+func replyTo(req *Request, w io.Writer, resp uint8, addr *AddrSpec) error {
+	if req.Version != socks4Version {
+		return sendReply(w, resp, addr)
+	}
+	if resp == successReply {
+		return sendReply4(w, socks4Granted, addr)
+	}
+	return sendReply4(w, socks4Rejected, addr)
+}
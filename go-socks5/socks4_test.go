@@ -0,0 +1,175 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type staticResolver map[string]net.IP
+
+func (r staticResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	if ip, ok := r[name]; ok {
+		return ctx, ip, nil
+	}
+	return ctx, nil, io.EOF
+}
+
+// pingServer accepts one connection, expects "ping" and answers "pong"
+func pingServer(t *testing.T) (*net.TCPAddr, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		defer l.Close()
+
+		conn, err := l.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 4)
+		if _, err := io.ReadAtLeast(conn, buf, 4); err != nil {
+			errs <- err
+			return
+		}
+
+		if !bytes.Equal(buf, []byte("ping")) {
+			errs <- io.ErrUnexpectedEOF
+			return
+		}
+		_, err = conn.Write([]byte("pong"))
+		errs <- err
+	}()
+
+	return l.Addr().(*net.TCPAddr), errs
+}
+
+func socks4Exchange(t *testing.T, conf *Config, req []byte, expected []byte) {
+	serv, err := New(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go serv.ServeConn(server)
+
+	err = client.SetDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := client.Write(req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out := make([]byte, len(expected))
+	if _, err := io.ReadAtLeast(client, out, len(out)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Ignore the bound port
+	out[2] = 0
+	out[3] = 0
+
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v %v", out, expected)
+	}
+}
+
+func TestSOCKS4_Connect(t *testing.T) {
+	lAddr, errs := pingServer(t)
+
+	port := []byte{0, 0}
+	binary.BigEndian.PutUint16(port, uint16(lAddr.Port))
+
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{4, 1})
+	req.Write(port)
+	req.Write([]byte{127, 0, 0, 1})
+	req.Write([]byte("user\x00"))
+	req.Write([]byte("ping"))
+
+	socks4Exchange(t, &Config{
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}, req.Bytes(), []byte{0, 90, 0, 0, 127, 0, 0, 1, 'p', 'o', 'n', 'g'})
+
+	if err := <-errs; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSOCKS4a_Connect(t *testing.T) {
+	lAddr, errs := pingServer(t)
+
+	port := []byte{0, 0}
+	binary.BigEndian.PutUint16(port, uint16(lAddr.Port))
+
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{4, 1})
+	req.Write(port)
+	req.Write([]byte{0, 0, 0, 1})
+	req.Write([]byte("\x00team2\x00"))
+	req.Write([]byte("ping"))
+
+	socks4Exchange(t, &Config{
+		Resolver: staticResolver{"team2": net.IPv4(127, 0, 0, 1)},
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+	}, req.Bytes(), []byte{0, 90, 0, 0, 127, 0, 0, 1, 'p', 'o', 'n', 'g'})
+
+	if err := <-errs; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSOCKS4_RuleFail(t *testing.T) {
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{4, 1, 0, 80, 127, 0, 0, 1, 0})
+
+	socks4Exchange(t, &Config{
+		Rules:  PermitNone(),
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}, req.Bytes(), []byte{0, 91, 0, 0, 0, 0, 0, 0})
+}
+
+func TestSOCKS4_AuthRequired(t *testing.T) {
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{4, 1, 0, 80, 127, 0, 0, 1, 0})
+
+	socks4Exchange(t, &Config{
+		Credentials: StaticCredentials{"foo": "bar"},
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+	}, req.Bytes(), []byte{0, 91, 0, 0, 0, 0, 0, 0})
+}
+
+func TestNewRequest4(t *testing.T) {
+	req, err := NewRequest4(bytes.NewBuffer([]byte("\x01\x00\x50\x00\x00\x00\x07bob\x00example.org\x00")))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if req.Version != socks4Version || req.Command != ConnectCommand {
+		t.Fatalf("bad request: %+v", req)
+	}
+
+	if req.DestAddr.FQDN != "example.org" || req.DestAddr.IP != nil || req.DestAddr.Port != 80 {
+		t.Fatalf("bad address: %v", req.DestAddr)
+	}
+
+	if req.AuthContext.Payload["UserID"] != "bob" {
+		t.Fatalf("bad user id: %v", req.AuthContext.Payload)
+	}
+}
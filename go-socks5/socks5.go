@@ -6,12 +6,26 @@ import (
 	"log"
 	"net"
 	"os"
+	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 )
 
 const (
 	socks5Version = uint8(5)
+
+	// refuseTimeout limits refusing a connection if HandshakeTimeout is not set
+	refuseTimeout = time.Second * 5
+	// shutdownPollInterval is how often Shutdown checks for active connections
+	shutdownPollInterval = time.Millisecond * 50
+)
+
+var (
+	// ErrServerClosed is returned by Serve and ServeConn after Shutdown
+	ErrServerClosed = fmt.Errorf("Server closed")
+	// ErrTooManyConns is returned by ServeConn when MaxConns is reached
+	ErrTooManyConns = fmt.Errorf("Too many connections")
 )
 
 // Config is used to setup and configure a Server
@@ -48,6 +62,18 @@ type Config struct {
 
 	// Optional function for dialing out
 	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// HandshakeTimeout limits the version, auth and request phases.
+	// Zero means no limit.
+	HandshakeTimeout time.Duration
+
+	// IdleTimeout closes proxied connections with no traffic in both directions.
+	// Zero means no limit.
+	IdleTimeout time.Duration
+
+	// MaxConns limits the number of concurrently served connections,
+	// connections above the limit are refused. Zero means no limit.
+	MaxConns int
 }
 
 // Server is reponsible for accepting connections and handling
@@ -55,6 +81,11 @@ type Config struct {
 type Server struct {
 	config      *Config
 	authMethods map[uint8]Authenticator
+
+	lock      sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
 }
 
 // New creates a new Server and potentially returns an error
@@ -107,19 +138,152 @@ func (s *Server) ListenAndServe(network, addr string) error {
 
 // Serve is used to serve connections from a listener
 func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
 			return err
 		}
 		go s.ServeConn(conn)
 	}
+}
+
+// Shutdown stops accepting new connections and waits for the active ones
+// to finish. When ctx expires, the remaining connections are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.lock.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		s.lock.Lock()
+		active := len(s.conns)
+		s.lock.Unlock()
+
+		if active == 0 {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.lock.Lock()
+			for conn := range s.conns {
+				conn.Close()
+			}
+			s.lock.Unlock()
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+// trackListener adds or removes an active listener
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+
+	if s.closed {
+		return false
+	}
+
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+// trackConn adds an active connection if the server is open and below MaxConns
+func (s *Server) trackConn(conn net.Conn) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return ErrServerClosed
+	}
+
+	if s.config.MaxConns > 0 && len(s.conns) >= s.config.MaxConns {
+		return ErrTooManyConns
+	}
+
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
 	return nil
 }
 
+func (s *Server) untrackConn(conn net.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.conns, conn)
+}
+
+// refuse tells the client the connection can not be served
+func (s *Server) refuse(conn net.Conn) {
+	timeout := s.config.HandshakeTimeout
+	if timeout == 0 {
+		timeout = refuseTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	bufConn := bufio.NewReader(conn)
+	version := []byte{0}
+	if _, err := bufConn.Read(version); err != nil {
+		return
+	}
+
+	switch version[0] {
+	case socks5Version:
+		if _, err := readMethods(bufConn); err == nil {
+			noAcceptableAuth(conn)
+		}
+	case socks4Version:
+		sendReply4(conn, socks4Rejected, nil)
+	}
+}
+
 // ServeConn is used to serve a single connection.
 func (s *Server) ServeConn(conn net.Conn) error {
 	defer conn.Close()
+
+	if err := s.trackConn(conn); err != nil {
+		s.refuse(conn)
+		s.config.Logger.Printf("[ERR] socks: Refused connection from %v: %v", conn.RemoteAddr(), err)
+		return err
+	}
+	defer s.untrackConn(conn)
+
+	// Limit the handshake, the deadline is cleared once the request is read
+	if s.config.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.config.HandshakeTimeout))
+	}
+
 	bufConn := bufio.NewReader(conn)
 
 	// Read the version byte
@@ -130,7 +294,11 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	}
 
 	// Ensure we are compatible
-	if version[0] != socks5Version {
+	switch version[0] {
+	case socks5Version:
+	case socks4Version:
+		return s.serveConn4(conn, bufConn)
+	default:
 		err := fmt.Errorf("Unsupported SOCKS version: %v", version)
 		s.config.Logger.Printf("[ERR] socks: %v", err)
 		return err
@@ -158,6 +326,11 @@ func (s *Server) ServeConn(conn net.Conn) error {
 		request.RemoteAddr = &AddrSpec{IP: client.IP, Port: client.Port}
 	}
 
+	// Handshake is done
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("Failed to clear deadline: %v", err)
+	}
+
 	// Process the client request
 	if err := s.handleRequest(request, conn); err != nil {
 		err = fmt.Errorf("Failed to handle request: %v", err)
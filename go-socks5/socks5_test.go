@@ -9,6 +9,8 @@ import (
 	"os"
 	"testing"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 func TestSOCKS5_Connect(t *testing.T) {
@@ -20,17 +22,20 @@ func TestSOCKS5_Connect(t *testing.T) {
 	go func() {
 		conn, err := l.Accept()
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		defer conn.Close()
 
 		buf := make([]byte, 4)
 		if _, err := io.ReadAtLeast(conn, buf, 4); err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 
 		if !bytes.Equal(buf, []byte("ping")) {
-			t.Fatalf("bad: %v", buf)
+			t.Errorf("bad: %v", buf)
+			return
 		}
 		conn.Write([]byte("pong"))
 	}()
@@ -53,7 +58,8 @@ func TestSOCKS5_Connect(t *testing.T) {
 	// Start listening
 	go func() {
 		if err := serv.ListenAndServe("tcp", "127.0.0.1:12365"); err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 	}()
 	time.Sleep(10 * time.Millisecond)
@@ -111,3 +117,203 @@ func TestSOCKS5_Connect(t *testing.T) {
 		t.Fatalf("bad: %v", out)
 	}
 }
+
+// noAuthHandshake negotiates "No Auth" on a client connection
+func noAuthHandshake(t *testing.T, conn net.Conn) {
+	if _, err := conn.Write([]byte{socks5Version, 1, NoAuth}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out := make([]byte, 2)
+	if _, err := io.ReadAtLeast(conn, out, len(out)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, []byte{socks5Version, NoAuth}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestSOCKS5_Shutdown(t *testing.T) {
+	serv, err := New(&Config{
+		HandshakeTimeout: time.Minute,
+		Logger:           log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serv.Serve(l)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	noAuthHandshake(t, conn)
+
+	// The connection is still active, so it is closed after the timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := serv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("bad: %v", err)
+	}
+
+	if err := <-serveErr; err != ErrServerClosed {
+		t.Fatalf("bad: %v", err)
+	}
+
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("bad: %v", err)
+	}
+
+	if err := serv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := serv.Serve(l); err != ErrServerClosed {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestSOCKS5_HandshakeTimeout(t *testing.T) {
+	serv, err := New(&Config{
+		HandshakeTimeout: 50 * time.Millisecond,
+		Logger:           log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serv.ServeConn(server)
+	}()
+
+	select {
+	case err := <-serveErr:
+		if err == nil {
+			t.Fatalf("expected timeout")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("handshake did not time out")
+	}
+}
+
+func TestSOCKS5_MaxConns(t *testing.T) {
+	serv, err := New(&Config{
+		MaxConns: 1,
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Occupy the only slot
+	first, server := net.Pipe()
+	defer first.Close()
+	go serv.ServeConn(server)
+
+	err = first.SetDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	noAuthHandshake(t, first)
+
+	// The next client is refused
+	second, server := net.Pipe()
+	defer second.Close()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serv.ServeConn(server)
+	}()
+
+	err = second.SetDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := second.Write([]byte{socks5Version, 1, NoAuth}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out := make([]byte, 2)
+	if _, err := io.ReadAtLeast(second, out, len(out)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, []byte{socks5Version, noAcceptable}) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	if err := <-serveErr; err != ErrTooManyConns {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestSOCKS5_IdleTimeout(t *testing.T) {
+	// A target that never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	serv, err := New(&Config{
+		IdleTimeout: 100 * time.Millisecond,
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go serv.ServeConn(server)
+
+	err = client.SetDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	noAuthHandshake(t, client)
+
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1})
+
+	port := []byte{0, 0}
+	binary.BigEndian.PutUint16(port, uint16(lAddr.Port))
+	req.Write(port)
+
+	if _, err := client.Write(req.Bytes()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out := make([]byte, 10)
+	if _, err := io.ReadAtLeast(client, out, len(out)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[1] != successReply {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// The proxy closes the connection instead of the deadline expiring
+	if _, err := client.Read(out); err != io.EOF {
+		t.Fatalf("bad: %v", err)
+	}
+}
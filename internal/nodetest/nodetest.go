@@ -0,0 +1,31 @@
+// Package nodetest helps tests to set up members of a game network
+package nodetest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"github.com/derlaft/pe2pectf/common"
+	core "github.com/libp2p/go-libp2p-core"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+// Member generates keys of a network member
+func Member(t *testing.T, name, addr string) (*common.CryptoSettings, core.PeerID, common.Member) {
+
+	key, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	assert.NoError(t, err)
+
+	onionKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	id, err := peer.IDFromPrivateKey(key)
+	assert.NoError(t, err)
+
+	return &common.CryptoSettings{Key: key, OnionKey: *onionKey}, id,
+		common.Member{ID: name, Address: addr, OnionKey: onionKey.PublicKey}
+}
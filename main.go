@@ -4,8 +4,11 @@ import (
 	"context"
 	"flag"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/derlaft/pe2pectf/common"
+	"github.com/derlaft/pe2pectf/node"
 
 	golog "github.com/ipfs/go-log"
 	gologging "github.com/whyrusleeping/go-logging"
@@ -13,16 +16,41 @@ import (
 
 var log = golog.Logger("pe2pe_main") //nolint:gochecknoglobals
 
+// shutdownTimeout is how long active proxy connections may finish on exit
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 
-	var settings = new(common.Settings)
+	var opts node.Options
 
 	// service-related settings
-	flag.StringVar(&settings.ListenAddr, "listen-relay", "0.0.0.0:4242", "Listen on (relay)")
-	flag.StringVar(&settings.ProxyAddr, "listen-proxy", "0.0.0.0:9050", "Listen on (socks5 proxy")
-	flag.StringVar(&settings.ExitNodeConfig, "exit-node-config", "", "Configuration file with service mappings")
-	flag.StringVar(&settings.NetworkConfig, "network-config", "", "Configuration file with network map")
-	flag.StringVar(&settings.CryptoConfig, "crypto-config", "", "Configuration file with client private crypto keys")
+	flag.StringVar(&opts.ListenAddr, "listen-relay", "0.0.0.0:4242", "Listen on (relay), comma-separated host:port pairs or multiaddrs")
+	flag.StringVar(&opts.AnnounceAddr, "announce-relay", "", "Announce these relay addrs to other nodes instead of the listen ones (multiaddrs like /dns4/relay.example/tcp/4242)")
+	flag.StringVar(&opts.ProxyAddr, "listen-proxy", "0.0.0.0:9050", "Listen on (socks5 proxy")
+	flag.BoolVar(&opts.BlockSelf, "block-self", false, "Refuse proxy requests to game addresses of own team")
+	flag.StringVar(&opts.ProxyUsersConfig, "proxy-users", "", "Configuration file with proxy users and their policies")
+	flag.StringVar(&opts.LightNode, "light-node", "", "Run as a light client of this team node (multiaddr with /ipfs/ peer ID)")
+	flag.StringVar(&opts.LightUsersConfig, "light-users", "", "Configuration file with light clients (proxy users with PeerID) served by this node")
+	flag.StringVar(&opts.ProxyConfig, "proxy-config", "", "Configuration file with additional proxy listeners and their policies")
+	flag.DurationVar(&opts.ProxyHandshakeTimeout, "proxy-handshake-timeout", 10*time.Second, "Close proxy clients that do not finish the handshake in time (0 - no limit)")
+	flag.DurationVar(&opts.ProxyIdleTimeout, "proxy-idle-timeout", 0, "Close proxied connections without traffic for this long (0 - no limit)")
+	flag.IntVar(&opts.ProxyMaxConns, "proxy-max-conns", 0, "Maximum amount of concurrent proxy connections (0 - unlimited)")
+	flag.StringVar(&opts.TunDevice, "tun", "", "Create TUN device with this name (VPN mode)")
+	flag.StringVar(&opts.TunAddr, "tun-addr", "", "Address of TUN device with game subnet prefix (e.g. 10.0.0.254/24)")
+	flag.StringVar(&opts.ForwardConfig, "forward-config", "", "Configuration file with static port forwards")
+	flag.StringVar(&opts.ExitNodeConfig, "exit-node-config", "", "Configuration file with service mappings")
+	flag.DurationVar(&opts.ExitNodeWatchInterval, "exit-node-watch", 2*time.Second, "Reload the service mappings when the file changes, checked this often (0 - on SIGHUP only)")
+	flag.BoolVar(&opts.ExitNodeDrain, "exit-node-drain", false, "Let streams of removed or changed service mappings finish on reload instead of closing them")
+	flag.StringVar(&opts.CaptureDir, "capture-dir", "", "Record streams of mapped services into capture files in this dir (per service)")
+	flag.StringVar(&opts.CaptureFormat, "capture-format", "pcapng", "Capture file format: pcapng (stream IDs as packet comments) or pcap")
+	flag.Int64Var(&opts.CaptureFileSize, "capture-file-size", 64<<20, "Rotate capture files at this size in bytes")
+	flag.StringVar(&opts.AnalyzerAddr, "analyzer-listen", "", "Index streams of mapped services, alert on leaked flags and serve the query API on this addr")
+	flag.StringVar(&opts.FlagPattern, "flag-regexp", "[A-Z0-9]{31}=", "Regular expression matching flags in service responses")
+	flag.IntVar(&opts.AnalyzerHistory, "analyzer-history", 1000, "Streams kept per service by the analyzer")
+	flag.StringVar(&opts.NetworkConfig, "network-config", "", "Configuration file with network map")
+	flag.StringVar(&opts.NetworkURL, "network-url", "", "Fetch newer signed network maps from this URL (signature at the URL with .sig)")
+	flag.DurationVar(&opts.NetworkUpdateInterval, "network-update-interval", time.Minute, "How often to check for newer signed network maps (0 - never)")
+	flag.StringVar(&opts.CryptoConfig, "crypto-config", "", "Configuration file with client private crypto keys")
 
 	// global debug mode
 	debug := flag.Bool("debug", false, "enable verbose logging")
@@ -30,7 +58,7 @@ func main() {
 	// parse cli options
 	flag.Parse()
 
-	if settings.CryptoConfig == "" || settings.NetworkConfig == "" {
+	if opts.CryptoConfig == "" || (opts.NetworkConfig == "" && opts.LightNode == "") {
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -43,38 +71,43 @@ func main() {
 
 	ctx := context.Background()
 
-	err := settings.Load()
+	n, err := node.New(opts)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Debugf("Loaded settings: %+v\n", settings)
-	log.Debugf("Network settings: %+v\n", settings.Network)
-
-	// Make a host that listens on the given multiaddress
-	c, err := common.CreateHost(ctx, settings)
+	err = n.Start(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = c.ConnectDHT(ctx)
-	if err != nil {
-		log.Fatal(err)
-	}
+	log.Infof("listening for connections (addr is %v)", n.Addr())
 
-	err = c.StartRelay()
-	if err != nil {
-		log.Fatal(err)
-	}
+	// reload configs on SIGHUP, dump proxy user counters and shadow stats on SIGUSR1,
+	// stop gracefully on SIGINT/SIGTERM, hang forever otherwise
+	var signals = make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGINT, syscall.SIGTERM)
+
+	for sig := range signals {
+
+		if sig == syscall.SIGUSR1 {
+			n.LogStats()
+			continue
+		}
 
-	// start proxy if requested
-	if settings.ProxyAddr != "" {
-		err = c.StartProxy()
+		if sig == syscall.SIGINT || sig == syscall.SIGTERM {
+			stopCtx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+			err := n.Shutdown(stopCtx)
+			cancel()
+			if err != nil {
+				log.Errorf("Proxy connections were interrupted: %v", err)
+			}
+			return
+		}
+
+		err := n.Reload()
 		if err != nil {
-			log.Fatal(err)
+			log.Error(err)
 		}
 	}
-
-	log.Infof("listening for connections (addr is %v)", c.HostAddress())
-	select {} // hang forever
 }
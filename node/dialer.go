@@ -0,0 +1,75 @@
+package node
+
+import (
+	"context"
+	"net"
+
+	"github.com/derlaft/pe2pectf/common"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pkg/errors"
+)
+
+// Dialer opens connections to game targets like "team2:4041" or "10.0.0.2:4041"
+type Dialer struct {
+	// onion path length (0 - default)
+	Hops int
+	// connections of different groups never share relays (empty - no isolation)
+	Isolation string
+	// first relay of the onion path if it is usable (empty - any)
+	EntryRelay peer.ID
+	// prove access to owner-only and organizer-only services
+	// (exits can tell such connections apart, set it for restricted services only)
+	ExitAuth bool
+
+	node *Node
+}
+
+// Dial connects to the game target
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the game target using the provided context
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+
+	c, err := d.node.running()
+	if err != nil {
+		return nil, err
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing addr %v", addr)
+	}
+
+	// member names are resolved to game addresses
+	if net.ParseIP(host) == nil {
+		var ip net.IP
+		ctx, ip, err = c.Resolve(ctx, host)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolving %v", host)
+		}
+
+		if ip != nil {
+			addr = net.JoinHostPort(ip.String(), port)
+		}
+	}
+
+	if d.Hops > 0 {
+		ctx = common.WithHops(ctx, d.Hops)
+	}
+
+	if d.Isolation != "" {
+		ctx = common.WithIsolation(ctx, d.Isolation)
+	}
+
+	if d.EntryRelay != "" {
+		ctx = common.WithEntryRelay(ctx, d.EntryRelay)
+	}
+
+	if d.ExitAuth {
+		ctx = common.WithExitAuth(ctx)
+	}
+
+	return c.Dial(ctx, network, addr)
+}
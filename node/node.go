@@ -0,0 +1,388 @@
+// Package node runs a pe2pectf node embedded in another Go program
+package node
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/derlaft/pe2pectf/common"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pkg/errors"
+)
+
+// Options configure a node, the fields match the command line flags
+type Options struct {
+	// relay listen addrs (comma-separated host:port pairs or multiaddrs)
+	ListenAddr string
+	// relay addrs announced to other nodes (empty - listen addrs)
+	AnnounceAddr string
+
+	// config files
+	NetworkConfig    string
+	CryptoConfig     string
+	ExitNodeConfig   string
+	ForwardConfig    string
+	ProxyConfig      string
+	ProxyUsersConfig string
+	LightUsersConfig string
+
+	// signed network map updates (HTTP URL, how often to check)
+	NetworkURL            string
+	NetworkUpdateInterval time.Duration
+
+	// settings loaded by the embedder are used instead of the config files
+	Network  *common.NetworkSettings
+	Crypto   *common.CryptoSettings
+	ExitNode *common.ExitNodeSettings
+
+	// how often the exit node config is checked for changes (0 - on Reload only),
+	// let streams of changed service mappings finish instead of closing them
+	ExitNodeWatchInterval time.Duration
+	ExitNodeDrain         bool
+
+	// capture dir of service streams (empty - no capture), file format and rotation size
+	CaptureDir      string
+	CaptureFormat   string
+	CaptureFileSize int64
+
+	// analyzer query API addr (empty - no analyzer), flag regexp and streams kept per service
+	AnalyzerAddr    string
+	FlagPattern     string
+	AnalyzerHistory int
+
+	// socks5 proxy listen addr (empty - no proxy)
+	ProxyAddr             string
+	BlockSelf             bool
+	ProxyHandshakeTimeout time.Duration
+	ProxyIdleTimeout      time.Duration
+	ProxyMaxConns         int
+
+	// team node multiaddr of a light client (empty - full node)
+	LightNode string
+
+	// TUN device name and address (empty - no VPN mode)
+	TunDevice string
+	TunAddr   string
+}
+
+// Node is a member of the game network
+type Node struct {
+	settings *common.Settings
+
+	lock   sync.Mutex
+	client *common.Client
+	closed bool
+}
+
+// New validates the options and loads the config files
+func New(opts Options) (*Node, error) {
+
+	settings := &common.Settings{
+		ListenAddr:            opts.ListenAddr,
+		AnnounceAddr:          opts.AnnounceAddr,
+		ProxyAddr:             opts.ProxyAddr,
+		BlockSelf:             opts.BlockSelf,
+		ProxyUsersConfig:      opts.ProxyUsersConfig,
+		ProxyConfig:           opts.ProxyConfig,
+		LightNode:             opts.LightNode,
+		LightUsersConfig:      opts.LightUsersConfig,
+		ProxyHandshakeTimeout: opts.ProxyHandshakeTimeout,
+		ProxyIdleTimeout:      opts.ProxyIdleTimeout,
+		ProxyMaxConns:         opts.ProxyMaxConns,
+		TunDevice:             opts.TunDevice,
+		TunAddr:               opts.TunAddr,
+		ForwardConfig:         opts.ForwardConfig,
+		ExitNodeConfig:        opts.ExitNodeConfig,
+		ExitNode:              opts.ExitNode,
+		ExitNodeWatchInterval: opts.ExitNodeWatchInterval,
+		ExitNodeDrain:         opts.ExitNodeDrain,
+		CaptureDir:            opts.CaptureDir,
+		CaptureFormat:         opts.CaptureFormat,
+		CaptureFileSize:       opts.CaptureFileSize,
+		AnalyzerAddr:          opts.AnalyzerAddr,
+		FlagPattern:           opts.FlagPattern,
+		AnalyzerHistory:       opts.AnalyzerHistory,
+		NetworkConfig:         opts.NetworkConfig,
+		Network:               opts.Network,
+		NetworkURL:            opts.NetworkURL,
+		NetworkUpdateInterval: opts.NetworkUpdateInterval,
+		CryptoConfig:          opts.CryptoConfig,
+		Crypto:                opts.Crypto,
+	}
+
+	if settings.ListenAddr == "" {
+		return nil, errors.New("listen addr not provided")
+	}
+
+	err := settings.Load()
+	if err != nil {
+		return nil, errors.Wrap(err, "loading settings")
+	}
+
+	return &Node{settings: settings}, nil
+}
+
+// Start connects the node to the network and starts the configured services.
+// The libp2p host lives until Close is called or ctx is done.
+func (n *Node) Start(ctx context.Context) error {
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.client != nil || n.closed {
+		return errors.New("node is already started")
+	}
+
+	c, err := common.CreateHost(ctx, n.settings)
+	if err != nil {
+		return errors.Wrap(err, "creating host")
+	}
+
+	err = n.start(ctx, c)
+	if err != nil {
+		_ = c.Close()
+		return err
+	}
+
+	n.client = c
+
+	return nil
+}
+
+func (n *Node) start(ctx context.Context, c *common.Client) error {
+
+	var s = n.settings
+
+	// light clients only talk to their team node
+	if s.LightNode != "" {
+		err := c.ConnectLightNode(ctx)
+		if err != nil {
+			return errors.Wrap(err, "connecting to team node")
+		}
+	} else {
+		err := c.ConnectDHT(ctx)
+		if err != nil {
+			return errors.Wrap(err, "connecting to DHT")
+		}
+
+		err = c.StartRelay()
+		if err != nil {
+			return errors.Wrap(err, "starting relay")
+		}
+
+		err = c.StartNetworkUpdates()
+		if err != nil {
+			return errors.Wrap(err, "starting network map updates")
+		}
+
+		err = c.StartExitNodeWatch()
+		if err != nil {
+			return errors.Wrap(err, "watching exit node config")
+		}
+
+		err = c.StartCapture()
+		if err != nil {
+			return errors.Wrap(err, "starting capture")
+		}
+
+		err = c.StartAnalyzer()
+		if err != nil {
+			return errors.Wrap(err, "starting analyzer")
+		}
+	}
+
+	if s.Proxies != nil {
+		err := c.StartProxy()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.LightUsers != nil {
+		err := c.StartLightService()
+		if err != nil {
+			return errors.Wrap(err, "starting light client service")
+		}
+	}
+
+	if s.TunDevice != "" {
+		err := c.StartTun()
+		if err != nil {
+			return errors.Wrap(err, "starting VPN mode")
+		}
+	}
+
+	if s.Forwards != nil {
+		err := c.StartForwards()
+		if err != nil {
+			return errors.Wrap(err, "starting port forwards")
+		}
+	}
+
+	return nil
+}
+
+// running returns the client of a started node
+func (n *Node) running() (*common.Client, error) {
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.closed {
+		return nil, errors.New("node is closed")
+	}
+
+	if n.client == nil {
+		return nil, errors.New("node is not started")
+	}
+
+	return n.client, nil
+}
+
+// Shutdown stops accepting proxy connections, waits for the active ones until ctx is done
+// and closes the node
+func (n *Node) Shutdown(ctx context.Context) error {
+
+	c, err := n.running()
+	if err != nil {
+		return err
+	}
+
+	err = c.StopProxy(ctx)
+
+	closeErr := n.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Close stops all services and disconnects from the network
+func (n *Node) Close() error {
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.closed {
+		return nil
+	}
+	n.closed = true
+
+	if n.client == nil {
+		return nil
+	}
+
+	return n.client.Close()
+}
+
+// Reload reads the network map, proxy users and service mappings from the disk again
+// (signed network maps are replaced only by newer versions)
+func (n *Node) Reload() error {
+
+	c, err := n.running()
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+
+	for _, reloadErr := range []error{c.ReloadNetwork(), c.ReloadProxyUsers(), c.ReloadExitNode()} {
+		if reloadErr != nil {
+			failed = append(failed, reloadErr.Error())
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+
+	return nil
+}
+
+// ReloadExitNode reads the service mappings from the disk again,
+// streams of changed mappings are closed unless ExitNodeDrain is set
+func (n *Node) ReloadExitNode() error {
+
+	c, err := n.running()
+	if err != nil {
+		return err
+	}
+
+	return c.ReloadExitNode()
+}
+
+// LogStats writes traffic counters of proxy users and shadow stats of services to the log
+func (n *Node) LogStats() {
+
+	c, err := n.running()
+	if err != nil {
+		return
+	}
+
+	c.LogProxyUserStats()
+	c.LogShadowStats()
+}
+
+// ShadowStats returns how the shadow backends of services answered compared to them
+func (n *Node) ShadowStats() map[string]common.ShadowStats {
+
+	c, err := n.running()
+	if err != nil {
+		return nil
+	}
+
+	return c.ShadowStats()
+}
+
+// ID returns the peer ID of a started node
+func (n *Node) ID() peer.ID {
+
+	c, err := n.running()
+	if err != nil {
+		return ""
+	}
+
+	return c.Host.ID()
+}
+
+// Addr returns the multiaddr of a started node
+func (n *Node) Addr() string {
+
+	c, err := n.running()
+	if err != nil {
+		return ""
+	}
+
+	return c.HostAddress()
+}
+
+// Network returns the current network map of a started node
+func (n *Node) Network() *common.NetworkSettings {
+
+	c, err := n.running()
+	if err != nil {
+		return nil
+	}
+
+	return c.Network()
+}
+
+// Listen serves a virtual port of the node in the game network
+func (n *Node) Listen(port int) (net.Listener, error) {
+
+	c, err := n.running()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Listen(port)
+}
+
+// Dialer returns a dialer into the game network
+func (n *Node) Dialer() *Dialer {
+	return &Dialer{node: n}
+}
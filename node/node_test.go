@@ -0,0 +1,165 @@
+package node
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/derlaft/pe2pectf/common"
+	"github.com/derlaft/pe2pectf/internal/nodetest"
+	core "github.com/libp2p/go-libp2p-core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNode(t *testing.T) {
+
+	keys, id, member := nodetest.Member(t, "team1", "10.0.0.1")
+
+	// a service hosted by the node
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer service.Close()
+
+	go func() {
+		conn, err := service.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	n, err := New(Options{
+		ListenAddr: "127.0.0.1:0",
+		Crypto:     keys,
+		ExitNode:   &common.ExitNodeSettings{},
+		Network: &common.NetworkSettings{
+			Nodes: map[core.PeerID]common.Member{id: member},
+		},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	_, err = n.Dialer().Dial("tcp", "team1:4041")
+	assert.Error(t, err, "not started")
+
+	err = n.Start(context.Background())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, id, n.ID())
+
+	port := strconv.Itoa(service.Addr().(*net.TCPAddr).Port)
+
+	conn, err := n.Dialer().DialContext(context.Background(), "tcp", net.JoinHostPort("team1", port))
+	if assert.NoError(t, err) {
+		_, err = conn.Write([]byte("ping"))
+		assert.NoError(t, err)
+
+		var buf [4]byte
+		_, err = io.ReadFull(conn, buf[:])
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(buf[:]))
+
+		conn.Close()
+	}
+
+	_, err = n.Dialer().Dial("tcp", "team9:4041")
+	assert.Error(t, err, "unknown member")
+
+	assert.NoError(t, n.Close())
+	assert.NoError(t, n.Close())
+
+	_, err = n.Dialer().Dial("tcp", net.JoinHostPort("team1", port))
+	assert.Error(t, err, "closed")
+	assert.Error(t, n.Start(context.Background()))
+}
+
+func TestListen(t *testing.T) {
+
+	var (
+		cryptoA, idA, memberA = nodetest.Member(t, "team1", "10.0.0.1")
+		cryptoB, idB, memberB = nodetest.Member(t, "team2", "10.0.0.2")
+		nodes                 = map[core.PeerID]common.Member{idA: memberA, idB: memberB}
+	)
+
+	// team2 serves a virtual port
+	b, err := New(Options{
+		ListenAddr: "127.0.0.1:0",
+		Crypto:     cryptoB,
+		Network:    &common.NetworkSettings{Nodes: nodes},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	err = b.Start(context.Background())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer b.Close()
+
+	l, err := b.Listen(4041)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, "10.0.0.2:4041", l.Addr().String())
+
+	_, err = b.Listen(4041)
+	assert.Error(t, err, "port is used")
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	// team1 reaches it through the network
+	a, err := New(Options{
+		ListenAddr: "127.0.0.1:0",
+		Crypto:     cryptoA,
+		Network: &common.NetworkSettings{
+			DHT:   common.DHTSettings{Bootstrap: []string{b.Addr()}},
+			Nodes: nodes,
+		},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	err = a.Start(context.Background())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer a.Close()
+
+	dialer := a.Dialer()
+	dialer.Hops = 1
+
+	conn, err := dialer.Dial("tcp", "team2:4041")
+	if assert.NoError(t, err) {
+		_, err = conn.Write([]byte("ping"))
+		assert.NoError(t, err)
+
+		var buf [4]byte
+		_, err = io.ReadFull(conn, buf[:])
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(buf[:]))
+
+		conn.Close()
+	}
+
+	// closed ports are refused
+	assert.NoError(t, l.Close())
+
+	_, err = dialer.Dial("tcp", "team2:4041")
+	assert.Error(t, err)
+}
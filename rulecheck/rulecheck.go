@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/derlaft/pe2pectf/common"
+)
+
+// rulecheck applies exit node rules to recorded streams:
+// rulecheck -rules=service.rules capture.pcapng [capture.pcap...]
+func main() {
+
+	rulesFile := flag.String("rules", "", "Rules file of a service")
+	verbose := flag.Bool("v", false, "Print streams without matches too")
+	flag.Parse()
+
+	if *rulesFile == "" || flag.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %v -rules=<file> <capture>...\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	rules, err := common.LoadExitRules(*rulesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var total, stopped int
+
+	for _, fname := range flag.Args() {
+
+		streams, err := common.ReadCapture(fname)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, stream := range streams {
+
+			verdict := rules.Replay(stream)
+
+			total++
+			if verdict.Action != "" {
+				stopped++
+			}
+
+			if len(verdict.Matches) == 0 && !*verbose {
+				continue
+			}
+
+			var action = verdict.Action
+			if action == "" {
+				action = "pass"
+			}
+
+			fmt.Printf("%v (%v -> %v): %v\n", stream.ID, stream.Client, stream.Server, action)
+			for _, match := range verdict.Matches {
+				fmt.Printf("\tline %v %q: %q\n", match.Line, match.Rule, match.Data)
+			}
+		}
+	}
+
+	fmt.Printf("%v streams, %v stopped\n", total, stopped)
+}
@@ -0,0 +1,124 @@
+package tun
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const tunDevice = "/dev/net/tun"
+
+type ifreqFlags struct {
+	Name  [syscall.IFNAMSIZ]byte
+	Flags uint16
+	_     [22]byte
+}
+
+type ifreqAddr struct {
+	Name [syscall.IFNAMSIZ]byte
+	Addr syscall.RawSockaddrInet4
+	_    [8]byte
+}
+
+type ifreqMTU struct {
+	Name [syscall.IFNAMSIZ]byte
+	MTU  int32
+	_    [20]byte
+}
+
+func ioctl(fd uintptr, request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Open creates a TUN device, assigns the address and brings it up.
+// The kernel routes the whole subnet of addr into the device.
+func Open(name string, addr *net.IPNet, mtu int) (*os.File, error) {
+
+	if len(name) >= syscall.IFNAMSIZ {
+		return nil, errors.Errorf("device name %v is too long", name)
+	}
+
+	if addr == nil || addr.IP.To4() == nil {
+		return nil, errors.New("an IPv4 device address is required")
+	}
+
+	dev, err := os.OpenFile(tunDevice, os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening tun device")
+	}
+
+	// create the interface
+	var req ifreqFlags
+	copy(req.Name[:], name)
+	req.Flags = syscall.IFF_TUN | syscall.IFF_NO_PI
+
+	err = ioctl(dev.Fd(), syscall.TUNSETIFF, unsafe.Pointer(&req))
+	if err != nil {
+		_ = dev.Close()
+		return nil, errors.Wrap(err, "creating tun interface")
+	}
+
+	err = configure(req.Name, addr, mtu)
+	if err != nil {
+		_ = dev.Close()
+		return nil, err
+	}
+
+	return dev, nil
+}
+
+// configure sets address, netmask and MTU of the interface and brings it up
+func configure(name [syscall.IFNAMSIZ]byte, addr *net.IPNet, mtu int) error {
+
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return errors.Wrap(err, "opening control socket")
+	}
+	defer syscall.Close(sock)
+
+	var fd = uintptr(sock)
+
+	setAddr := func(request uintptr, ip net.IP) error {
+		var req = ifreqAddr{Name: name}
+		req.Addr.Family = syscall.AF_INET
+		copy(req.Addr.Addr[:], ip.To4())
+		return ioctl(fd, request, unsafe.Pointer(&req))
+	}
+
+	err = setAddr(syscall.SIOCSIFADDR, addr.IP)
+	if err != nil {
+		return errors.Wrap(err, "setting interface address")
+	}
+
+	err = setAddr(syscall.SIOCSIFNETMASK, net.IP(addr.Mask))
+	if err != nil {
+		return errors.Wrap(err, "setting interface netmask")
+	}
+
+	var mtuReq = ifreqMTU{Name: name, MTU: int32(mtu)}
+	err = ioctl(fd, syscall.SIOCSIFMTU, unsafe.Pointer(&mtuReq))
+	if err != nil {
+		return errors.Wrap(err, "setting interface mtu")
+	}
+
+	var flags = ifreqFlags{Name: name}
+	err = ioctl(fd, syscall.SIOCGIFFLAGS, unsafe.Pointer(&flags))
+	if err != nil {
+		return errors.Wrap(err, "reading interface flags")
+	}
+
+	flags.Flags |= syscall.IFF_UP | syscall.IFF_RUNNING
+	err = ioctl(fd, syscall.SIOCSIFFLAGS, unsafe.Pointer(&flags))
+	if err != nil {
+		return errors.Wrap(err, "bringing interface up")
+	}
+
+	return nil
+}
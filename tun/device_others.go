@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package tun
+
+import (
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Open is only implemented on linux
+func Open(name string, addr *net.IPNet, mtu int) (*os.File, error) {
+	return nil, errors.New("tun devices are only supported on linux")
+}
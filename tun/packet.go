@@ -0,0 +1,196 @@
+package tun
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ipv4HeaderLen = 20
+	tcpHeaderLen  = 20
+
+	protoTCP = 6
+	protoUDP = 17
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+
+	tcpOptionEnd = 0
+	tcpOptionNop = 1
+	tcpOptionMSS = 2
+
+	defaultTTL = 64
+)
+
+// segment is a parsed IPv4 TCP packet
+type segment struct {
+	Src, Dst         net.IP
+	SrcPort, DstPort uint16
+	Seq, Ack         uint32
+	Flags            uint8
+	Window           uint16
+	MSS              uint16 // only set if present in the options
+	Payload          []byte
+}
+
+// parseIPv4 returns the protocol number and the payload of an IPv4 packet
+func parseIPv4(pkt []byte) (proto uint8, src, dst net.IP, payload []byte, err error) {
+
+	if len(pkt) < ipv4HeaderLen {
+		return 0, nil, nil, nil, errors.New("packet is too short")
+	}
+
+	if pkt[0]>>4 != 4 {
+		return 0, nil, nil, nil, errors.Errorf("unsupported IP version %v", pkt[0]>>4)
+	}
+
+	var (
+		headerLen = int(pkt[0]&0x0f) * 4
+		totalLen  = int(binary.BigEndian.Uint16(pkt[2:4]))
+		fragment  = binary.BigEndian.Uint16(pkt[6:8])
+	)
+
+	if headerLen < ipv4HeaderLen || totalLen < headerLen || totalLen > len(pkt) {
+		return 0, nil, nil, nil, errors.New("malformed IPv4 header")
+	}
+
+	// more fragments flag or non-zero fragment offset
+	if fragment&0x3fff != 0 {
+		return 0, nil, nil, nil, errors.New("fragmented packets are not supported")
+	}
+
+	return pkt[9], net.IP(pkt[12:16]), net.IP(pkt[16:20]), pkt[headerLen:totalLen], nil
+}
+
+// parseSegment decodes a TCP segment carried inside of an IPv4 packet
+func parseSegment(src, dst net.IP, data []byte) (*segment, error) {
+
+	if len(data) < tcpHeaderLen {
+		return nil, errors.New("segment is too short")
+	}
+
+	var offset = int(data[12]>>4) * 4
+	if offset < tcpHeaderLen || offset > len(data) {
+		return nil, errors.New("malformed TCP header")
+	}
+
+	if checksum(pseudoHeaderSum(src, dst, protoTCP, len(data)), data) != 0 {
+		return nil, errors.New("bad TCP checksum")
+	}
+
+	seg := &segment{
+		Src:     append(net.IP(nil), src...),
+		Dst:     append(net.IP(nil), dst...),
+		SrcPort: binary.BigEndian.Uint16(data[0:2]),
+		DstPort: binary.BigEndian.Uint16(data[2:4]),
+		Seq:     binary.BigEndian.Uint32(data[4:8]),
+		Ack:     binary.BigEndian.Uint32(data[8:12]),
+		Flags:   data[13],
+		Window:  binary.BigEndian.Uint16(data[14:16]),
+		Payload: append([]byte(nil), data[offset:]...),
+	}
+
+	// the only option we care about is MSS
+	for opts := data[tcpHeaderLen:offset]; len(opts) > 0; {
+		switch opts[0] {
+		case tcpOptionEnd:
+			opts = nil
+		case tcpOptionNop:
+			opts = opts[1:]
+		default:
+			if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+				return nil, errors.New("malformed TCP options")
+			}
+			if opts[0] == tcpOptionMSS && opts[1] == 4 {
+				seg.MSS = binary.BigEndian.Uint16(opts[2:4])
+			}
+			opts = opts[opts[1]:]
+		}
+	}
+
+	return seg, nil
+}
+
+// marshal encodes the segment into an IPv4 packet
+func (s *segment) marshal() []byte {
+
+	var optionsLen int
+	if s.MSS > 0 {
+		optionsLen = 4
+	}
+
+	var (
+		tcpLen = tcpHeaderLen + optionsLen + len(s.Payload)
+		pkt    = make([]byte, ipv4HeaderLen+tcpLen)
+		ip     = pkt[:ipv4HeaderLen]
+		tcp    = pkt[ipv4HeaderLen:]
+	)
+
+	// IPv4 header
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(ip[6:8], 0x4000) // don't fragment
+	ip[8] = defaultTTL
+	ip[9] = protoTCP
+	copy(ip[12:16], s.Src.To4())
+	copy(ip[16:20], s.Dst.To4())
+	binary.BigEndian.PutUint16(ip[10:12], checksum(0, ip))
+
+	// TCP header
+	binary.BigEndian.PutUint16(tcp[0:2], s.SrcPort)
+	binary.BigEndian.PutUint16(tcp[2:4], s.DstPort)
+	binary.BigEndian.PutUint32(tcp[4:8], s.Seq)
+	binary.BigEndian.PutUint32(tcp[8:12], s.Ack)
+	tcp[12] = uint8((tcpHeaderLen+optionsLen)/4) << 4
+	tcp[13] = s.Flags
+	binary.BigEndian.PutUint16(tcp[14:16], s.Window)
+
+	if s.MSS > 0 {
+		tcp[20] = tcpOptionMSS
+		tcp[21] = 4
+		binary.BigEndian.PutUint16(tcp[22:24], s.MSS)
+	}
+
+	copy(tcp[tcpHeaderLen+optionsLen:], s.Payload)
+
+	binary.BigEndian.PutUint16(tcp[16:18],
+		checksum(pseudoHeaderSum(s.Src, s.Dst, protoTCP, tcpLen), tcp))
+
+	return pkt
+}
+
+// pseudoHeaderSum returns the partial checksum of the TCP/UDP pseudo-header
+func pseudoHeaderSum(src, dst net.IP, proto uint8, length int) uint32 {
+
+	var sum uint32
+	for _, addr := range []net.IP{src.To4(), dst.To4()} {
+		sum += uint32(binary.BigEndian.Uint16(addr[0:2]))
+		sum += uint32(binary.BigEndian.Uint16(addr[2:4]))
+	}
+
+	return sum + uint32(proto) + uint32(length)
+}
+
+// checksum computes the internet checksum (RFC 1071) of data
+func checksum(initial uint32, data []byte) uint16 {
+
+	var sum = initial
+	for ; len(data) >= 2; data = data[2:] {
+		sum += uint32(binary.BigEndian.Uint16(data))
+	}
+
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+
+	return ^uint16(sum)
+}
@@ -0,0 +1,548 @@
+package tun
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// receiveWindow is the amount of data buffered towards the dialed connection
+	receiveWindow = 0xffff
+	// sendBufferSize limits the amount of unacknowledged data read from the dialed connection
+	sendBufferSize = 256 * 1024
+	// initialRTO is the first retransmission timeout
+	initialRTO = time.Second
+	// maxRTO caps the exponential backoff of retransmissions
+	maxRTO = time.Second * 16
+	// maxRetransmits is the amount of retries before the flow is reset
+	maxRetransmits = 8
+	// readChunk is the size of a single read from the dialed connection
+	readChunk = 16 * 1024
+)
+
+type flowState int
+
+const (
+	stateDialing flowState = iota
+	stateSynReceived
+	stateEstablished
+	stateClosed
+)
+
+// flowKey identifies a TCP flow (src is the host behind the TUN device)
+type flowKey struct {
+	src, dst         [4]byte
+	srcPort, dstPort uint16
+}
+
+func keyOf(seg *segment) flowKey {
+
+	var key = flowKey{
+		srcPort: seg.SrcPort,
+		dstPort: seg.DstPort,
+	}
+
+	copy(key.src[:], seg.Src.To4())
+	copy(key.dst[:], seg.Dst.To4())
+
+	return key
+}
+
+// halfCloser is implemented by connections that support sending EOF without closing;
+// for other connections (e.g. overlay circuits) a FIN of the host is not propagated:
+// the connection stays open until the dialed side closes it or the flow is reset
+type halfCloser interface {
+	CloseWrite() error
+}
+
+// flow terminates a single TCP connection and bridges it to a dialed net.Conn
+type flow struct {
+	server *Server
+	key    flowKey
+
+	lock  sync.Mutex
+	cond  *sync.Cond
+	state flowState
+	conn  net.Conn
+
+	// receive side (host -> conn)
+	rcvNxt     uint32
+	rcvQueued  int
+	rcvPending [][]byte
+	peerFin    bool
+
+	// send side (conn -> host)
+	iss        uint32
+	sndUna     uint32
+	sndNxt     uint32
+	sndWnd     uint32
+	sndBuf     []byte // data starting at sndBufSeq
+	sndBufSeq  uint32
+	mss        int
+	localFin   bool
+	finSent    bool
+	finAcked   bool
+	writerDone bool
+
+	rto         time.Duration
+	retransmits int
+	timer       *time.Timer
+}
+
+func seqLT(a, b uint32) bool  { return int32(a-b) < 0 }
+func seqLEQ(a, b uint32) bool { return int32(a-b) <= 0 }
+
+func newFlow(s *Server, seg *segment) *flow {
+
+	var isn [4]byte
+	_, _ = rand.Read(isn[:])
+
+	mss := s.mss()
+	if seg.MSS > 0 && int(seg.MSS) < mss {
+		mss = int(seg.MSS)
+	}
+
+	f := &flow{
+		server: s,
+		key:    keyOf(seg),
+		state:  stateDialing,
+		rcvNxt: seg.Seq + 1,
+		iss:    binary.BigEndian.Uint32(isn[:]),
+		sndWnd: uint32(seg.Window),
+		mss:    mss,
+		rto:    initialRTO,
+	}
+
+	f.sndUna = f.iss
+	f.sndNxt = f.iss
+	f.sndBufSeq = f.iss + 1
+	f.cond = sync.NewCond(&f.lock)
+
+	return f
+}
+
+// dial opens the outgoing connection and answers the initial SYN
+func (f *flow) dial(ctx context.Context) {
+
+	var (
+		dst  = net.IP(f.key.dst[:])
+		addr = net.JoinHostPort(dst.String(), strconv.Itoa(int(f.key.dstPort)))
+	)
+
+	conn, err := f.server.config.Dial(ctx, "tcp", addr)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err != nil {
+		log.Infof("Dial to %v failed: %v", addr, err)
+		f.sendRaw(0, f.rcvNxt, tcpRST|tcpACK, nil)
+		f.teardownLocked()
+		return
+	}
+
+	if f.state != stateDialing {
+		// flow was reset while dialing
+		_ = conn.Close()
+		return
+	}
+
+	log.Debugf("Flow %v established", addr)
+
+	f.conn = conn
+	f.state = stateSynReceived
+	f.sendSynAck()
+	f.sndNxt = f.iss + 1
+	f.armTimer()
+}
+
+func (f *flow) sendSynAck() {
+
+	seg := f.reply(f.iss, f.rcvNxt, tcpSYN|tcpACK, nil)
+	seg.MSS = uint16(f.mss)
+
+	f.server.writeSegment(seg)
+}
+
+// reply constructs a segment travelling back to the host
+func (f *flow) reply(seq, ack uint32, flags uint8, payload []byte) *segment {
+	return &segment{
+		Src:     net.IP(append([]byte(nil), f.key.dst[:]...)),
+		Dst:     net.IP(append([]byte(nil), f.key.src[:]...)),
+		SrcPort: f.key.dstPort,
+		DstPort: f.key.srcPort,
+		Seq:     seq,
+		Ack:     ack,
+		Flags:   flags,
+		Window:  f.window(),
+		Payload: payload,
+	}
+}
+
+func (f *flow) sendRaw(seq, ack uint32, flags uint8, payload []byte) {
+	f.server.writeSegment(f.reply(seq, ack, flags, payload))
+}
+
+func (f *flow) sendAck() {
+	f.sendRaw(f.sndNxt, f.rcvNxt, tcpACK, nil)
+}
+
+// window is the amount of data the host is allowed to send
+func (f *flow) window() uint16 {
+
+	var free = receiveWindow - f.rcvQueued
+	if free < 0 {
+		free = 0
+	}
+
+	return uint16(free)
+}
+
+// handle processes a segment received from the host
+func (f *flow) handle(seg *segment) {
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch {
+	case f.state == stateClosed:
+		return
+
+	case seg.Flags&tcpRST != 0:
+		log.Debugf("Flow reset by the host")
+		f.teardownLocked()
+		return
+
+	case seg.Flags&tcpSYN != 0:
+		// retransmitted SYN - still dialing or SYN-ACK was lost
+		if f.state == stateSynReceived {
+			f.sendSynAck()
+		}
+		return
+
+	case f.state == stateDialing || seg.Flags&tcpACK == 0:
+		return
+	}
+
+	f.processAck(seg)
+
+	if f.state != stateEstablished {
+		return
+	}
+
+	f.processData(seg)
+	f.trySend()
+	f.maybeFinish()
+}
+
+func (f *flow) processAck(seg *segment) {
+
+	// ack for something never sent
+	if seqLT(f.sndNxt, seg.Ack) {
+		f.sendAck()
+		return
+	}
+
+	f.sndWnd = uint32(seg.Window)
+
+	if seqLEQ(seg.Ack, f.sndUna) {
+		return
+	}
+
+	if f.state == stateSynReceived {
+		f.state = stateEstablished
+		go f.readLoop()
+		go f.writeLoop()
+	}
+
+	// drop acknowledged data from the buffer
+	acked := int(seg.Ack - f.sndBufSeq)
+	if acked > len(f.sndBuf) {
+		acked = len(f.sndBuf)
+	}
+	if acked > 0 {
+		f.sndBuf = f.sndBuf[acked:]
+		f.sndBufSeq += uint32(acked)
+		f.cond.Broadcast()
+	}
+
+	if f.finSent && seg.Ack == f.sndNxt {
+		f.finAcked = true
+	}
+
+	f.sndUna = seg.Ack
+	f.rto = initialRTO
+	f.retransmits = 0
+	f.stopTimer()
+
+	if f.sndUna != f.sndNxt {
+		f.armTimer()
+	}
+}
+
+func (f *flow) processData(seg *segment) {
+
+	var length = len(seg.Payload)
+	if seg.Flags&tcpFIN != 0 {
+		length++
+	}
+
+	if length == 0 {
+		return
+	}
+
+	// only in-order segments are accepted, everything else is retransmitted by the host
+	if seg.Seq != f.rcvNxt || f.peerFin {
+		f.sendAck()
+		return
+	}
+
+	if len(seg.Payload) > 0 {
+
+		if len(seg.Payload) > int(f.window()) {
+			f.sendAck()
+			return
+		}
+
+		f.rcvQueued += len(seg.Payload)
+		f.rcvNxt += uint32(len(seg.Payload))
+		f.rcvPending = append(f.rcvPending, seg.Payload)
+	}
+
+	if seg.Flags&tcpFIN != 0 {
+		f.rcvNxt++
+		f.peerFin = true
+	}
+
+	f.cond.Broadcast()
+
+	f.sendAck()
+}
+
+// trySend transmits buffered data permitted by the host window
+func (f *flow) trySend() {
+
+	if f.state != stateEstablished {
+		return
+	}
+
+	for {
+		var (
+			offset   = int(f.sndNxt - f.sndBufSeq)
+			inFlight = f.sndNxt - f.sndUna
+			size     = len(f.sndBuf) - offset
+		)
+
+		if size <= 0 || inFlight >= f.sndWnd {
+			break
+		}
+
+		if size > f.mss {
+			size = f.mss
+		}
+		if uint32(size) > f.sndWnd-inFlight {
+			size = int(f.sndWnd - inFlight)
+		}
+
+		f.sendRaw(f.sndNxt, f.rcvNxt, tcpACK|tcpPSH, f.sndBuf[offset:offset+size])
+		f.sndNxt += uint32(size)
+	}
+
+	if f.localFin && !f.finSent && int(f.sndNxt-f.sndBufSeq) == len(f.sndBuf) {
+		f.sendRaw(f.sndNxt, f.rcvNxt, tcpFIN|tcpACK, nil)
+		f.sndNxt++
+		f.finSent = true
+	}
+
+	// keep the timer running while there is something to (re)send
+	if f.sndUna != f.sndNxt || int(f.sndNxt-f.sndBufSeq) < len(f.sndBuf) {
+		f.armTimer()
+	}
+}
+
+func (f *flow) armTimer() {
+	if f.timer == nil {
+		f.timer = time.AfterFunc(f.rto, f.onTimeout)
+	}
+}
+
+func (f *flow) stopTimer() {
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+}
+
+// onTimeout retransmits everything not acknowledged yet (go-back-N)
+func (f *flow) onTimeout() {
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.timer = nil
+
+	if f.state == stateClosed {
+		return
+	}
+
+	f.retransmits++
+	if f.retransmits > maxRetransmits {
+		log.Debugf("Flow timed out, resetting")
+		f.sendRaw(f.sndNxt, f.rcvNxt, tcpRST|tcpACK, nil)
+		f.teardownLocked()
+		return
+	}
+
+	f.rto *= 2
+	if f.rto > maxRTO {
+		f.rto = maxRTO
+	}
+
+	if f.state == stateSynReceived {
+		f.sendSynAck()
+		f.armTimer()
+		return
+	}
+
+	f.sndNxt = f.sndUna
+	if f.finSent && !f.finAcked {
+		f.finSent = false
+	}
+
+	// zero window probe
+	if f.sndWnd == 0 && len(f.sndBuf) > 0 {
+		f.sendRaw(f.sndNxt, f.rcvNxt, tcpACK, f.sndBuf[:1])
+		f.sndNxt++
+		f.armTimer()
+		return
+	}
+
+	f.trySend()
+}
+
+// readLoop moves data from the dialed connection into the send buffer
+func (f *flow) readLoop() {
+
+	var buf = make([]byte, readChunk)
+
+	for {
+		n, err := f.conn.Read(buf)
+
+		f.lock.Lock()
+
+		for f.state != stateClosed && len(f.sndBuf) >= sendBufferSize {
+			f.cond.Wait()
+		}
+
+		if f.state == stateClosed {
+			f.lock.Unlock()
+			return
+		}
+
+		f.sndBuf = append(f.sndBuf, buf[:n]...)
+
+		if err != nil {
+			if err != io.EOF {
+				log.Debugf("Reading from dialed connection: %v", err)
+			}
+			f.localFin = true
+		}
+
+		f.trySend()
+		f.maybeFinish()
+		f.lock.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeLoop moves data received from the host into the dialed connection
+func (f *flow) writeLoop() {
+
+	for {
+		f.lock.Lock()
+
+		for f.state != stateClosed && len(f.rcvPending) == 0 && !f.peerFin {
+			f.cond.Wait()
+		}
+
+		if f.state == stateClosed {
+			f.lock.Unlock()
+			return
+		}
+
+		if len(f.rcvPending) == 0 {
+			// the host has sent FIN and everything is written
+			f.lock.Unlock()
+			break
+		}
+
+		data := f.rcvPending[0]
+		f.rcvPending = f.rcvPending[1:]
+		f.lock.Unlock()
+
+		_, err := f.conn.Write(data)
+
+		f.lock.Lock()
+
+		if err != nil {
+			log.Debugf("Writing to dialed connection: %v", err)
+			f.sendRaw(f.sndNxt, f.rcvNxt, tcpRST|tcpACK, nil)
+			f.teardownLocked()
+			f.lock.Unlock()
+			return
+		}
+
+		var wasFull = f.window() < uint16(f.mss)
+		f.rcvQueued -= len(data)
+
+		// window update
+		if wasFull && f.state == stateEstablished {
+			f.sendAck()
+		}
+
+		f.lock.Unlock()
+	}
+
+	// closing the whole connection here would drop the response, see halfCloser
+	if hc, ok := f.conn.(halfCloser); ok {
+		_ = hc.CloseWrite()
+	}
+
+	f.lock.Lock()
+	f.writerDone = true
+	f.maybeFinish()
+	f.lock.Unlock()
+}
+
+// maybeFinish removes the flow once both directions are closed
+func (f *flow) maybeFinish() {
+	if f.peerFin && f.finAcked && f.writerDone {
+		f.teardownLocked()
+	}
+}
+
+func (f *flow) teardownLocked() {
+
+	if f.state == stateClosed {
+		return
+	}
+
+	f.state = stateClosed
+	f.stopTimer()
+	f.cond.Broadcast()
+
+	if f.conn != nil {
+		_ = f.conn.Close()
+	}
+
+	f.server.removeFlow(f)
+}
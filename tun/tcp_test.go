@@ -0,0 +1,346 @@
+package tun
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDevice passes packets through channels instead of a real TUN device
+type fakeDevice struct {
+	toServer   chan []byte
+	fromServer chan []byte
+}
+
+func (d *fakeDevice) Read(p []byte) (int, error) {
+	pkt, ok := <-d.toServer
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(p, pkt), nil
+}
+
+func (d *fakeDevice) Write(p []byte) (int, error) {
+	d.fromServer <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (d *fakeDevice) expect(t *testing.T) *segment {
+
+	select {
+	case pkt := <-d.fromServer:
+		proto, src, dst, payload, err := parseIPv4(pkt)
+		if !assert.NoError(t, err) || !assert.Equal(t, uint8(protoTCP), proto) {
+			t.FailNow()
+		}
+
+		seg, err := parseSegment(src, dst, payload)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return seg
+
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for a packet")
+		return nil
+	}
+}
+
+func TestFlow(t *testing.T) {
+
+	var (
+		host   = net.IPv4(10, 0, 0, 254).To4()
+		remote = net.IPv4(10, 0, 0, 2).To4()
+		dev    = &fakeDevice{
+			toServer:   make(chan []byte, 16),
+			fromServer: make(chan []byte, 16),
+		}
+		dialed = make(chan string, 1)
+	)
+
+	server, err := New(&Config{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed <- addr
+
+			inside, outside := net.Pipe()
+			go func() {
+				buf := make([]byte, 4)
+				_, err := io.ReadFull(inside, buf)
+				if err == nil && string(buf) == "ping" {
+					_, _ = inside.Write([]byte("pong"))
+				}
+				_ = inside.Close()
+			}()
+			return outside, nil
+		},
+	})
+	assert.NoError(t, err)
+
+	go func() { _ = server.Serve(dev) }()
+	defer close(dev.toServer)
+
+	send := func(seq, ack uint32, flags uint8, payload []byte) {
+		dev.toServer <- (&segment{
+			Src:     host,
+			Dst:     remote,
+			SrcPort: 40000,
+			DstPort: 4041,
+			Seq:     seq,
+			Ack:     ack,
+			Flags:   flags,
+			Window:  0xffff,
+			Payload: payload,
+		}).marshal()
+	}
+
+	// handshake
+	send(1000, 0, tcpSYN, nil)
+
+	assert.Equal(t, "10.0.0.2:4041", <-dialed)
+
+	synAck := dev.expect(t)
+	assert.Equal(t, uint8(tcpSYN|tcpACK), synAck.Flags)
+	assert.Equal(t, uint32(1001), synAck.Ack)
+	assert.Equal(t, uint16(DefaultMTU-40), synAck.MSS)
+
+	send(1001, synAck.Seq+1, tcpACK|tcpPSH, []byte("ping"))
+
+	// ack for the data
+	ack := dev.expect(t)
+	assert.Equal(t, uint32(1005), ack.Ack)
+
+	// the dialed side answers and closes
+	data := dev.expect(t)
+	assert.Equal(t, "pong", string(data.Payload))
+	assert.Equal(t, synAck.Seq+1, data.Seq)
+
+	fin := dev.expect(t)
+	assert.Equal(t, uint8(tcpFIN|tcpACK), fin.Flags)
+	assert.Equal(t, synAck.Seq+5, fin.Seq)
+
+	send(1005, fin.Seq+1, tcpFIN|tcpACK, nil)
+
+	last := dev.expect(t)
+	assert.Equal(t, uint32(1006), last.Ack)
+}
+
+func TestDialFailure(t *testing.T) {
+
+	var dev = &fakeDevice{
+		toServer:   make(chan []byte, 1),
+		fromServer: make(chan []byte, 1),
+	}
+
+	server, err := New(&Config{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, io.ErrUnexpectedEOF
+		},
+	})
+	assert.NoError(t, err)
+
+	go func() { _ = server.Serve(dev) }()
+	defer close(dev.toServer)
+
+	dev.toServer <- (&segment{
+		Src:     net.IPv4(10, 0, 0, 254).To4(),
+		Dst:     net.IPv4(10, 0, 0, 3).To4(),
+		SrcPort: 40000,
+		DstPort: 80,
+		Seq:     41,
+		Flags:   tcpSYN,
+		Window:  0xffff,
+	}).marshal()
+
+	rst := dev.expect(t)
+	assert.Equal(t, uint8(tcpRST|tcpACK), rst.Flags)
+	assert.Equal(t, uint32(42), rst.Ack)
+}
+
+func TestDialTimeout(t *testing.T) {
+
+	var (
+		dev = &fakeDevice{
+			toServer:   make(chan []byte, 1),
+			fromServer: make(chan []byte, 1),
+		}
+		dialing = make(chan context.Context, 1)
+	)
+
+	server, err := New(&Config{
+		DialTimeout: time.Minute,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialing <- ctx
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+	assert.NoError(t, err)
+
+	go func() { _ = server.Serve(dev) }()
+
+	dev.toServer <- (&segment{
+		Src:     net.IPv4(10, 0, 0, 254).To4(),
+		Dst:     net.IPv4(10, 0, 0, 3).To4(),
+		SrcPort: 40000,
+		DstPort: 80,
+		Seq:     41,
+		Flags:   tcpSYN,
+		Window:  0xffff,
+	}).marshal()
+
+	var ctx = <-dialing
+
+	deadline, found := ctx.Deadline()
+	assert.True(t, found)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second*5)
+
+	// closing the device aborts the dial
+	close(dev.toServer)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("the dial was not aborted")
+	}
+
+	rst := dev.expect(t)
+	assert.Equal(t, uint8(tcpRST|tcpACK), rst.Flags)
+}
+
+func TestMaxFlows(t *testing.T) {
+
+	var (
+		dev = &fakeDevice{
+			toServer:   make(chan []byte, 2),
+			fromServer: make(chan []byte, 2),
+		}
+		dialed = make(chan struct{}, 2)
+	)
+
+	server, err := New(&Config{
+		MaxFlows: 1,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed <- struct{}{}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+	assert.NoError(t, err)
+
+	go func() { _ = server.Serve(dev) }()
+	defer close(dev.toServer)
+
+	for _, port := range []uint16{40000, 40001} {
+		dev.toServer <- (&segment{
+			Src:     net.IPv4(10, 0, 0, 254).To4(),
+			Dst:     net.IPv4(10, 0, 0, 3).To4(),
+			SrcPort: port,
+			DstPort: 80,
+			Seq:     41,
+			Flags:   tcpSYN,
+			Window:  0xffff,
+		}).marshal()
+	}
+
+	// the second SYN is over the limit and is reset without dialing
+	rst := dev.expect(t)
+	assert.Equal(t, uint8(tcpRST|tcpACK), rst.Flags)
+	assert.Equal(t, uint16(40001), rst.DstPort)
+	assert.Equal(t, uint32(42), rst.Ack)
+
+	<-dialed
+	assert.Len(t, dialed, 0)
+}
+
+// pipeConn is a net.Conn without CloseWrite
+type pipeConn struct {
+	net.Conn
+}
+
+func TestHostFin(t *testing.T) {
+
+	for _, halfClose := range []bool{true, false} {
+
+		var (
+			host   = net.IPv4(10, 0, 0, 254).To4()
+			remote = net.IPv4(10, 0, 0, 2).To4()
+			dev    = &fakeDevice{
+				toServer:   make(chan []byte, 16),
+				fromServer: make(chan []byte, 16),
+			}
+			gotEOF = make(chan bool, 1)
+		)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			buf := make([]byte, 4)
+			_, _ = io.ReadFull(conn, buf)
+			_, _ = conn.Write([]byte("pong"))
+
+			// wait for the FIN of the host
+			_ = conn.SetReadDeadline(time.Now().Add(time.Millisecond * 300))
+			_, err = conn.Read(buf)
+			gotEOF <- err == io.EOF
+		}()
+
+		server, err := New(&Config{
+			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil || halfClose {
+					return conn, err
+				}
+				return pipeConn{conn}, nil
+			},
+		})
+		assert.NoError(t, err)
+
+		go func() { _ = server.Serve(dev) }()
+
+		send := func(seq, ack uint32, flags uint8, payload []byte) {
+			dev.toServer <- (&segment{
+				Src:     host,
+				Dst:     remote,
+				SrcPort: 40000,
+				DstPort: 4041,
+				Seq:     seq,
+				Ack:     ack,
+				Flags:   flags,
+				Window:  0xffff,
+				Payload: payload,
+			}).marshal()
+		}
+
+		send(1000, 0, tcpSYN, nil)
+		synAck := dev.expect(t)
+
+		// the host sends its request and closes its side right away
+		send(1001, synAck.Seq+1, tcpACK|tcpPSH|tcpFIN, []byte("ping"))
+
+		ack := dev.expect(t)
+		assert.Equal(t, uint32(1006), ack.Ack)
+
+		// the response is delivered either way
+		data := dev.expect(t)
+		assert.Equal(t, "pong", string(data.Payload))
+
+		// only a connection with CloseWrite learns about the FIN
+		assert.Equal(t, halfClose, <-gotEOF)
+
+		close(dev.toServer)
+		_ = ln.Close()
+	}
+}
@@ -0,0 +1,236 @@
+// Package tun terminates TCP flows arriving on a TUN device and bridges them to dialed connections
+package tun
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	golog "github.com/ipfs/go-log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultMTU is used if Config.MTU is not set
+	DefaultMTU = 1400
+	// DefaultDialTimeout is used if Config.DialTimeout is not set
+	DefaultDialTimeout = time.Second * 15
+	// DefaultMaxFlows is used if Config.MaxFlows is not set
+	DefaultMaxFlows = 1024
+)
+
+var log = golog.Logger("pe2pe_tun") //nolint:gochecknoglobals
+
+// Config is used to setup and configure a Server
+type Config struct {
+	// Name of the TUN device to create
+	Name string
+
+	// Addr is the address of the device; its mask defines the routed subnet
+	Addr *net.IPNet
+
+	// MTU of the device, defaults to DefaultMTU
+	MTU int
+
+	// Dial is used to open outgoing connections for incoming flows
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// DialTimeout limits Dial, defaults to DefaultDialTimeout
+	DialTimeout time.Duration
+
+	// MaxFlows limits the amount of concurrent flows, defaults to DefaultMaxFlows;
+	// SYNs above the limit are answered with RST
+	MaxFlows int
+}
+
+// Server reads IP packets from a device and serves TCP flows found in them
+type Server struct {
+	config *Config
+
+	// dials are aborted once the device is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	writeLock sync.Mutex
+	device    io.ReadWriter
+
+	flowsLock sync.Mutex
+	flows     map[flowKey]*flow
+}
+
+// New creates a new Server and potentially returns an error
+func New(conf *Config) (*Server, error) {
+
+	if conf.Dial == nil {
+		return nil, errors.New("dial function is required")
+	}
+
+	if conf.MTU == 0 {
+		conf.MTU = DefaultMTU
+	}
+
+	if conf.DialTimeout == 0 {
+		conf.DialTimeout = DefaultDialTimeout
+	}
+
+	if conf.MaxFlows == 0 {
+		conf.MaxFlows = DefaultMaxFlows
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Server{
+		config: conf,
+		ctx:    ctx,
+		cancel: cancel,
+		flows:  make(map[flowKey]*flow),
+	}, nil
+}
+
+// ListenAndServe creates the TUN device and serves it
+func (s *Server) ListenAndServe() error {
+
+	dev, err := Open(s.config.Name, s.config.Addr, s.config.MTU)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(dev)
+}
+
+// Serve reads packets from the device until it is closed
+func (s *Server) Serve(dev io.ReadWriter) error {
+
+	s.device = dev
+	defer s.cancel()
+
+	var buf = make([]byte, s.config.MTU+ipv4HeaderLen)
+
+	for {
+		n, err := dev.Read(buf)
+		if err != nil {
+			return err
+		}
+
+		s.handlePacket(buf[:n])
+	}
+}
+
+func (s *Server) handlePacket(pkt []byte) {
+
+	proto, src, dst, payload, err := parseIPv4(pkt)
+	if err != nil {
+		log.Debugf("Dropping packet: %v", err)
+		return
+	}
+
+	switch proto {
+	case protoTCP:
+	case protoUDP:
+		// overlay streams are TCP-only, there is nothing to carry datagrams over
+		log.Debugf("Dropping UDP packet %v -> %v: datagrams are not supported", src, dst)
+		return
+	default:
+		log.Debugf("Dropping packet %v -> %v with protocol %v", src, dst, proto)
+		return
+	}
+
+	seg, err := parseSegment(src, dst, payload)
+	if err != nil {
+		log.Debugf("Dropping TCP segment %v -> %v: %v", src, dst, err)
+		return
+	}
+
+	var key = keyOf(seg)
+
+	s.flowsLock.Lock()
+	f, found := s.flows[key]
+
+	var syn = !found && seg.Flags&(tcpSYN|tcpACK|tcpRST) == tcpSYN
+
+	if syn && len(s.flows) >= s.config.MaxFlows {
+		s.flowsLock.Unlock()
+		log.Infof("Refusing flow %v -> %v:%v: too many flows", seg.Src, seg.Dst, seg.DstPort)
+		s.resetUnknown(seg)
+		return
+	}
+
+	if syn {
+		f = newFlow(s, seg)
+		s.flows[key] = f
+		s.flowsLock.Unlock()
+
+		go func() {
+			ctx, cancel := context.WithTimeout(s.ctx, s.config.DialTimeout)
+			defer cancel()
+
+			f.dial(ctx)
+		}()
+		return
+	}
+
+	s.flowsLock.Unlock()
+
+	if !found {
+		s.resetUnknown(seg)
+		return
+	}
+
+	f.handle(seg)
+}
+
+// resetUnknown answers segments of unknown flows with RST
+func (s *Server) resetUnknown(seg *segment) {
+
+	if seg.Flags&tcpRST != 0 {
+		return
+	}
+
+	var reply = &segment{
+		Src:     seg.Dst,
+		Dst:     seg.Src,
+		SrcPort: seg.DstPort,
+		DstPort: seg.SrcPort,
+		Flags:   tcpRST,
+	}
+
+	if seg.Flags&tcpACK != 0 {
+		reply.Seq = seg.Ack
+	} else {
+		reply.Flags |= tcpACK
+		reply.Ack = seg.Seq + uint32(len(seg.Payload))
+		if seg.Flags&(tcpSYN|tcpFIN) != 0 {
+			reply.Ack++
+		}
+	}
+
+	s.writeSegment(reply)
+}
+
+func (s *Server) writeSegment(seg *segment) {
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	_, err := s.device.Write(seg.marshal())
+	if err != nil {
+		log.Errorf("Failed to write packet: %v", err)
+	}
+}
+
+func (s *Server) removeFlow(f *flow) {
+
+	s.flowsLock.Lock()
+	defer s.flowsLock.Unlock()
+
+	if s.flows[f.key] == f {
+		delete(s.flows, f.key)
+	}
+}
+
+// mss is the maximum segment size allowed by the device MTU
+func (s *Server) mss() int {
+	return s.config.MTU - ipv4HeaderLen - tcpHeaderLen
+}